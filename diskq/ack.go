@@ -0,0 +1,246 @@
+package diskq
+
+import (
+	"bufio"
+	"context"
+	"time"
+)
+
+// compactInFlightSlack is the number of acked entries tolerated before the
+// in-flight entries are compacted
+const compactInFlightSlack = 64
+
+// delivery is a message handed out by Get
+type delivery struct {
+	id      uint64
+	attempt int
+	data    []byte
+}
+
+type ackRequest struct {
+	id      uint64
+	attempt int
+	ack     bool
+}
+
+// inFlight tracks a message read past by Get or ReadChan until it is committed,
+// consecutive acked entries are merged into one
+type inFlight struct {
+	// id is 0 for messages consumed via ReadChan and skipped bad files
+	id uint64
+	// position of the message, it is read back from there when redelivered
+	fileNum int64
+	pos     int64
+	// position right after the message, the committed position moves here
+	nextFileNum int64
+	nextPos     int64
+	// count is the number of messages removed from depth when committed
+	count int64
+
+	attempts int
+	deadline time.Time
+	acked    bool
+	// queued means waiting in the redelivery queue
+	queued bool
+}
+
+// Get blocks until a message is available, the message is redelivered if
+// nack is called or neither ack nor nack is called within the visibility
+// timeout, it returns ErrExiting once the queue is closed
+func (d *DiskQueue) Get() ([]byte, func(), func(), error) {
+	return d.GetCtx(context.Background())
+}
+
+func (d *DiskQueue) GetCtx(ctx context.Context) ([]byte, func(), func(), error) {
+	select {
+	case m := <-d.getChan:
+		ack := func() {
+			d.sendAck(ackRequest{id: m.id, attempt: m.attempt, ack: true})
+		}
+		nack := func() {
+			d.sendAck(ackRequest{id: m.id, attempt: m.attempt, ack: false})
+		}
+		return m.data, ack, nack, nil
+	case <-ctx.Done():
+		return nil, nil, nil, ctx.Err()
+	case <-d.exitChan:
+		return nil, nil, nil, ErrExiting
+	}
+}
+
+func (d *DiskQueue) sendAck(req ackRequest) {
+	select {
+	case d.ackChan <- req:
+	case <-d.exitChan:
+		// not acked messages are redelivered after restart
+	}
+}
+
+// track records the message read ahead as in flight and moves the read
+// position past it
+func (d *DiskQueue) track(f *inFlight) {
+	f.fileNum = d.readFileNum
+	f.pos = d.readPos
+	f.nextFileNum = d.nextReadFileNum
+	f.nextPos = d.nextReadPos
+	f.count = 1
+	d.appendInFlight(f)
+	if f.id > 0 {
+		d.inFlightIndex[f.id] = f
+	}
+	d.moveRead()
+}
+
+// appendInFlight merges an acked entry into the last one if it is acked too
+func (d *DiskQueue) appendInFlight(f *inFlight) {
+	if n := len(d.inFlight); f.acked && n > 0 && d.inFlight[n-1].acked {
+		last := d.inFlight[n-1]
+		last.nextFileNum = f.nextFileNum
+		last.nextPos = f.nextPos
+		last.count += f.count
+		return
+	}
+	d.inFlight = append(d.inFlight, f)
+}
+
+// compactInFlight merges the runs of acked entries left behind an un-acked
+// one, so that the entries are bounded by the un-acked messages
+func (d *DiskQueue) compactInFlight() {
+	if len(d.inFlight) <= 2*d.unacked+compactInFlightSlack {
+		return
+	}
+	entries := d.inFlight
+	d.inFlight = make([]*inFlight, 0, 2*d.unacked+1)
+	for _, f := range entries {
+		d.appendInFlight(f)
+	}
+}
+
+// redelivery reads the message at the head of the redelivery queue back from
+// disk, it is kept until handed out
+func (d *DiskQueue) redelivery() (delivery, bool) {
+	for len(d.redeliver) > 0 {
+		f := d.redeliver[0]
+		if d.redeliverHead == f {
+			return d.redeliverPending, true
+		}
+		data, err := d.readAt(f.fileNum, f.pos)
+		if err == nil {
+			d.redeliverHead = f
+			d.redeliverPending = delivery{id: f.id, attempt: f.attempts + 1, data: data}
+			return d.redeliverPending, true
+		}
+		// the message cannot be redelivered, it is dropped as if acked
+		d.logf(ERROR, "DISKQUEUE(%s) failed to read message %d back at %d of %s, dropping it - %s",
+			d.name, f.id, f.pos, d.fileName(f.fileNum), err)
+		d.handleAck(ackRequest{id: f.id, ack: true})
+	}
+	return delivery{}, false
+}
+
+// readAt reads the message at pos of the given file
+func (d *DiskQueue) readAt(fileNum int64, pos int64) ([]byte, error) {
+	r, _, err := d.openSegment(fileNum, pos)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, _, err := decodeRecord(bufio.NewReader(r), d.minMsgSize, d.maxMsgSize)
+	return data, err
+}
+
+// handOut is called once a delivery has been received by Get
+func (d *DiskQueue) handOut(m delivery) {
+	if m.attempt > 1 {
+		f := d.redeliver[0]
+		d.redeliver[0] = nil
+		d.redeliver = d.redeliver[1:]
+		d.redeliverHead = nil
+		d.redeliverPending = delivery{}
+		f.queued = false
+		f.attempts = m.attempt
+		f.deadline = time.Now().Add(d.visibilityTimeout)
+		return
+	}
+	d.lastID = m.id
+	d.unacked++
+	d.track(&inFlight{
+		id:       m.id,
+		attempts: 1,
+		deadline: time.Now().Add(d.visibilityTimeout),
+	})
+}
+
+func (d *DiskQueue) handleAck(req ackRequest) {
+	f := d.inFlightIndex[req.id]
+	if f == nil || f.acked {
+		return
+	}
+	if !req.ack {
+		// ignore nack from a consumer whose delivery has already expired
+		if f.attempts != req.attempt || f.queued {
+			return
+		}
+		f.queued = true
+		d.redeliver = append(d.redeliver, f)
+		return
+	}
+
+	f.acked = true
+	delete(d.inFlightIndex, f.id)
+	d.unacked--
+	if f.queued {
+		for i, queued := range d.redeliver {
+			if queued == f {
+				d.redeliver = append(d.redeliver[:i], d.redeliver[i+1:]...)
+				break
+			}
+		}
+		f.queued = false
+		if d.redeliverHead == f {
+			d.redeliverHead = nil
+			d.redeliverPending = delivery{}
+		}
+	}
+	d.commit()
+	d.compactInFlight()
+}
+
+// commit moves the committed position past the acked messages at the head
+func (d *DiskQueue) commit() {
+	for len(d.inFlight) > 0 && d.inFlight[0].acked {
+		f := d.inFlight[0]
+		d.inFlight[0] = nil
+		d.inFlight = d.inFlight[1:]
+		d.moveCommit(f.nextFileNum, f.nextPos, f.count)
+	}
+	if len(d.inFlight) == 0 {
+		d.checkTailCorruption(d.depth)
+	}
+}
+
+// requeueExpired schedules the messages not acked in time for redelivery
+func (d *DiskQueue) requeueExpired() {
+	if d.unacked == 0 {
+		return
+	}
+	now := time.Now()
+	for _, f := range d.inFlight {
+		if f.acked || f.queued || now.Before(f.deadline) {
+			continue
+		}
+		d.logf(WARN, "DISKQUEUE(%s) message %d not acked after %s, redelivering",
+			d.name, f.id, d.visibilityTimeout)
+		f.queued = true
+		d.redeliver = append(d.redeliver, f)
+	}
+}
+
+func (d *DiskQueue) resetInFlight() {
+	d.inFlight = nil
+	d.inFlightIndex = make(map[uint64]*inFlight)
+	d.redeliver = nil
+	d.redeliverHead = nil
+	d.redeliverPending = delivery{}
+	d.unacked = 0
+}
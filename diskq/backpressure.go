@@ -0,0 +1,122 @@
+package diskq
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrFull = errors.New("queue full")
+
+// spaceSignal is closed (and replaced) by ioLoop once a full queue has room
+// again, writers blocked by WithBlockOnFull wait on it
+type spaceSignal struct {
+	sync.Mutex
+	ch chan struct{}
+}
+
+func (s *spaceSignal) wait() <-chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+	return s.ch
+}
+
+func (s *spaceSignal) broadcast() {
+	s.Lock()
+	defer s.Unlock()
+	close(s.ch)
+	s.ch = make(chan struct{})
+}
+
+// LowWaterChan receives a notification every time the depth drops below the
+// low-water mark set by WithLowWaterMark, notifications are dropped while one
+// is pending
+func (d *DiskQueue) LowWaterChan() <-chan struct{} {
+	return d.lowWaterChan
+}
+
+// put retries the write once there is room when the queue is full and
+// writers block, waiting happens outside the lock so that Close is not held
+func (d *DiskQueue) put(ctx context.Context, write func() error) error {
+	for {
+		space := d.space.wait()
+		err := write()
+		if err != ErrFull || !d.blockOnFull {
+			return err
+		}
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.exitChan:
+			return ErrExiting
+		}
+	}
+}
+
+// checkFull returns ErrFull if count more messages of size bytes would exceed
+// the limits, a queue holding no message accepts any write
+func (d *DiskQueue) checkFull(count int64, bytes int64) error {
+	if d.depth == 0 {
+		return nil
+	}
+	if d.maxDepth > 0 && d.depth+count > d.maxDepth {
+		d.full = true
+		return ErrFull
+	}
+	if d.maxBytes > 0 && d.backlogBytes()+bytes > d.maxBytes {
+		d.full = true
+		return ErrFull
+	}
+	return nil
+}
+
+// checkWaterMarks is called by ioLoop, it wakes the blocked writers up once
+// the queue has room and notifies LowWaterChan
+func (d *DiskQueue) checkWaterMarks() {
+	if d.full && d.checkFull(0, 0) == nil {
+		d.full = false
+		d.space.broadcast()
+	}
+
+	if d.lowWaterMark > 0 {
+		below := d.depth < d.lowWaterMark
+		if below && !d.belowLowWater {
+			select {
+			case d.lowWaterChan <- struct{}{}:
+			default:
+			}
+		}
+		d.belowLowWater = below
+	}
+}
+
+// backlogBytes returns the number of bytes between the committed position
+// and the write position
+func (d *DiskQueue) backlogBytes() int64 {
+	for fileNum := range d.fileSizes {
+		if fileNum < d.commitFileNum {
+			delete(d.fileSizes, fileNum)
+		}
+	}
+
+	bytes := d.writePos - d.commitPos
+	for i := d.commitFileNum; i < d.writeFileNum; i++ {
+		size, ok := d.fileSizes[i]
+		if !ok {
+			// a missing file holds no message
+			size, _ = d.segmentSize(i)
+			d.fileSizes[i] = size
+		}
+		bytes += size
+	}
+	return bytes
+}
+
+func batchBytes(data [][]byte) int64 {
+	var bytes int64
+	for _, bs := range data {
+		bytes += recordHeaderSize + int64(len(bs))
+	}
+	return bytes
+}
@@ -0,0 +1,41 @@
+package diskq
+
+type writeRequest struct {
+	data     [][]byte
+	response chan error // buffered, ioLoop never blocks on it
+}
+
+// groupSync writes the batches of the writers already waiting on batchChan
+// and fsyncs once for all of them, including req which has been written
+func (d *DiskQueue) groupSync(req writeRequest, count *int64) {
+	waiters := []chan error{req.response}
+	for more := true; more; {
+		select {
+		case req := <-d.batchChan:
+			err := d.checkFull(int64(len(req.data)), batchBytes(req.data))
+			if err != nil {
+				req.response <- err
+				continue
+			}
+			*count += int64(len(req.data))
+			err = d.writeBatch(req.data)
+			if err != nil {
+				req.response <- err
+				continue
+			}
+			waiters = append(waiters, req.response)
+		default:
+			more = false
+		}
+	}
+
+	err := d.sync()
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+	} else {
+		*count = 0
+	}
+	for _, waiter := range waiters {
+		waiter <- err
+	}
+}
@@ -0,0 +1,307 @@
+package diskq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm used to compress closed data files
+type Compression string
+
+const (
+	CompressionNone   Compression = ""
+	CompressionSnappy Compression = "snappy"
+	CompressionZstd   Compression = "zstd"
+)
+
+// compressed data file format
+//
+// size(8) | compressed stream of the original file
+//
+// positions keep referring to the uncompressed bytes, a reader opening a
+// compressed file decompresses and discards the bytes before its position
+const compressedHeaderSize = 8
+
+var compressionExts = []struct {
+	compression Compression
+	ext         string
+}{
+	{CompressionZstd, ".zst"},
+	{CompressionSnappy, ".snappy"},
+}
+
+func compressionExt(compression Compression) string {
+	for _, c := range compressionExts {
+		if c.compression == compression {
+			return c.ext
+		}
+	}
+	return ""
+}
+
+func (d *DiskQueue) compressedFileName(fileNum int64, compression Compression) string {
+	return d.fileName(fileNum) + compressionExt(compression)
+}
+
+type segmentReader struct {
+	io.Reader
+	closers []func() error
+}
+
+func (r *segmentReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if innerErr := r.closers[i](); innerErr != nil {
+			err = innerErr
+		}
+	}
+	return err
+}
+
+// openSegment opens the data file at pos, transparently decompressing it if
+// it has been compressed, it returns the (uncompressed) size of the file
+//
+// the size of the file being written changes, it is up to the caller to
+// ignore it
+func (d *DiskQueue) openSegment(fileNum int64, pos int64) (io.ReadCloser, int64, error) {
+	f, err := os.OpenFile(d.fileName(fileNum), os.O_RDONLY, 0o600)
+	if err == nil {
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		if pos > 0 {
+			_, err = f.Seek(pos, 0)
+			if err != nil {
+				f.Close()
+				return nil, 0, err
+			}
+		}
+		return f, stat.Size(), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+
+	for _, c := range compressionExts {
+		r, size, cerr := openCompressed(d.compressedFileName(fileNum, c.compression), c.compression)
+		if os.IsNotExist(cerr) {
+			continue
+		}
+		if cerr != nil {
+			return nil, 0, cerr
+		}
+		if pos > 0 {
+			_, cerr = io.CopyN(io.Discard, r, pos)
+			if cerr != nil {
+				r.Close()
+				return nil, 0, cerr
+			}
+		}
+		return r, size, nil
+	}
+	return nil, 0, err
+}
+
+// segmentSize returns the (uncompressed) size of a data file
+func (d *DiskQueue) segmentSize(fileNum int64) (int64, error) {
+	r, size, err := d.openSegment(fileNum, 0)
+	if err != nil {
+		return 0, err
+	}
+	r.Close()
+	return size, nil
+}
+
+func openCompressed(fileName string, compression Compression) (io.ReadCloser, int64, error) {
+	f, err := os.OpenFile(fileName, os.O_RDONLY, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	var header [compressedHeaderSize]byte
+	_, err = io.ReadFull(f, header[:])
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	size := int64(binary.BigEndian.Uint64(header[:]))
+
+	switch compression {
+	case CompressionSnappy:
+		return &segmentReader{Reader: snappy.NewReader(f), closers: []func() error{f.Close}}, size, nil
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		closeDecoder := func() error {
+			decoder.Close()
+			return nil
+		}
+		return &segmentReader{Reader: decoder, closers: []func() error{f.Close, closeDecoder}}, size, nil
+	}
+	f.Close()
+	return nil, 0, fmt.Errorf("unknown compression %q", compression)
+}
+
+func newCompressor(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+// removeSegment removes a data file whether it has been compressed or not,
+// together with its index
+func (d *DiskQueue) removeSegment(fileNum int64) error {
+	var err error
+	fileNames := []string{d.fileName(fileNum), d.indexFileName(fileNum)}
+	for _, c := range compressionExts {
+		fileNames = append(fileNames, d.compressedFileName(fileNum, c.compression))
+	}
+	for _, fn := range fileNames {
+		innerErr := os.Remove(fn)
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			err = innerErr
+		}
+	}
+	return err
+}
+
+// triggerCompress wakes compressLoop up after the writer moved to a new file
+func (d *DiskQueue) triggerCompress() {
+	if d.compression == CompressionNone {
+		return
+	}
+	select {
+	case d.compressChan <- 1:
+	default:
+	}
+}
+
+// compressLoop compresses the closed data files in the background
+func (d *DiskQueue) compressLoop() {
+	for {
+		select {
+		case <-d.compressChan:
+		case <-d.exitChan:
+			goto exit
+		}
+
+		d.cursors.Lock()
+		from, to := d.cursors.gcFileNum, d.cursors.writeFileNum
+		d.cursors.Unlock()
+		for i := from; i < to; i++ {
+			select {
+			case <-d.exitChan:
+				goto exit
+			default:
+			}
+			err := d.compressSegment(i)
+			if err != nil {
+				d.logf(ERROR, "DISKQUEUE(%s) failed to compress %s - %s", d.name, d.fileName(i), err)
+			}
+		}
+	}
+
+exit:
+	d.compressSyncChan <- 1
+}
+
+// compressSegment replaces a closed data file by its compressed version,
+// readers which have already opened the file keep reading it
+func (d *DiskQueue) compressSegment(fileNum int64) error {
+	fn := d.fileName(fileNum)
+	compressedFn := d.compressedFileName(fileNum, d.compression)
+	if _, err := os.Stat(compressedFn); err == nil {
+		// crashed after compressing
+		return d.replaceSegment(fileNum, "")
+	}
+
+	src, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := compressedFn + ".tmp"
+	err = writeCompressed(tmpFileName, src, stat.Size(), d.compression)
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s): compressed %s", d.name, fn)
+	return d.replaceSegment(fileNum, tmpFileName)
+}
+
+func writeCompressed(fileName string, src io.Reader, size int64, compression Compression) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var header [compressedHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(size))
+	_, err = f.Write(header[:])
+	if err != nil {
+		return err
+	}
+	w, err := newCompressor(f, compression)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// replaceSegment moves the compressed tmp file in place and removes the
+// uncompressed file, unless the file has been removed in the meantime
+func (d *DiskQueue) replaceSegment(fileNum int64, tmpFileName string) error {
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	if fileNum < d.cursors.gcFileNum {
+		if tmpFileName != "" {
+			os.Remove(tmpFileName)
+		}
+		return nil
+	}
+	if tmpFileName != "" {
+		err := os.Rename(tmpFileName, d.compressedFileName(fileNum, d.compression))
+		if err != nil {
+			return err
+		}
+	}
+	err := os.Remove(d.fileName(fileNum))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,545 @@
+package diskq
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidCursorName = errors.New("invalid cursor name")
+
+var cursorNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Cursor is a named consumer reading the queue at its own pace, independently
+// of the default reader (ReadChan/Get) and of the other cursors
+//
+// the read position of a cursor is persisted together with the queue metadata,
+// a message read after the last sync is read again after a restart
+type Cursor interface {
+	Name() string
+	ReadChan() <-chan []byte // this is expected to be an *unbuffered* channel
+	// MessageChan returns the messages with their offsets, it consumes the
+	// cursor like ReadChan
+	MessageChan() <-chan Message
+	// SeekTo and SeekToTime move the cursor like the DiskQueue methods
+	SeekTo(offset Offset) error
+	SeekToTime(t time.Time) error
+	// Depth returns the number of messages the cursor has not read yet
+	Depth() int64
+}
+
+// cursorSet holds the state shared between ioLoop and the cursor goroutines
+type cursorSet struct {
+	sync.Mutex
+
+	cursors map[string]*cursor
+	wg      sync.WaitGroup
+
+	// data files below gcFileNum have been removed
+	gcFileNum int64
+	// the committed file of the default reader
+	commitFileNum int64
+
+	// the write position published by ioLoop, written is closed (and
+	// replaced) every time it moves
+	writeFileNum int64
+	writePos     int64
+	written      chan struct{}
+}
+
+type cursorRequest struct {
+	name     string
+	response chan cursorResponse
+}
+
+type cursorResponse struct {
+	cursor Cursor
+	err    error
+}
+
+type cursor struct {
+	d    *DiskQueue
+	name string
+
+	// guarded by d.cursors
+	readFileNum int64
+	readPos     int64
+	depth       int64
+	dirty       bool
+	// reset is set by Empty and seeks, the read file has to be reopened
+	reset bool
+
+	// owned by the cursor goroutine
+	readFile     io.ReadCloser
+	reader       *bufio.Reader
+	readFileSize int64 // size of a complete file, -1 while unknown
+
+	readChan          chan []byte
+	msgChan           chan Message
+	depthChan         chan int
+	depthResponseChan chan int64
+	closeChan         chan struct{}
+	doneChan          chan struct{}
+}
+
+// Cursor returns the cursor with the given name, creating it at the committed
+// position of the default reader if it does not exist yet
+//
+// data files are only removed once the default reader and every cursor have
+// read past them, so an unused cursor must be removed with RemoveCursor
+func (d *DiskQueue) Cursor(name string) (Cursor, error) {
+	if !cursorNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCursorName, name)
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+
+	response := make(chan cursorResponse, 1)
+	d.cursorChan <- cursorRequest{name: name, response: response}
+	resp := <-response
+	return resp.cursor, resp.err
+}
+
+// RemoveCursor stops the cursor with the given name and forgets its position,
+// the data files only it was holding are removed
+func (d *DiskQueue) RemoveCursor(name string) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.cursors.Lock()
+	c, ok := d.cursors.cursors[name]
+	if ok {
+		delete(d.cursors.cursors, name)
+	}
+	d.cursors.Unlock()
+	if !ok {
+		return nil
+	}
+
+	close(c.closeChan)
+	<-c.doneChan
+
+	err := os.Remove(d.cursorMetaDataFileName(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	d.cursors.Lock()
+	d.gcLocked()
+	d.cursors.Unlock()
+	return nil
+}
+
+// openCursor is called by ioLoop
+func (d *DiskQueue) openCursor(name string) (Cursor, error) {
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	if c, ok := d.cursors.cursors[name]; ok {
+		return c, nil
+	}
+	c := d.newCursor(name)
+	c.readFileNum = d.commitFileNum
+	c.readPos = d.commitPos
+	c.depth = d.depth
+	c.dirty = true
+	d.needSync = true
+	d.startCursorLocked(c)
+	return c, nil
+}
+
+func (d *DiskQueue) newCursor(name string) *cursor {
+	return &cursor{
+		d:                 d,
+		name:              name,
+		readFileSize:      -1,
+		readChan:          make(chan []byte),
+		msgChan:           make(chan Message),
+		depthChan:         make(chan int),
+		depthResponseChan: make(chan int64),
+		closeChan:         make(chan struct{}),
+		doneChan:          make(chan struct{}),
+	}
+}
+
+func (d *DiskQueue) startCursorLocked(c *cursor) {
+	d.cursors.cursors[c.name] = c
+	d.cursors.wg.Add(1)
+	go c.ioLoop()
+}
+
+// loadCursors starts the cursors persisted by a previous instance
+func (d *DiskQueue) loadCursors() {
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	d.cursors.commitFileNum = d.commitFileNum
+	d.cursors.writeFileNum = d.writeFileNum
+	d.cursors.writePos = d.writePos
+	d.cursors.written = make(chan struct{})
+
+	pattern := path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.cursor.*.meta.dat", d.name))
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		d.logf(WARN, "DISKQUEUE(%s) failed to glob cursor files - %s", d.name, err)
+	}
+	for _, fn := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(fn),
+			fmt.Sprintf("%s.diskqueue.cursor.", d.name)), ".meta.dat")
+		if !cursorNameRegexp.MatchString(name) {
+			continue
+		}
+		c := d.newCursor(name)
+		err = c.retrieveMetaData()
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to retrieve metadata of cursor %s - %s", d.name, name, err)
+			continue
+		}
+		d.startCursorLocked(c)
+	}
+
+	d.cursors.gcFileNum = d.lowestFileNumLocked()
+	if d.retainSegments {
+		d.cursors.gcFileNum = min(d.cursors.gcFileNum, d.firstFileNum())
+	}
+}
+
+// lowestFileNumLocked returns the lowest data file still needed by a reader
+func (d *DiskQueue) lowestFileNumLocked() int64 {
+	fileNum := d.cursors.commitFileNum
+	for _, c := range d.cursors.cursors {
+		fileNum = min(fileNum, c.readFileNum)
+	}
+	return fileNum
+}
+
+// gcLocked removes the data files every reader has passed, unless they are
+// retained
+func (d *DiskQueue) gcLocked() {
+	if d.retainSegments {
+		return
+	}
+	lowest := d.lowestFileNumLocked()
+	for ; d.cursors.gcFileNum < lowest; d.cursors.gcFileNum++ {
+		err := d.removeSegment(d.cursors.gcFileNum)
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, d.fileName(d.cursors.gcFileNum), err)
+		}
+	}
+}
+
+// moveCursorsCommit publishes the committed file of the default reader
+func (d *DiskQueue) moveCursorsCommit(fileNum int64) {
+	d.cursors.Lock()
+	d.cursors.commitFileNum = fileNum
+	d.gcLocked()
+	d.cursors.Unlock()
+}
+
+// moveCursorsWrite publishes the write position, count messages were written
+func (d *DiskQueue) moveCursorsWrite(count int64) {
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	for _, c := range d.cursors.cursors {
+		c.depth += count
+		c.dirty = true
+	}
+	d.cursors.writeFileNum = d.writeFileNum
+	d.cursors.writePos = d.writePos
+	close(d.cursors.written)
+	d.cursors.written = make(chan struct{})
+}
+
+// resetCursors moves every cursor to the write position, used by Empty
+func (d *DiskQueue) resetCursors() {
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	for _, c := range d.cursors.cursors {
+		c.readFileNum = d.writeFileNum
+		c.readPos = d.writePos
+		c.depth = 0
+		c.dirty = true
+		c.reset = true
+	}
+	d.cursors.commitFileNum = d.commitFileNum
+	d.cursors.gcFileNum = d.writeFileNum
+	d.cursors.writeFileNum = d.writeFileNum
+	d.cursors.writePos = d.writePos
+	close(d.cursors.written)
+	d.cursors.written = make(chan struct{})
+}
+
+func (d *DiskQueue) cursorsDirty() bool {
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	for _, c := range d.cursors.cursors {
+		if c.dirty {
+			return true
+		}
+	}
+	return false
+}
+
+// persistCursors persists the positions of the cursors moved since the last sync
+func (d *DiskQueue) persistCursors() error {
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	var err error
+	for _, c := range d.cursors.cursors {
+		if !c.dirty {
+			continue
+		}
+		innerErr := writeFileAtomic(d.cursorMetaDataFileName(c.name),
+			fmt.Sprintf("%d\n%d,%d\n", c.depth, c.readFileNum, c.readPos))
+		if innerErr != nil {
+			err = innerErr
+			continue
+		}
+		c.dirty = false
+	}
+	return err
+}
+
+func (d *DiskQueue) cursorMetaDataFileName(name string) string {
+	return path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.cursor.%s.meta.dat", d.name, name))
+}
+
+func (c *cursor) Name() string {
+	return c.name
+}
+
+func (c *cursor) ReadChan() <-chan []byte {
+	return c.readChan
+}
+
+// Depth is served by ioLoop so that it accounts for the messages already
+// received from ReadChan
+func (c *cursor) Depth() int64 {
+	select {
+	case c.depthChan <- 1:
+		return <-c.depthResponseChan
+	case <-c.doneChan:
+		// ioLoop exited
+		c.d.cursors.Lock()
+		defer c.d.cursors.Unlock()
+		return c.depth
+	}
+}
+
+func (c *cursor) retrieveMetaData() error {
+	f, err := os.Open(c.d.cursorMetaDataFileName(c.name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n", &c.depth, &c.readFileNum, &c.readPos)
+	return err
+}
+
+// ioLoop reads ahead a single message and blocks until it is consumed, then
+// advances the read position of the cursor
+func (c *cursor) ioLoop() {
+	d := c.d
+	defer func() {
+		c.closeFile()
+		close(c.doneChan)
+		d.cursors.wg.Done()
+	}()
+
+	var dataRead []byte
+	var fileNum, pos, nextFileNum, nextPos int64
+	for {
+		d.cursors.Lock()
+		if c.reset {
+			c.closeFile()
+			c.reset = false
+			dataRead = nil
+		}
+		writeFileNum, writePos := d.cursors.writeFileNum, d.cursors.writePos
+		written := d.cursors.written
+		c.checkTailCorruptionLocked(writeFileNum, writePos)
+		fileNum, pos = c.readFileNum, c.readPos
+		d.cursors.Unlock()
+
+		var r chan []byte
+		var m chan Message
+		// a seek drops the message read ahead
+		w := written
+		if dataRead != nil {
+			r = c.readChan
+			m = c.msgChan
+		} else if fileNum < writeFileNum || (fileNum == writeFileNum && pos < writePos) {
+			var err error
+			dataRead, nextFileNum, nextPos, err = c.readOne(fileNum, pos, writeFileNum, writePos)
+			if err != nil {
+				d.logf(ERROR, "DISKQUEUE(%s) cursor %s reading at %d of %s - %s",
+					d.name, c.name, pos, d.fileName(fileNum), err)
+				nextFileNum, nextPos = c.skipCorrupt(fileNum, pos, writeFileNum, writePos)
+			}
+			if dataRead == nil {
+				c.moveTo(fileNum, pos, nextFileNum, nextPos, 0)
+				continue
+			}
+			r = c.readChan
+			m = c.msgChan
+		}
+
+		select {
+		case r <- dataRead:
+			dataRead = nil
+			c.moveTo(fileNum, pos, nextFileNum, nextPos, 1)
+		case m <- Message{Offset: Offset{FileNum: fileNum, Pos: pos}, Data: dataRead}:
+			dataRead = nil
+			c.moveTo(fileNum, pos, nextFileNum, nextPos, 1)
+		case <-c.depthChan:
+			d.cursors.Lock()
+			depth := c.depth
+			d.cursors.Unlock()
+			c.depthResponseChan <- depth
+		case <-w:
+		case <-c.closeChan:
+			return
+		case <-d.exitChan:
+			return
+		}
+	}
+}
+
+// moveTo advances the read position unless Empty or a seek moved it in the meantime
+func (c *cursor) moveTo(fileNum int64, pos int64, nextFileNum int64, nextPos int64, count int64) {
+	d := c.d
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	if c.readFileNum != fileNum || c.readPos != pos {
+		return
+	}
+	c.readFileNum = nextFileNum
+	c.readPos = nextPos
+	c.depth -= count
+	c.dirty = true
+	if nextFileNum != fileNum {
+		d.gcLocked()
+	}
+}
+
+// readOne reads the message at the given position, it returns nil data with
+// the start of the next file at the end of a complete file
+func (c *cursor) readOne(fileNum int64, pos int64, writeFileNum int64, writePos int64) ([]byte, int64, int64, error) {
+	d := c.d
+	var err error
+
+	if c.readFile == nil {
+		var size int64
+		c.readFile, size, err = d.openSegment(fileNum, pos)
+		if os.IsNotExist(err) && fileNum < writeFileNum {
+			d.logf(WARN, "DISKQUEUE(%s) cursor %s skipping missing file %s",
+				d.name, c.name, d.fileName(fileNum))
+			return nil, fileNum + 1, 0, nil
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		c.reader = bufio.NewReader(c.readFile)
+		c.readFileSize = -1
+		if fileNum < writeFileNum {
+			c.readFileSize = size
+		}
+	}
+
+	// the size of the file is only known once the writer has moved on
+	if fileNum < writeFileNum && c.readFileSize < 0 {
+		c.readFileSize, err = d.segmentSize(fileNum)
+		if err != nil {
+			c.closeFile()
+			return nil, 0, 0, err
+		}
+	}
+	if fileNum < writeFileNum && pos >= c.readFileSize {
+		c.closeFile()
+		return nil, fileNum + 1, 0, nil
+	}
+
+	data, totalBytes, err := decodeRecord(c.reader, d.minMsgSize, d.maxMsgSize)
+	if err != nil {
+		c.closeFile()
+		return nil, 0, 0, err
+	}
+	d.metrics.read(c.name, totalBytes)
+
+	nextFileNum, nextPos := fileNum, pos+totalBytes
+	if fileNum < writeFileNum && nextPos >= c.readFileSize {
+		c.closeFile()
+		nextFileNum++
+		nextPos = 0
+	}
+	return data, nextFileNum, nextPos, nil
+}
+
+// skipCorrupt returns the position of the next valid record, the default
+// reader is in charge of quarantining the corrupt bytes
+func (c *cursor) skipCorrupt(fileNum int64, pos int64, writeFileNum int64, writePos int64) (int64, int64) {
+	d := c.d
+	f, err := os.Open(d.fileName(fileNum))
+	if err != nil {
+		if fileNum < writeFileNum {
+			return fileNum + 1, 0
+		}
+		return fileNum, writePos
+	}
+	defer f.Close()
+
+	limit := writePos
+	if fileNum < writeFileNum {
+		limit, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fileNum + 1, 0
+		}
+	}
+	next := resync(f, pos+1, limit, d.minMsgSize, d.maxMsgSize)
+	if next < limit || fileNum == writeFileNum {
+		return fileNum, next
+	}
+	return fileNum + 1, 0
+}
+
+// checkTailCorruptionLocked resets the depth of a cursor which has read
+// everything, skipped corrupt records leave it positive
+func (c *cursor) checkTailCorruptionLocked(writeFileNum int64, writePos int64) {
+	if c.readFileNum != writeFileNum || c.readPos != writePos || c.depth == 0 {
+		return
+	}
+	c.d.logf(ERROR, "DISKQUEUE(%s) cursor %s depth at tail (%d), resetting 0...",
+		c.d.name, c.name, c.depth)
+	c.depth = 0
+	c.dirty = true
+}
+
+func (c *cursor) closeFile() {
+	if c.readFile != nil {
+		c.readFile.Close()
+		c.readFile = nil
+	}
+}
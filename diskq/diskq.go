@@ -2,8 +2,7 @@ package diskq
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -14,6 +13,9 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
 )
 
 // logging stuff copied from github.com/nsqio/nsq/internal/lg
@@ -46,13 +48,38 @@ func (l LogLevel) String() string {
 	panic("invalid LogLevel")
 }
 
+var ErrExiting = errors.New("exiting")
+
 type Interface interface {
 	Put([]byte) error
+	// PutCtx is Put giving up once ctx is done, while waiting for the queue
+	// or for room in a full queue
+	PutCtx(ctx context.Context, data []byte) error
+	// PutBatch writes the messages with a single write per data file
+	PutBatch([][]byte) error
 	ReadChan() <-chan []byte // this is expected to be an *unbuffered* channel
+	// MessageChan returns the messages with their offsets, it consumes the
+	// queue like ReadChan
+	MessageChan() <-chan Message
 	PeekChan() <-chan []byte // this is expected to be an *unbuffered* channel
+	// Get blocks until a message is available and returns it together with
+	// ack/nack funcs, the committed read position only moves past acked messages
+	Get() (data []byte, ack func(), nack func(), err error)
+	// GetCtx is Get giving up once ctx is done
+	GetCtx(ctx context.Context) (data []byte, ack func(), nack func(), err error)
+	// LowWaterChan is notified when the depth drops below the low-water mark
+	LowWaterChan() <-chan struct{}
+	// Cursor returns a named consumer with its own persisted read position
+	Cursor(name string) (Cursor, error)
+	RemoveCursor(name string) error
+	// SeekTo and SeekToTime move the default reader to replay the queue
+	SeekTo(offset Offset) error
+	SeekToTime(t time.Time) error
 	Close() error
 	Delete() error
 	Depth() int64
+	// Stats returns the size of the queue on disk
+	Stats() Stats
 	Empty() error
 }
 
@@ -67,6 +94,15 @@ type DiskQueue struct {
 	writeFileNum int64
 	depth        int64
 
+	// position below which every message has been acked (also persisted to disk),
+	// readers restart from here, equal to readPos unless messages are in flight
+	commitPos     int64
+	commitFileNum int64
+
+	// what the retention policy dropped since the queue was opened
+	droppedFiles    int64
+	droppedMessages int64
+
 	sync.RWMutex
 
 	// instantiation time metadata
@@ -78,6 +114,17 @@ type DiskQueue struct {
 	maxMsgSize          int32
 	syncEvery           int64         // number of writes per fsync
 	syncTimeout         time.Duration // duration of time per fsync
+	visibilityTimeout   time.Duration // un-acked messages are redelivered after this
+	maxInFlight         int           // max un-acked messages handed out by Get
+	groupCommit         bool          // Put and PutBatch wait for a shared fsync
+	compression         Compression   // algorithm compressing closed files
+	retention           RetentionPolicy
+	retainSegments      bool  // keep the data files every reader has passed
+	indexInterval       int64 // number of records per index entry
+	maxDepth            int64 // Put fails or blocks beyond this depth
+	maxBytes            int64 // Put fails or blocks beyond this many unread bytes
+	blockOnFull         bool  // Put blocks instead of returning ErrFull
+	lowWaterMark        int64 // LowWaterChan is notified below this depth
 	exitFlag            int32
 	needSync            bool
 
@@ -86,38 +133,88 @@ type DiskQueue struct {
 	nextReadPos     int64
 	nextReadFileNum int64
 
-	readFile  *os.File
+	readFile  io.ReadCloser
 	writeFile *os.File
 	reader    *bufio.Reader
-	writeBuf  bytes.Buffer
+	writeBuf  []byte
+
+	// index of the write file
+	indexFile  *os.File
+	indexBuf   []byte
+	writeCount int64 // number of records in the write file
 
 	// exposed via ReadChan()
 	readChan chan []byte
 
+	// exposed via MessageChan()
+	msgChan chan Message
+
 	// exposed via PeekChan()
 	peekChan chan []byte
 
+	// exposed via Get()
+	getChan chan delivery
+
+	// messages handed out by Get (and acked messages behind them) ordered by position
+	inFlight      []*inFlight
+	inFlightIndex map[uint64]*inFlight
+	redeliver     []*inFlight
+	// redeliverHead is the head of redeliver read back into redeliverPending
+	redeliverHead    *inFlight
+	redeliverPending delivery
+	unacked          int
+	lastID           uint64
+
+	// named cursors, exposed via Cursor()
+	cursors cursorSet
+
+	// backpressure, the sizes of the closed files are cached for backlogBytes
+	full          bool
+	space         spaceSignal
+	fileSizes     map[int64]int64
+	belowLowWater bool
+	lowWaterChan  chan struct{}
+
 	// internal channels
 	depthChan         chan int64
 	writeChan         chan []byte
 	writeResponseChan chan error
+	batchChan         chan writeRequest
 	emptyChan         chan int
 	emptyResponseChan chan error
+	ackChan           chan ackRequest
+	cursorChan        chan cursorRequest
+	seekChan          chan seekRequest
+	compressChan      chan int
+	compressSyncChan  chan int
 	exitChan          chan int
 	exitSyncChan      chan int
 
-	logf AppLogFunc
+	logf    AppLogFunc
+	metrics *metrics
 }
 
 type options struct {
-	name            string
-	dataDIR         string
-	maxBytesPerFile int64
-	minMsgSize      int32
-	maxMsgSize      int32
-	syncEvery       int64
-	syncTimeout     time.Duration
-	logf            AppLogFunc
+	name              string
+	dataDIR           string
+	maxBytesPerFile   int64
+	minMsgSize        int32
+	maxMsgSize        int32
+	syncEvery         int64
+	syncTimeout       time.Duration
+	visibilityTimeout time.Duration
+	maxInFlight       int
+	groupCommit       bool
+	compression       Compression
+	retention         RetentionPolicy
+	retainSegments    bool
+	indexInterval     int64
+	maxDepth          int64
+	maxBytes          int64
+	blockOnFull       bool
+	lowWaterMark      int64
+	meterProvider     metric.MeterProvider
+	logf              AppLogFunc
 }
 
 func defaultOptions() *options {
@@ -130,6 +227,11 @@ func defaultOptions() *options {
 		maxMsgSize:      10 * 1024 * 1024, // 10MB
 		syncEvery:       2500,             // number of writes
 		syncTimeout:     2 * time.Second,  // duration of time
+
+		visibilityTimeout: 30 * time.Second,
+		maxInFlight:       1000,
+		indexInterval:     256,
+		meterProvider:     otel.GetMeterProvider(),
 		logf: func(lvl LogLevel, f string, args ...interface{}) {
 			builder := strings.Builder{}
 			builder.WriteString(fmt.Sprintf("[%s] ", lvl))
@@ -191,6 +293,104 @@ func WithSyncTimeout(syncTimeout time.Duration) Option {
 	})
 }
 
+// WithVisibilityTimeout sets how long a message handed out by Get may stay
+// un-acked before it is redelivered
+func WithVisibilityTimeout(visibilityTimeout time.Duration) Option {
+	return optionFunc(func(opt *options) {
+		opt.visibilityTimeout = visibilityTimeout
+	})
+}
+
+// WithMaxInFlight limits the number of un-acked messages handed out by Get,
+// Get blocks (except for redeliveries) once the limit is reached
+func WithMaxInFlight(maxInFlight int) Option {
+	return optionFunc(func(opt *options) {
+		opt.maxInFlight = maxInFlight
+	})
+}
+
+// WithGroupCommit makes Put and PutBatch return only once the written
+// messages have been fsynced, concurrent writers waiting at the same time
+// share a single fsync
+func WithGroupCommit(groupCommit bool) Option {
+	return optionFunc(func(opt *options) {
+		opt.groupCommit = groupCommit
+	})
+}
+
+// WithCompression compresses the data files in the background once the
+// writer has moved to the next file
+func WithCompression(compression Compression) Option {
+	return optionFunc(func(opt *options) {
+		opt.compression = compression
+	})
+}
+
+// WithRetention bounds the size and the age of the data files
+func WithRetention(retention RetentionPolicy) Option {
+	return optionFunc(func(opt *options) {
+		opt.retention = retention
+	})
+}
+
+// WithRetainSegments keeps the data files once every reader has read past
+// them so that they can be replayed with SeekTo, only the retention policy
+// and Empty remove them
+func WithRetainSegments(retainSegments bool) Option {
+	return optionFunc(func(opt *options) {
+		opt.retainSegments = retainSegments
+	})
+}
+
+// WithIndexInterval sets the number of records between two entries of the
+// index of a data file, SeekToTime lands up to indexInterval records early
+func WithIndexInterval(indexInterval int64) Option {
+	return optionFunc(func(opt *options) {
+		opt.indexInterval = indexInterval
+	})
+}
+
+// WithMaxDepth bounds the depth of the queue, a write beyond it returns
+// ErrFull, or blocks with WithBlockOnFull, a queue holding no message accepts
+// any write
+func WithMaxDepth(maxDepth int64) Option {
+	return optionFunc(func(opt *options) {
+		opt.maxDepth = maxDepth
+	})
+}
+
+// WithMaxBytes bounds the bytes between the committed read position and the
+// write position like WithMaxDepth
+func WithMaxBytes(maxBytes int64) Option {
+	return optionFunc(func(opt *options) {
+		opt.maxBytes = maxBytes
+	})
+}
+
+// WithBlockOnFull makes the writes to a full queue wait for room instead of
+// returning ErrFull, PutCtx gives up once its context is done
+func WithBlockOnFull(blockOnFull bool) Option {
+	return optionFunc(func(opt *options) {
+		opt.blockOnFull = blockOnFull
+	})
+}
+
+// WithLowWaterMark enables LowWaterChan, notified when the depth drops below
+// lowWaterMark
+func WithLowWaterMark(lowWaterMark int64) Option {
+	return optionFunc(func(opt *options) {
+		opt.lowWaterMark = lowWaterMark
+	})
+}
+
+// WithMeterProvider sets the provider of the metrics of the queue, it
+// defaults to otel.GetMeterProvider()
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return optionFunc(func(opt *options) {
+		opt.meterProvider = mp
+	})
+}
+
 func WithLogf(logf AppLogFunc) Option {
 	return optionFunc(func(opt *options) {
 		opt.logf = logf
@@ -205,36 +405,80 @@ func New(opts ...Option) Interface {
 		o.apply(_options)
 	}
 
-	return newDiskq(_options.name, _options.dataDIR, _options.maxBytesPerFile,
-		_options.minMsgSize, _options.maxMsgSize,
-		_options.syncEvery, _options.syncTimeout, _options.logf)
+	return newDiskqWithOptions(_options)
 }
 
-// New instantiates an instance of DiskQueue, retrieving metadata
-// from the filesystem and starting the read ahead goroutine
+// newDiskq instantiates an instance of DiskQueue with default values for
+// the options not listed
 func newDiskq(name string, dataDIR string, maxBytesPerFile int64,
 	minMsgSize int32, maxMsgSize int32,
 	syncEvery int64, syncTimeout time.Duration, logf AppLogFunc,
 ) Interface {
+	_options := defaultOptions()
+	_options.name = name
+	_options.dataDIR = dataDIR
+	_options.maxBytesPerFile = maxBytesPerFile
+	_options.minMsgSize = minMsgSize
+	_options.maxMsgSize = maxMsgSize
+	_options.syncEvery = syncEvery
+	_options.syncTimeout = syncTimeout
+	_options.logf = logf
+	return newDiskqWithOptions(_options)
+}
+
+func newDiskqWithOptions(opts *options) *DiskQueue {
+	if opts.maxInFlight < 1 {
+		opts.maxInFlight = 1
+	}
+	if opts.indexInterval < 1 {
+		opts.indexInterval = 1
+	}
 	d := &DiskQueue{
-		name:            name,
-		dataDIR:         dataDIR,
-		maxBytesPerFile: maxBytesPerFile,
-		minMsgSize:      minMsgSize,
-		maxMsgSize:      maxMsgSize,
-		syncEvery:       syncEvery,
-		syncTimeout:     syncTimeout,
-		logf:            logf,
+		name:              opts.name,
+		dataDIR:           opts.dataDIR,
+		maxBytesPerFile:   opts.maxBytesPerFile,
+		minMsgSize:        opts.minMsgSize,
+		maxMsgSize:        opts.maxMsgSize,
+		syncEvery:         opts.syncEvery,
+		syncTimeout:       opts.syncTimeout,
+		visibilityTimeout: opts.visibilityTimeout,
+		maxInFlight:       opts.maxInFlight,
+		groupCommit:       opts.groupCommit,
+		compression:       opts.compression,
+		retention:         opts.retention,
+		retainSegments:    opts.retainSegments,
+		indexInterval:     opts.indexInterval,
+		maxDepth:          opts.maxDepth,
+		maxBytes:          opts.maxBytes,
+		blockOnFull:       opts.blockOnFull,
+		lowWaterMark:      opts.lowWaterMark,
+		logf:              opts.logf,
 
 		readChan:          make(chan []byte),
+		msgChan:           make(chan Message),
 		peekChan:          make(chan []byte),
+		getChan:           make(chan delivery),
 		depthChan:         make(chan int64),
 		writeChan:         make(chan []byte),
 		writeResponseChan: make(chan error),
+		batchChan:         make(chan writeRequest),
 		emptyChan:         make(chan int),
 		emptyResponseChan: make(chan error),
+		ackChan:           make(chan ackRequest),
+		cursorChan:        make(chan cursorRequest),
+		seekChan:          make(chan seekRequest),
+		compressChan:      make(chan int, 1),
+		compressSyncChan:  make(chan int),
 		exitChan:          make(chan int),
 		exitSyncChan:      make(chan int),
+
+		inFlightIndex: make(map[uint64]*inFlight),
+		space:         spaceSignal{ch: make(chan struct{})},
+		fileSizes:     make(map[int64]int64),
+		lowWaterChan:  make(chan struct{}, 1),
+		cursors: cursorSet{
+			cursors: make(map[string]*cursor),
+		},
 	}
 
 	// no need to lock here, nothing else could possibly be touching this instance
@@ -243,15 +487,27 @@ func newDiskq(name string, dataDIR string, maxBytesPerFile int64,
 		d.logf(ERROR, "DISKQUEUE(%s) failed to retrieveMetaData - %s", d.name, err)
 	}
 
-	// clean up stale temp and bad files left by previous crashed instances
+	// clean up stale temp files left by previous crashed instances, bad files
+	// hold quarantined bytes and are kept until the queue is emptied
 	d.cleanupTempFiles()
-	d.cleanupBadFiles()
 
+	d.belowLowWater = d.depth < d.lowWaterMark
+
+	// the cursors loaded below start reading right away and record metrics
+	d.metrics = d.newMetrics(opts.meterProvider)
+	d.loadWriteIndex()
+	d.loadCursors()
+
+	if d.compression != CompressionNone {
+		go d.compressLoop()
+		d.triggerCompress()
+	}
 	go d.ioLoop()
 	return d
 }
 
-// Depth returns the depth of the queue
+// Depth returns the depth of the queue, messages handed out by Get count
+// until they (and every message before them) are acked
 func (d *DiskQueue) Depth() int64 {
 	depth, ok := <-d.depthChan
 	if !ok {
@@ -272,15 +528,54 @@ func (d *DiskQueue) PeekChan() <-chan []byte {
 
 // Put writes a []byte to the queue
 func (d *DiskQueue) Put(data []byte) error {
-	d.RLock()
-	defer d.RUnlock()
+	return d.PutCtx(context.Background(), data)
+}
 
-	if d.exitFlag == 1 {
-		return errors.New("exiting")
+func (d *DiskQueue) PutCtx(ctx context.Context, data []byte) error {
+	if d.groupCommit {
+		return d.putBatch(ctx, [][]byte{data})
 	}
+	return d.put(ctx, func() error {
+		d.RLock()
+		defer d.RUnlock()
+
+		if d.exitFlag == 1 {
+			return ErrExiting
+		}
+
+		select {
+		case d.writeChan <- data:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return <-d.writeResponseChan
+	})
+}
+
+// PutBatch writes the messages to the queue in order, nothing is written if
+// one of them has an invalid size or if they do not fit in a full queue, a
+// failing write may leave a prefix written
+func (d *DiskQueue) PutBatch(data [][]byte) error {
+	return d.putBatch(context.Background(), data)
+}
+
+func (d *DiskQueue) putBatch(ctx context.Context, data [][]byte) error {
+	return d.put(ctx, func() error {
+		d.RLock()
+		defer d.RUnlock()
+
+		if d.exitFlag == 1 {
+			return ErrExiting
+		}
 
-	d.writeChan <- data
-	return <-d.writeResponseChan
+		response := make(chan error, 1)
+		select {
+		case d.batchChan <- writeRequest{data: data, response: response}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return <-response
+	})
 }
 
 // Close cleans up the queue and persists metadata
@@ -301,6 +596,7 @@ func (d *DiskQueue) exit(deleted bool) error {
 	defer d.Unlock()
 
 	d.exitFlag = 1
+	d.metrics.unregister()
 
 	if deleted {
 		d.logf(INFO, "DISKQUEUE(%s): deleting", d.name)
@@ -309,8 +605,12 @@ func (d *DiskQueue) exit(deleted bool) error {
 	}
 
 	close(d.exitChan)
-	// ensure that ioLoop has exited
+	// ensure that ioLoop and the cursors have exited
 	<-d.exitSyncChan
+	d.cursors.wg.Wait()
+	if d.compression != CompressionNone {
+		<-d.compressSyncChan
+	}
 
 	close(d.depthChan)
 
@@ -323,6 +623,7 @@ func (d *DiskQueue) exit(deleted bool) error {
 		d.writeFile.Close()
 		d.writeFile = nil
 	}
+	d.closeIndex()
 
 	return nil
 }
@@ -334,7 +635,7 @@ func (d *DiskQueue) Empty() error {
 	defer d.RUnlock()
 
 	if d.exitFlag == 1 {
-		return errors.New("exiting")
+		return ErrExiting
 	}
 
 	d.logf(INFO, "DISKQUEUE(%s): emptying", d.name)
@@ -360,13 +661,22 @@ func (d *DiskQueue) deleteAllFiles() error {
 
 // cleanupTempFiles removes stale .tmp metadata files left by crashed processes
 func (d *DiskQueue) cleanupTempFiles() {
-	pattern := fmt.Sprintf(path.Join(d.dataDIR, "%s.diskqueue.meta.dat.*.tmp"), d.name)
-	matches, err := filepath.Glob(pattern)
-	if err != nil {
-		d.logf(WARN, "DISKQUEUE(%s) failed to glob temp files - %s", d.name, err)
-		return
+	var matches []string
+	for _, pattern := range []string{
+		path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.meta.dat.*.tmp", d.name)),
+		path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.cursor.*.meta.dat.*.tmp", d.name)),
+		// data files being compressed or repaired
+		path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.[0-9]*.dat.*.tmp", d.name)),
+	} {
+		fns, err := filepath.Glob(pattern)
+		if err != nil {
+			d.logf(WARN, "DISKQUEUE(%s) failed to glob temp files - %s", d.name, err)
+			return
+		}
+		matches = append(matches, fns...)
 	}
 	for _, fn := range matches {
+		var err error
 		if err = os.Remove(fn); err != nil && !os.IsNotExist(err) {
 			d.logf(WARN, "DISKQUEUE(%s) failed to remove temp file %s - %s", d.name, fn, err)
 		} else {
@@ -375,9 +685,9 @@ func (d *DiskQueue) cleanupTempFiles() {
 	}
 }
 
-// cleanupBadFiles removes .bad files that were created when corrupt data files were encountered
+// cleanupBadFiles removes .bad files holding the bytes quarantined when corrupt records were encountered
 func (d *DiskQueue) cleanupBadFiles() {
-	pattern := fmt.Sprintf(path.Join(d.dataDIR, "%s.diskqueue.*.dat.bad"), d.name)
+	pattern := path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.*.dat.bad", d.name))
 	matches, err := filepath.Glob(pattern)
 	if err != nil {
 		d.logf(WARN, "DISKQUEUE(%s) failed to glob bad files - %s", d.name, err)
@@ -404,23 +714,32 @@ func (d *DiskQueue) skipToNextRWFile() error {
 		d.writeFile.Close()
 		d.writeFile = nil
 	}
-
-	for i := d.readFileNum; i <= d.writeFileNum; i++ {
-		fn := d.fileName(i)
-		innerErr := os.Remove(fn)
-		if innerErr != nil && !os.IsNotExist(innerErr) {
+	d.closeIndex()
+	d.writeCount = 0
+
+	// cursors may still hold files before the read position
+	d.cursors.Lock()
+	for i := min(d.readFileNum, d.cursors.gcFileNum); i <= d.writeFileNum; i++ {
+		innerErr := d.removeSegment(i)
+		if innerErr != nil {
 			d.logf(ERROR, "DISKQUEUE(%s) failed to remove data file - %s", d.name, innerErr)
 			err = innerErr
 		}
 	}
+	d.cursors.gcFileNum = d.writeFileNum + 1
+	d.cursors.Unlock()
 
 	d.writeFileNum++
 	d.writePos = 0
 	d.readFileNum = d.writeFileNum
 	d.readPos = 0
+	d.commitFileNum = d.writeFileNum
+	d.commitPos = 0
 	d.nextReadFileNum = d.writeFileNum
 	d.nextReadPos = 0
 	d.depth = 0
+	d.resetInFlight()
+	d.resetCursors()
 
 	return err
 }
@@ -429,63 +748,35 @@ func (d *DiskQueue) skipToNextRWFile() error {
 // while advancing read positions and rolling files, if necessary
 func (d *DiskQueue) readOne() ([]byte, error) {
 	var err error
-	var msgSize int32
 
 	if d.readFile == nil {
 		curFileName := d.fileName(d.readFileNum)
-		d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0o600)
+		var size int64
+		d.readFile, size, err = d.openSegment(d.readFileNum, d.readPos)
 		if err != nil {
 			return nil, err
 		}
 
 		d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
 
-		if d.readPos > 0 {
-			_, err = d.readFile.Seek(d.readPos, 0)
-			if err != nil {
-				d.readFile.Close()
-				d.readFile = nil
-				return nil, err
-			}
-		}
-
 		// for "complete" files (i.e. not the "current" file), maxBytesPerFileRead
 		// should be initialized to the file's size, or default to maxBytesPerFile
 		d.maxBytesPerFileRead = d.maxBytesPerFile
 		if d.readFileNum < d.writeFileNum {
-			stat, err := d.readFile.Stat()
-			if err == nil {
-				d.maxBytesPerFileRead = stat.Size()
-			}
+			d.maxBytesPerFileRead = size
 		}
 
 		d.reader = bufio.NewReader(d.readFile)
 	}
 
-	err = binary.Read(d.reader, binary.BigEndian, &msgSize)
+	readBuf, totalBytes, err := decodeRecord(d.reader, d.minMsgSize, d.maxMsgSize)
 	if err != nil {
 		d.readFile.Close()
 		d.readFile = nil
 		return nil, err
 	}
 
-	if msgSize < d.minMsgSize || msgSize > d.maxMsgSize {
-		// this file is corrupt and we have no reasonable guarantee on
-		// where a new message should begin
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, fmt.Errorf("invalid message read size (%d)", msgSize)
-	}
-
-	readBuf := make([]byte, msgSize)
-	_, err = io.ReadFull(d.reader, readBuf)
-	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
-	}
-
-	totalBytes := int64(4 + msgSize)
+	d.metrics.read("", totalBytes)
 
 	// we only advance next* because we have not yet sent this to consumers
 	// (where readFileNum, readPos will actually be advanced)
@@ -511,14 +802,68 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 // writeOne performs a low level filesystem write for a single []byte
 // while advancing write positions and rolling files, if necessary
 func (d *DiskQueue) writeOne(data []byte) error {
-	var err error
+	err := d.checkMsgSize(data)
+	if err != nil {
+		return err
+	}
 
-	dataLen := int32(len(data))
-	totalBytes := int64(4 + dataLen)
+	err = d.prepareWrite(int64(recordHeaderSize) + int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	d.writeBuf = encodeRecord(d.writeBuf[:0], data)
+	return d.flushWriteBuf(1)
+}
+
+// writeBatch writes the records in as few writes as possible, one per file,
+// on error the records before the failed write remain written
+func (d *DiskQueue) writeBatch(batch [][]byte) error {
+	for _, data := range batch {
+		err := d.checkMsgSize(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.writeBuf = d.writeBuf[:0]
+	var count int64
+	for _, data := range batch {
+		totalBytes := int64(recordHeaderSize) + int64(len(data))
+		if count > 0 && d.writePos+int64(len(d.writeBuf))+totalBytes > d.maxBytesPerFile {
+			err := d.flushWriteBuf(count)
+			if err != nil {
+				return err
+			}
+			count = 0
+		}
+		if count == 0 {
+			err := d.prepareWrite(totalBytes)
+			if err != nil {
+				return err
+			}
+		}
+		d.writeBuf = encodeRecord(d.writeBuf, data)
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+	return d.flushWriteBuf(count)
+}
 
+func (d *DiskQueue) checkMsgSize(data []byte) error {
+	dataLen := int32(len(data))
 	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
 		return fmt.Errorf("invalid message write size (%d) minMsgSize=%d maxMsgSize=%d", dataLen, d.minMsgSize, d.maxMsgSize)
 	}
+	return nil
+}
+
+// prepareWrite rolls the write file if a record of totalBytes does not fit
+// and opens the write file
+func (d *DiskQueue) prepareWrite(totalBytes int64) error {
+	var err error
 
 	// will not wrap-around if maxBytesPerFile + maxMsgSize < Int64Max
 	if d.writePos > 0 && d.writePos+totalBytes > d.maxBytesPerFile {
@@ -526,8 +871,11 @@ func (d *DiskQueue) writeOne(data []byte) error {
 			d.maxBytesPerFileRead = d.writePos
 		}
 
+		d.fileSizes[d.writeFileNum] = d.writePos
+		d.finishIndex()
 		d.writeFileNum++
 		d.writePos = 0
+		d.metrics.rotated()
 
 		// sync every time we start writing to a new file
 		err = d.sync()
@@ -539,6 +887,9 @@ func (d *DiskQueue) writeOne(data []byte) error {
 			d.writeFile.Close()
 			d.writeFile = nil
 		}
+
+		d.triggerCompress()
+		d.applyRetention()
 	}
 	if d.writeFile == nil {
 		curFileName := d.fileName(d.writeFileNum)
@@ -558,34 +909,33 @@ func (d *DiskQueue) writeOne(data []byte) error {
 			}
 		}
 	}
+	return nil
+}
 
-	d.writeBuf.Reset()
-	err = binary.Write(&d.writeBuf, binary.BigEndian, dataLen)
-	if err != nil {
-		return err
-	}
-
-	_, err = d.writeBuf.Write(data)
-	if err != nil {
-		return err
-	}
-
+// flushWriteBuf writes the count records in writeBuf to the write file
+func (d *DiskQueue) flushWriteBuf(count int64) error {
 	// only write to the file once
-	_, err = d.writeFile.Write(d.writeBuf.Bytes())
+	_, err := d.writeFile.Write(d.writeBuf)
 	if err != nil {
 		d.writeFile.Close()
 		d.writeFile = nil
 		return err
 	}
 
-	d.writePos += totalBytes
-	d.depth += 1
+	d.metrics.written(len(d.writeBuf))
+	d.indexRecords(d.writePos, d.writeBuf, count)
+	d.writePos += int64(len(d.writeBuf))
+	d.depth += count
+	d.moveCursorsWrite(count)
+	d.writeBuf = d.writeBuf[:0]
 
-	return err
+	return nil
 }
 
 // sync fsyncs the current writeFile and persists metadata
 func (d *DiskQueue) sync() error {
+	defer d.metrics.synced(time.Now())
+
 	if d.writeFile != nil {
 		err := d.writeFile.Sync()
 		if err != nil {
@@ -599,6 +949,10 @@ func (d *DiskQueue) sync() error {
 	if err != nil {
 		return err
 	}
+	err = d.persistCursors()
+	if err != nil {
+		return err
+	}
 
 	d.needSync = false
 	return nil
@@ -616,15 +970,19 @@ func (d *DiskQueue) retrieveMetaData() error {
 	}
 	defer f.Close()
 
+	// the in-flight read position (4th line) is informational only, reading
+	// restarts from the committed position so un-acked messages are redelivered
 	var depth int64
 	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
 		&depth,
-		&d.readFileNum, &d.readPos,
+		&d.commitFileNum, &d.commitPos,
 		&d.writeFileNum, &d.writePos)
 	if err != nil {
 		return err
 	}
 	d.depth = depth
+	d.readFileNum = d.commitFileNum
+	d.readPos = d.commitPos
 	d.nextReadFileNum = d.readFileNum
 	d.nextReadPos = d.readPos
 
@@ -656,10 +1014,18 @@ func (d *DiskQueue) retrieveMetaData() error {
 
 // persistMetaData atomically writes state to the filesystem
 func (d *DiskQueue) persistMetaData() error {
+	return writeFileAtomic(d.metaDataFileName(), fmt.Sprintf("%d\n%d,%d\n%d,%d\n%d,%d\n",
+		d.depth,
+		d.commitFileNum, d.commitPos,
+		d.writeFileNum, d.writePos,
+		d.readFileNum, d.readPos))
+}
+
+// writeFileAtomic writes content to a tmp file and renames it to fileName
+func writeFileAtomic(fileName string, content string) error {
 	var f *os.File
 	var err error
 
-	fileName := d.metaDataFileName()
 	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
 
 	// write to tmp file
@@ -668,10 +1034,7 @@ func (d *DiskQueue) persistMetaData() error {
 		return err
 	}
 
-	_, err = fmt.Fprintf(f, "%d\n%d,%d\n%d,%d\n",
-		d.depth,
-		d.readFileNum, d.readPos,
-		d.writeFileNum, d.writePos)
+	_, err = f.WriteString(content)
 	if err != nil {
 		f.Close()
 		return err
@@ -684,11 +1047,11 @@ func (d *DiskQueue) persistMetaData() error {
 }
 
 func (d *DiskQueue) metaDataFileName() string {
-	return fmt.Sprintf(path.Join(d.dataDIR, "%s.diskqueue.meta.dat"), d.name)
+	return path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.meta.dat", d.name))
 }
 
 func (d *DiskQueue) fileName(fileNum int64) string {
-	return fmt.Sprintf(path.Join(d.dataDIR, "%s.diskqueue.%06d.dat"), d.name, fileNum)
+	return path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.%06d.dat", d.name, fileNum))
 }
 
 func (d *DiskQueue) checkTailCorruption(depth int64) {
@@ -731,29 +1094,81 @@ func (d *DiskQueue) checkTailCorruption(depth int64) {
 	}
 }
 
+// moveForward advances the read position past a message consumed via
+// ReadChan, which needs no ack
 func (d *DiskQueue) moveForward() {
-	oldReadFileNum := d.readFileNum
+	if len(d.inFlight) > 0 {
+		// commit in order once the messages before it are acked
+		d.track(&inFlight{acked: true})
+		return
+	}
+	d.moveRead()
+	d.moveCommit(d.readFileNum, d.readPos, 1)
+	d.checkTailCorruption(d.depth)
+}
+
+// moveRead advances the read position past the message read ahead
+func (d *DiskQueue) moveRead() {
 	d.readFileNum = d.nextReadFileNum
 	d.readPos = d.nextReadPos
-	d.depth -= 1
+}
+
+// moveCommit advances the committed position, removing the files left behind
+func (d *DiskQueue) moveCommit(fileNum int64, pos int64, count int64) {
+	oldCommitFileNum := d.commitFileNum
+	d.commitFileNum = fileNum
+	d.commitPos = pos
+	d.depth -= count
 
-	// see if we need to clean up the old file
-	if oldReadFileNum != d.nextReadFileNum {
+	// see if we need to clean up the old files, cursors may still hold them
+	if oldCommitFileNum != fileNum {
 		// sync every time we start reading from a new file
 		d.needSync = true
+		d.moveCursorsCommit(fileNum)
+	}
+}
 
-		fn := d.fileName(oldReadFileNum)
-		err := os.Remove(fn)
+// handleReadError skips the corrupt bytes at the read position, resuming at
+// the next valid record of the same file if there is one, the skipped bytes
+// are moved to the .bad sidecar of the file
+func (d *DiskQueue) handleReadError() {
+	fn := d.fileName(d.readFileNum)
+	f, err := os.Open(fn)
+	if err != nil {
+		d.skipBadFile()
+		return
+	}
+	defer f.Close()
+
+	limit := d.writePos
+	if d.readFileNum < d.writeFileNum {
+		stat, err := f.Stat()
 		if err != nil {
-			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, fn, err)
+			d.skipBadFile()
+			return
 		}
+		limit = stat.Size()
 	}
+	next := resync(f, d.readPos+1, limit, d.minMsgSize, d.maxMsgSize)
 
-	d.checkTailCorruption(d.depth)
+	d.metrics.corrupted()
+	d.logf(WARN,
+		"DISKQUEUE(%s) skipping %d corrupt bytes at %d of %s, saving them to %s",
+		d.name, next-d.readPos, d.readPos, fn, d.badFileName(d.readFileNum))
+	err = quarantine(f, d.badFileName(d.readFileNum), d.readPos, next)
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to quarantine corrupt bytes of %s - %s", d.name, fn, err)
+	}
+
+	if next < limit {
+		d.skipTo(d.readFileNum, next)
+		return
+	}
+	d.skipBadFile()
 }
 
-func (d *DiskQueue) handleReadError() {
-	// jump to the next read file and rename the current (bad) file
+// skipBadFile jumps to the next read file
+func (d *DiskQueue) skipBadFile() {
 	if d.readFileNum == d.writeFileNum {
 		// if you can't properly read from the current write file it's safe to
 		// assume that something is fucked and we should skip the current file too
@@ -761,32 +1176,43 @@ func (d *DiskQueue) handleReadError() {
 			d.writeFile.Close()
 			d.writeFile = nil
 		}
+		d.fileSizes[d.writeFileNum] = d.writePos
+		d.finishIndex()
 		d.writeFileNum++
 		d.writePos = 0
+		d.metrics.rotated()
+		d.moveCursorsWrite(0)
 	}
 
-	badFn := d.fileName(d.readFileNum)
-	badRenameFn := badFn + ".bad"
+	d.logf(WARN, "DISKQUEUE(%s) jump to next file after %s", d.name, d.fileName(d.readFileNum))
 
-	d.logf(WARN,
-		"DISKQUEUE(%s) jump to next file and saving bad file as %s",
-		d.name, badRenameFn)
+	d.skipTo(d.readFileNum+1, 0)
+}
 
-	err := os.Rename(badFn, badRenameFn)
-	if err != nil {
-		d.logf(ERROR,
-			"DISKQUEUE(%s) failed to rename bad diskqueue file %s to %s",
-			d.name, badFn, badRenameFn)
+// skipTo moves the read position forward without reading, the committed
+// position follows once the messages before it are acked
+func (d *DiskQueue) skipTo(fileNum int64, pos int64) {
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
 	}
-
-	d.readFileNum++
-	d.readPos = 0
-	d.nextReadFileNum = d.readFileNum
-	d.nextReadPos = 0
+	d.readFileNum = fileNum
+	d.readPos = pos
+	d.nextReadFileNum = fileNum
+	d.nextReadPos = pos
 
 	// significant state change, schedule a sync on the next iteration
 	d.needSync = true
 
+	if len(d.inFlight) > 0 {
+		d.appendInFlight(&inFlight{
+			nextFileNum: fileNum,
+			nextPos:     pos,
+			acked:       true,
+		})
+		return
+	}
+	d.moveCommit(fileNum, pos, 0)
 	d.checkTailCorruption(d.depth)
 }
 
@@ -803,13 +1229,17 @@ func (d *DiskQueue) ioLoop() {
 	var err error
 	var count int64
 	var r chan []byte
+	var m chan Message
 	var p chan []byte
+	var g chan delivery
+	var pending delivery
 
 	syncTicker := time.NewTicker(d.syncTimeout)
+	visibilityTicker := time.NewTicker(max(d.visibilityTimeout/4, 10*time.Millisecond))
 
 	for {
 		// dont sync all the time :)
-		if count == d.syncEvery {
+		if count >= d.syncEvery {
 			d.needSync = true
 		}
 
@@ -821,6 +1251,14 @@ func (d *DiskQueue) ioLoop() {
 			count = 0
 		}
 
+		d.checkWaterMarks()
+
+		g = nil
+		if redelivery, ok := d.redelivery(); ok {
+			// redeliveries go first and are not limited by maxInFlight
+			pending = redelivery
+			g = d.getChan
+		}
 		if (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
 			if d.nextReadPos == d.readPos {
 				dataRead, err = d.readOne()
@@ -832,9 +1270,15 @@ func (d *DiskQueue) ioLoop() {
 				}
 			}
 			r = d.readChan
+			m = d.msgChan
 			p = d.peekChan
+			if g == nil && d.unacked < d.maxInFlight {
+				pending = delivery{id: d.lastID + 1, attempt: 1, data: dataRead}
+				g = d.getChan
+			}
 		} else {
 			r = nil
+			m = nil
 			p = nil
 		}
 
@@ -846,15 +1290,50 @@ func (d *DiskQueue) ioLoop() {
 			count++
 			// moveForward sets needSync flag if a file is removed
 			d.moveForward()
+		case m <- Message{Offset: Offset{FileNum: d.readFileNum, Pos: d.readPos}, Data: dataRead}:
+			count++
+			d.moveForward()
+		case g <- pending:
+			d.handOut(pending)
+		case req := <-d.ackChan:
+			count++
+			// commit sets needSync flag if a file is removed
+			d.handleAck(req)
+		case req := <-d.cursorChan:
+			cursor, err := d.openCursor(req.name)
+			req.response <- cursorResponse{cursor: cursor, err: err}
+		case req := <-d.seekChan:
+			req.response <- d.seek(req)
+		case <-visibilityTicker.C:
+			d.requeueExpired()
 		case d.depthChan <- d.depth:
 		case <-d.emptyChan:
 			d.emptyResponseChan <- d.deleteAllFiles()
 			count = 0
 		case dataWrite := <-d.writeChan:
+			err = d.checkFull(1, recordHeaderSize+int64(len(dataWrite)))
+			if err != nil {
+				d.writeResponseChan <- err
+				continue
+			}
 			count++
 			d.writeResponseChan <- d.writeOne(dataWrite)
+		case req := <-d.batchChan:
+			err = d.checkFull(int64(len(req.data)), batchBytes(req.data))
+			if err != nil {
+				req.response <- err
+				continue
+			}
+			count += int64(len(req.data))
+			err = d.writeBatch(req.data)
+			if err != nil || !d.groupCommit {
+				req.response <- err
+				continue
+			}
+			d.groupSync(req, &count)
 		case <-syncTicker.C:
-			if count == 0 {
+			d.applyRetention()
+			if count == 0 && !d.cursorsDirty() {
 				// avoid sync when there's no activity
 				continue
 			}
@@ -867,5 +1346,6 @@ func (d *DiskQueue) ioLoop() {
 exit:
 	d.logf(INFO, "DISKQUEUE(%s): closing ... ioLoop", d.name)
 	syncTicker.Stop()
+	visibilityTicker.Stop()
 	d.exitSyncChan <- 1
 }
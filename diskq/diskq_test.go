@@ -3,6 +3,8 @@ package diskq
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -10,10 +12,17 @@ import (
 	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/ccheers/xpkg/xlogger"
 )
 
 func Equal(t *testing.T, expected, actual interface{}) {
@@ -103,7 +112,7 @@ func TestDiskQueueRoll(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 	msg := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0}
 	ml := int64(len(msg))
-	dq := newDiskq(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, l)
+	dq := newDiskq(dqName, tmpDir, 10*(ml+recordHeaderSize), int32(ml), 1<<10, 2500, 2*time.Second, l)
 	defer dq.Close()
 	NotNil(t, dq)
 	Equal(t, int64(0), dq.Depth())
@@ -115,7 +124,7 @@ func TestDiskQueueRoll(t *testing.T) {
 	}
 
 	Equal(t, int64(1), dq.(*DiskQueue).writeFileNum)
-	Equal(t, int64(ml+4), dq.(*DiskQueue).writePos)
+	Equal(t, int64(ml+recordHeaderSize), dq.(*DiskQueue).writePos)
 
 	for i := 11; i > 0; i-- {
 		Equal(t, msg, <-dq.ReadChan())
@@ -130,7 +139,7 @@ func TestDiskQueuePeek(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 	msg := bytes.Repeat([]byte{0}, 10)
 	ml := int64(len(msg))
-	dq := newDiskq(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, l)
+	dq := newDiskq(dqName, tmpDir, 10*(ml+recordHeaderSize), int32(ml), 1<<10, 2500, 2*time.Second, l)
 	defer dq.Close()
 	NotNil(t, dq)
 	Equal(t, int64(0), dq.Depth())
@@ -276,29 +285,32 @@ func TestDiskQueueCorruption(t *testing.T) {
 	dq := newDiskq(dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, l)
 	defer dq.Close()
 
-	msg := make([]byte, 120) // 124 bytes per message, 8 messages (992 bytes) per file
+	msg := make([]byte, 120) // 130 bytes per message, 7 messages (910 bytes) per file
 	msg[0] = 91
 	msg[62] = 4
 	msg[119] = 211
 
-	for i := 0; i < 25; i++ {
+	for i := 0; i < 22; i++ {
 		dq.Put(msg)
 	}
 
-	Equal(t, int64(25), dq.Depth())
+	Equal(t, int64(22), dq.Depth())
 
 	// corrupt the 2nd file
 	dqFn := dq.(*DiskQueue).fileName(1)
-	os.Truncate(dqFn, 400) // 3 valid messages, 5 corrupted
-
-	for i := 0; i < 19; i++ { // 1 message leftover in 4th file
-		Equal(t, msg, <-dq.ReadChan())
-	}
+	os.Truncate(dqFn, 400) // 3 valid messages, 4 corrupted
 
-	// corrupt the 4th (current) file
+	// corrupt the 4th (current) file, holding its only message, before the
+	// reads below: once the 17th message is received the reader prefetches
+	// the next one in the background, truncating afterwards would race with
+	// it and the message would only sometimes be lost
 	dqFn = dq.(*DiskQueue).fileName(3)
 	os.Truncate(dqFn, 100)
 
+	for i := 0; i < 17; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+
 	dq.Put(msg) // in 5th file
 
 	Equal(t, msg, <-dq.ReadChan())
@@ -330,6 +342,43 @@ func TestDiskQueueCorruption(t *testing.T) {
 	Equal(t, int64(0), dq.Depth())
 }
 
+func TestDiskQueueCorruptionChecksum(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_corruption_checksum" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dq := newDiskq(dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, l)
+	defer dq.Close()
+
+	msg := make([]byte, 120) // 130 bytes per message, 7 messages (910 bytes) per file
+	msg[0] = 91
+	msg[62] = 4
+	msg[119] = 211
+
+	for i := 0; i < 10; i++ { // 3 messages in the 2nd file
+		dq.Put(msg)
+	}
+
+	// flip a bit in the body of the 2nd message of the 2nd file, which is not
+	// read yet, the message is skipped while the following ones are still read
+	dqFn := dq.(*DiskQueue).fileName(1)
+	f, err := os.OpenFile(dqFn, os.O_RDWR, 0o600)
+	Nil(t, err)
+	f.WriteAt([]byte{5}, 130+recordHeaderSize+62)
+	f.Close()
+
+	for i := 0; i < 9; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+
+	// the corrupt message is saved to the bad file
+	stat, err := os.Stat(dqFn + ".bad")
+	Nil(t, err)
+	Equal(t, int64(130), stat.Size())
+	Equal(t, int64(0), dq.Depth())
+}
+
 type md struct {
 	depth        int64
 	readFileNum  int64
@@ -380,7 +429,7 @@ func TestDiskQueueSyncAfterRead(t *testing.T) {
 			d.readFileNum == 0 &&
 			d.writeFileNum == 0 &&
 			d.readPos == 0 &&
-			d.writePos == 1004 {
+			d.writePos == 1010 {
 			// success
 			goto next
 		}
@@ -397,8 +446,8 @@ next:
 		if d.depth == 1 &&
 			d.readFileNum == 0 &&
 			d.writeFileNum == 0 &&
-			d.readPos == 1004 &&
-			d.writePos == 2008 {
+			d.readPos == 1010 &&
+			d.writePos == 2020 {
 			// success
 			goto done
 		}
@@ -502,7 +551,7 @@ func TestDiskQueueResize(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 	msg := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
 	ml := int64(len(msg))
-	dq := newDiskq(dqName, tmpDir, 8*(ml+4), int32(ml), 1<<10, 2500, time.Second, l)
+	dq := newDiskq(dqName, tmpDir, 8*(ml+recordHeaderSize), int32(ml), 1<<10, 2500, time.Second, l)
 	NotNil(t, dq)
 	Equal(t, int64(0), dq.Depth())
 
@@ -512,11 +561,11 @@ func TestDiskQueueResize(t *testing.T) {
 		Nil(t, err)
 	}
 	Equal(t, int64(1), dq.(*DiskQueue).writeFileNum)
-	Equal(t, int64(ml+4), dq.(*DiskQueue).writePos)
+	Equal(t, int64(ml+recordHeaderSize), dq.(*DiskQueue).writePos)
 	Equal(t, int64(9), dq.Depth())
 
 	dq.Close()
-	dq = newDiskq(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, time.Second, l)
+	dq = newDiskq(dqName, tmpDir, 10*(ml+recordHeaderSize), int32(ml), 1<<10, 2500, time.Second, l)
 
 	for i := 0; i < 10; i++ {
 		msg[0] = byte(20 + i)
@@ -524,7 +573,7 @@ func TestDiskQueueResize(t *testing.T) {
 		Nil(t, err)
 	}
 	Equal(t, int64(2), dq.(*DiskQueue).writeFileNum)
-	Equal(t, int64(ml+4), dq.(*DiskQueue).writePos)
+	Equal(t, int64(ml+recordHeaderSize), dq.(*DiskQueue).writePos)
 	Equal(t, int64(19), dq.Depth())
 
 	for i := 0; i < 9; i++ {
@@ -547,6 +596,764 @@ func TestDiskQueueResize(t *testing.T) {
 	}
 }
 
+func TestDiskQueueGetAck(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_get_ack" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	// 2 messages per file
+	dq := New(WithName(dqName), WithDataDIR(tmpDir), WithMaxBytesPerFile(2*(1+recordHeaderSize)),
+		WithVisibilityTimeout(100*time.Millisecond), WithLogf(l))
+	defer dq.Close()
+
+	for i := 0; i < 4; i++ {
+		Nil(t, dq.Put([]byte{byte(i)}))
+	}
+
+	msg0, ack0, _, err := dq.Get()
+	Nil(t, err)
+	Equal(t, []byte{0}, msg0)
+	msg1, _, nack1, err := dq.Get()
+	Nil(t, err)
+	Equal(t, []byte{1}, msg1)
+	msg2, ack2, _, err := dq.Get()
+	Nil(t, err)
+	Equal(t, []byte{2}, msg2)
+
+	// acked out of order, the committed position stays before message 0
+	ack2()
+	Equal(t, int64(4), dq.Depth())
+	ack0()
+	Equal(t, int64(3), dq.Depth())
+
+	// nack redelivers before new messages
+	nack1()
+	msg1, ack1, _, err := dq.Get()
+	Nil(t, err)
+	Equal(t, []byte{1}, msg1)
+	ack1()
+	Equal(t, int64(1), dq.Depth())
+	// the first file is removed once the messages in it are committed
+	assertFileNotExist(t, dq.(*DiskQueue).fileName(0))
+
+	// not acked within the visibility timeout
+	msg3, _, _, err := dq.Get()
+	Nil(t, err)
+	Equal(t, []byte{3}, msg3)
+	startAt := time.Now()
+	msg3, ack3, _, err := dq.Get()
+	Nil(t, err)
+	Equal(t, []byte{3}, msg3)
+	if time.Since(startAt) < 100*time.Millisecond {
+		t.Fatalf("redelivered too early after %s", time.Since(startAt))
+	}
+	ack3()
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueGetCompact(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_get_compact" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dq := New(WithName(dqName), WithDataDIR(tmpDir), WithMaxBytesPerFile(1024), WithLogf(l))
+
+	for i := 0; i < 500; i++ {
+		Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+	}
+	_, _, nack0, err := dq.Get()
+	Nil(t, err)
+	// acked behind the un-acked message 0, half through Get, half through ReadChan
+	for i := 1; i < 500; i++ {
+		if i%2 == 0 {
+			<-dq.ReadChan()
+			continue
+		}
+		_, ack, _, err := dq.Get()
+		Nil(t, err)
+		ack()
+	}
+	Equal(t, int64(500), dq.Depth())
+
+	// message 0 is read back from disk
+	nack0()
+	msg0, _, _, err := dq.Get()
+	Nil(t, err)
+	Equal(t, []byte("0"), msg0)
+	Nil(t, dq.Close())
+
+	d := dq.(*DiskQueue)
+	if len(d.inFlight) > 2*d.unacked+compactInFlightSlack {
+		t.Fatalf("%d in-flight entries for %d un-acked messages", len(d.inFlight), d.unacked)
+	}
+	for _, f := range d.inFlight[1:] {
+		if !f.acked {
+			t.Fatal("only message 0 should be un-acked")
+		}
+	}
+}
+
+func TestDiskQueueGetRestart(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_get_restart" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dq := New(WithName(dqName), WithDataDIR(tmpDir), WithLogf(l))
+
+	for i := 0; i < 3; i++ {
+		Nil(t, dq.Put([]byte{byte(i)}))
+	}
+	_, ack0, _, err := dq.Get()
+	Nil(t, err)
+	ack0()
+	_, _, _, err = dq.Get()
+	Nil(t, err)
+	_, ack2, _, err := dq.Get()
+	Nil(t, err)
+	ack2()
+	Nil(t, dq.Close())
+
+	// committed and in-flight positions are persisted separately
+	fileName := dq.(*DiskQueue).metaDataFileName()
+	bs, err := os.ReadFile(fileName)
+	Nil(t, err)
+	Equal(t, "2\n0,11\n0,33\n0,33\n", string(bs))
+
+	// message 1 was not acked, it is delivered again together with message 2
+	dq = New(WithName(dqName), WithDataDIR(tmpDir), WithLogf(l))
+	defer dq.Close()
+	Equal(t, int64(2), dq.Depth())
+	for i := 1; i < 3; i++ {
+		msg, ack, _, err := dq.Get()
+		Nil(t, err)
+		Equal(t, []byte{byte(i)}, msg)
+		ack()
+	}
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueVerifyRepair(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_verify_repair" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts := []Option{WithName(dqName), WithDataDIR(tmpDir), WithLogf(l)}
+	dq := New(opts...)
+
+	const recordSize = recordHeaderSize + 10
+	for i := 0; i < 5; i++ {
+		Nil(t, dq.Put(bytes.Repeat([]byte{byte(i)}, 10)))
+	}
+	msg := <-dq.ReadChan()
+	Equal(t, bytes.Repeat([]byte{0}, 10), msg)
+	Nil(t, dq.Close())
+
+	// flip a byte in the body of message 2 and leave a torn record at the tail
+	fileName := dq.(*DiskQueue).fileName(0)
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0o600)
+	Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 2*recordSize+recordHeaderSize+5)
+	Nil(t, err)
+	_, err = f.WriteAt([]byte{recordMagic, recordVersion, 0}, 5*recordSize)
+	Nil(t, err)
+	Nil(t, f.Close())
+
+	report, err := Verify(opts...)
+	Nil(t, err)
+	Equal(t, true, report.Corrupt())
+	Equal(t, int64(3), report.Depth)
+	Equal(t, []Range{{2 * recordSize, 3 * recordSize}, {5 * recordSize, 5*recordSize + 3}}, report.Files[0].Corrupt)
+
+	report, err = Repair(opts...)
+	Nil(t, err)
+	Equal(t, int64(3), report.Depth)
+	stat, err := os.Stat(dq.(*DiskQueue).badFileName(0))
+	Nil(t, err)
+	Equal(t, int64(recordSize+3), stat.Size())
+
+	report, err = Verify(opts...)
+	Nil(t, err)
+	Equal(t, false, report.Corrupt())
+
+	dq = New(opts...)
+	defer dq.Close()
+	Equal(t, int64(3), dq.Depth())
+	for _, i := range []int{1, 3, 4} {
+		msg := <-dq.ReadChan()
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 10), msg)
+	}
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueCursors(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_cursors" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	// 2 messages per file
+	opts := []Option{WithName(dqName), WithDataDIR(tmpDir), WithMaxBytesPerFile(2 * (1 + recordHeaderSize)), WithLogf(l)}
+	dq := New(opts...)
+
+	indexer, err := dq.Cursor("indexer")
+	Nil(t, err)
+	auditor, err := dq.Cursor("auditor")
+	Nil(t, err)
+	_, err = dq.Cursor("../auditor")
+	NotNil(t, err)
+
+	for i := 0; i < 6; i++ {
+		Nil(t, dq.Put([]byte{byte(i)}))
+	}
+	Equal(t, int64(6), indexer.Depth())
+	Equal(t, int64(6), auditor.Depth())
+
+	// the default reader and the cursors read independently
+	for i := 0; i < 6; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	for i := 0; i < 2; i++ {
+		Equal(t, []byte{byte(i)}, <-indexer.ReadChan())
+	}
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte{byte(i)}, <-auditor.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(4), indexer.Depth())
+	Equal(t, int64(3), auditor.Depth())
+
+	// the indexer still holds the second file
+	assertFileNotExist(t, dq.(*DiskQueue).fileName(0))
+	_, err = os.Stat(dq.(*DiskQueue).fileName(1))
+	Nil(t, err)
+	Nil(t, dq.Close())
+
+	// the cursors resume from their persisted positions
+	dq = New(opts...)
+	defer dq.Close()
+	auditor, err = dq.Cursor("auditor")
+	Nil(t, err)
+	Equal(t, int64(3), auditor.Depth())
+	for i := 3; i < 6; i++ {
+		Equal(t, []byte{byte(i)}, <-auditor.ReadChan())
+	}
+	Equal(t, int64(0), auditor.Depth())
+	indexer, err = dq.Cursor("indexer")
+	Nil(t, err)
+	Equal(t, int64(4), indexer.Depth())
+	_, err = os.Stat(dq.(*DiskQueue).fileName(1))
+	Nil(t, err)
+
+	// removing the indexer releases the files it was holding
+	Nil(t, dq.RemoveCursor("indexer"))
+	assertFileNotExist(t, dq.(*DiskQueue).fileName(1))
+	assertFileNotExist(t, dq.(*DiskQueue).cursorMetaDataFileName("indexer"))
+}
+
+func TestDiskQueuePutBatch(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_batch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	// 3 messages per file
+	dq := New(WithName(dqName), WithDataDIR(tmpDir), WithMaxBytesPerFile(3*(1+recordHeaderSize)),
+		WithMaxMsgSize(1), WithLogf(l))
+	defer dq.Close()
+
+	// nothing is written if a message is invalid
+	NotNil(t, dq.PutBatch([][]byte{{0}, {1, 2}}))
+	Equal(t, int64(0), dq.Depth())
+
+	batch := make([][]byte, 0, 8)
+	for i := 0; i < 8; i++ {
+		batch = append(batch, []byte{byte(i)})
+	}
+	Nil(t, dq.PutBatch(batch))
+	Nil(t, dq.Put([]byte{8}))
+	Equal(t, int64(9), dq.Depth())
+	stat, err := os.Stat(dq.(*DiskQueue).fileName(2))
+	Nil(t, err)
+	Equal(t, int64(3*(1+recordHeaderSize)), stat.Size())
+
+	for i := 0; i < 9; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueGroupCommit(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_group_commit" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dq := New(WithName(dqName), WithDataDIR(tmpDir), WithSyncEvery(1<<30), WithSyncTimeout(time.Hour),
+		WithGroupCommit(true), WithLogf(l))
+	defer dq.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Nil(t, dq.PutBatch([][]byte{[]byte("a"), []byte("b")}))
+			Nil(t, dq.Put([]byte("c")))
+		}()
+	}
+	wg.Wait()
+
+	// every acknowledged write is covered by the persisted metadata
+	d := readMetaDataFile(dq.(*DiskQueue).metaDataFileName(), 0)
+	Equal(t, int64(30), d.depth)
+	Equal(t, int64(30*(1+recordHeaderSize)), d.writePos)
+}
+
+func TestDiskQueueCompression(t *testing.T) {
+	for _, compression := range []Compression{CompressionSnappy, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			l := NewTestLogger(t)
+			dqName := "test_disk_queue_compression" + strconv.Itoa(int(time.Now().Unix()))
+			tmpDir, err := os.MkdirTemp("", dqName)
+			Nil(t, err)
+			defer os.RemoveAll(tmpDir)
+			msg := bytes.Repeat([]byte("0123456789"), 10)
+			// 5 messages per file
+			opts := []Option{WithName(dqName), WithDataDIR(tmpDir), WithCompression(compression),
+				WithMaxBytesPerFile(5 * int64(1+len(msg)+recordHeaderSize)), WithLogf(l)}
+			dq := New(opts...)
+			cursor, err := dq.Cursor("auditor")
+			Nil(t, err)
+
+			for i := 0; i < 12; i++ {
+				Nil(t, dq.Put(append([]byte{byte(i)}, msg...)))
+			}
+			// closed files are compressed in the background
+			for _, fileNum := range []int64{0, 1} {
+				fn := dq.(*DiskQueue).compressedFileName(fileNum, compression)
+				for i := 0; i < 100; i++ {
+					if _, err := os.Stat(fn); err == nil {
+						break
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				_, err = os.Stat(fn)
+				Nil(t, err)
+				assertFileNotExist(t, dq.(*DiskQueue).fileName(fileNum))
+			}
+			stats := dq.Stats()
+			Equal(t, int64(3), stats.Files)
+			if stats.DiskBytes >= 12*int64(len(msg)+recordHeaderSize) {
+				t.Fatalf("disk bytes %d not compressed", stats.DiskBytes)
+			}
+
+			for i := 0; i < 7; i++ {
+				Equal(t, append([]byte{byte(i)}, msg...), <-dq.ReadChan())
+			}
+			for i := 0; i < 3; i++ {
+				Equal(t, append([]byte{byte(i)}, msg...), <-cursor.ReadChan())
+			}
+			Nil(t, dq.Close())
+
+			// readers resume in the middle of compressed files
+			dq = New(opts...)
+			defer dq.Close()
+			cursor, err = dq.Cursor("auditor")
+			Nil(t, err)
+			for i := 7; i < 12; i++ {
+				Equal(t, append([]byte{byte(i)}, msg...), <-dq.ReadChan())
+			}
+			for i := 3; i < 12; i++ {
+				Equal(t, append([]byte{byte(i)}, msg...), <-cursor.ReadChan())
+			}
+			Equal(t, int64(0), dq.Depth())
+			Equal(t, int64(0), cursor.Depth())
+		})
+	}
+}
+
+func TestDiskQueueRetention(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_retention" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	msg := bytes.Repeat([]byte{'a'}, 99)
+	fileSize := 5 * int64(1+len(msg)+recordHeaderSize)
+
+	var dropped []DroppedFile
+	dq := New(WithName(dqName), WithDataDIR(tmpDir), WithMaxBytesPerFile(fileSize), WithLogf(l),
+		WithRetention(RetentionPolicy{
+			MaxBytes: 2*fileSize + fileSize/2,
+			OnDrop: func(file DroppedFile) {
+				dropped = append(dropped, file)
+			},
+		}))
+	defer dq.Close()
+
+	for i := 0; i < 20; i++ {
+		Nil(t, dq.Put(append([]byte{byte(i)}, msg...)))
+	}
+	Equal(t, int64(15), dq.Depth())
+	Equal(t, []DroppedFile{{FileNum: 0, Bytes: fileSize, Messages: 5, Unread: 5, Reason: DropReasonMaxBytes}}, dropped)
+	assertFileNotExist(t, dq.(*DiskQueue).fileName(0))
+	stats := dq.Stats()
+	Equal(t, 3*fileSize, stats.DiskBytes)
+	Equal(t, int64(1), stats.DroppedFiles)
+	Equal(t, int64(5), stats.DroppedMessages)
+
+	// reading resumes after the dropped file
+	Equal(t, append([]byte{5}, msg...), <-dq.ReadChan())
+}
+
+func TestDiskQueueRetentionMaxAge(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_retention_max_age" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dq := New(WithName(dqName), WithDataDIR(tmpDir), WithMaxBytesPerFile(5*(1+recordHeaderSize)),
+		WithSyncTimeout(10*time.Millisecond), WithLogf(l),
+		WithRetention(RetentionPolicy{MaxAge: 50 * time.Millisecond}))
+	defer dq.Close()
+
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.Put([]byte{byte(i)}))
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// the file being written is kept
+	Equal(t, int64(5), dq.Depth())
+	Equal(t, []byte{5}, <-dq.ReadChan())
+}
+
+func TestDiskQueueSeek(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_seek" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	// 3 messages per file
+	msgSize := int64(1 + recordHeaderSize)
+	opts := []Option{WithName(dqName), WithDataDIR(tmpDir), WithMaxBytesPerFile(3 * msgSize),
+		WithRetainSegments(true), WithIndexInterval(2), WithLogf(l)}
+	dq := New(opts...)
+
+	for i := 0; i < 5; i++ {
+		Nil(t, dq.Put([]byte{byte(i)}))
+	}
+	time.Sleep(20 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	for i := 5; i < 10; i++ {
+		Nil(t, dq.Put([]byte{byte(i)}))
+	}
+
+	for i := 0; i < 10; i++ {
+		msg := <-dq.MessageChan()
+		Equal(t, Offset{FileNum: int64(i / 3), Pos: int64(i%3) * msgSize}, msg.Offset)
+		Equal(t, []byte{byte(i)}, msg.Data)
+	}
+	Equal(t, int64(0), dq.Depth())
+	// the files read are retained
+	_, err = os.Stat(dq.(*DiskQueue).fileName(0))
+	Nil(t, err)
+
+	// the index of the second file has an entry for message 5, written after since
+	Nil(t, dq.SeekToTime(since))
+	Equal(t, int64(7), dq.Depth())
+	for i := 3; i < 10; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	Nil(t, dq.SeekTo(Offset{FileNum: 2, Pos: msgSize}))
+	Equal(t, int64(3), dq.Depth())
+	msg := <-dq.MessageChan()
+	Equal(t, Offset{FileNum: 2, Pos: msgSize}, msg.Offset)
+	Equal(t, []byte{7}, msg.Data)
+
+	// the end of a complete file is the start of the next one
+	Nil(t, dq.SeekTo(Offset{FileNum: 2, Pos: 3 * msgSize}))
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte{9}, <-dq.ReadChan())
+
+	// not the start of a record
+	err = dq.SeekTo(Offset{FileNum: 2, Pos: 5})
+	Equal(t, true, errors.Is(err, ErrInvalidOffset))
+	err = dq.SeekTo(Offset{FileNum: 4})
+	Equal(t, true, errors.Is(err, ErrInvalidOffset))
+
+	// cursors seek on their own
+	replay, err := dq.Cursor("replay")
+	Nil(t, err)
+	Equal(t, int64(0), replay.Depth())
+	Nil(t, replay.SeekTo(Offset{FileNum: 0, Pos: msgSize}))
+	Equal(t, int64(9), replay.Depth())
+	msg = <-replay.MessageChan()
+	Equal(t, Offset{FileNum: 0, Pos: msgSize}, msg.Offset)
+	Equal(t, []byte{1}, msg.Data)
+	Nil(t, replay.SeekToTime(since))
+	Equal(t, []byte{3}, <-replay.ReadChan())
+	Equal(t, int64(0), dq.Depth())
+	Nil(t, dq.Close())
+
+	// the retained files survive a restart
+	dq = New(opts...)
+	defer dq.Close()
+	Nil(t, dq.SeekTo(Offset{}))
+	Equal(t, int64(10), dq.Depth())
+	Equal(t, []byte{0}, <-dq.ReadChan())
+	Nil(t, dq.Put([]byte{10}))
+	Equal(t, int64(10), dq.Depth())
+	Nil(t, dq.SeekToTime(time.Now().Add(time.Hour)))
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueMetrics(t *testing.T) {
+	dqName := "test_disk_queue_metrics" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	var logs bytes.Buffer
+	// 2 messages per file
+	dq := New(WithName(dqName), WithDataDIR(tmpDir), WithMaxBytesPerFile(2*(1+recordHeaderSize)),
+		WithMeterProvider(mp), WithLogger(xlogger.NewStdLogger(&logs)))
+
+	for i := 0; i < 4; i++ {
+		Nil(t, dq.Put([]byte{byte(i)}))
+	}
+	for i := 0; i < 3; i++ {
+		<-dq.ReadChan()
+	}
+
+	collect := func() map[string]int64 {
+		var rm metricdata.ResourceMetrics
+		Nil(t, reader.Collect(context.Background(), &rm))
+		values := make(map[string]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				switch data := m.Data.(type) {
+				case metricdata.Gauge[int64]:
+					for _, dp := range data.DataPoints {
+						values[m.Name] += dp.Value
+					}
+				case metricdata.Sum[int64]:
+					for _, dp := range data.DataPoints {
+						values[m.Name] += dp.Value
+					}
+				case metricdata.Histogram[float64]:
+					for _, dp := range data.DataPoints {
+						values[m.Name] += int64(dp.Count)
+					}
+				}
+			}
+		}
+		return values
+	}
+	values := collect()
+	Equal(t, int64(1), values["diskq_depth"])
+	Equal(t, true, values["diskq_disk_bytes"] > 0)
+	Nil(t, dq.Close())
+
+	// the gauges are unregistered on close
+	values = collect()
+	_, ok := values["diskq_depth"]
+	Equal(t, false, ok)
+	Equal(t, int64(4*(1+recordHeaderSize)), values["diskq_bytes_written"])
+	Equal(t, int64(1), values["diskq_file_rotations"])
+	Equal(t, int64(0), values["diskq_corruption_events"])
+	Equal(t, true, values["diskq_bytes_read"] >= 3*(1+recordHeaderSize))
+	Equal(t, true, values["diskq_fsync_duration"] > 0)
+
+	Equal(t, true, strings.Contains(logs.String(), "INFO msg=DISKQUEUE("+dqName+"): closing"))
+}
+
+func TestPriorityQueue(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_priority_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts := []PriorityOption{
+		WithLaneWeights(1, 2, 4),
+		WithLaneQueueOptions(WithName(dqName), WithDataDIR(tmpDir), WithLogf(l)),
+	}
+	pq := NewPriorityQueue(3, opts...)
+
+	NotNil(t, pq.Put(3, []byte{3}))
+	for p := 0; p < 3; p++ {
+		for i := 0; i < 4; i++ {
+			Nil(t, pq.Put(p, []byte{byte(p), byte(i)}))
+		}
+	}
+	Equal(t, int64(12), pq.Depth())
+	Equal(t, int64(4), pq.LaneDepth(1))
+
+	// 4 messages of priority 2, 2 of priority 1 and 1 of priority 0 per round
+	expected := []byte{2, 2, 2, 2, 1, 1, 0, 1, 1}
+	for i, p := range expected {
+		data := <-pq.ReadChan()
+		Equal(t, p, data[0])
+		if i == 6 {
+			Equal(t, []byte{0, 0}, data)
+		}
+	}
+	Equal(t, int64(0), pq.LaneDepth(2))
+	// the last message is acked once the read loop has stopped
+	Nil(t, pq.Close())
+	Equal(t, int64(0), pq.LaneDepth(1))
+
+	// the lanes resume after a restart
+	pq = NewPriorityQueue(3, opts...)
+	defer pq.Close()
+	Equal(t, int64(3), pq.LaneDepth(0))
+	for i := 1; i < 4; i++ {
+		Equal(t, []byte{0, byte(i)}, <-pq.ReadChan())
+	}
+
+	// an empty queue hands out the first message put
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.Put(1, []byte{1, 4})
+	}()
+	Equal(t, []byte{1, 4}, <-pq.ReadChan())
+	Equal(t, int64(0), pq.Depth())
+}
+
+func TestDiskQueueBackpressure(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_backpressure" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	dq := New(WithName(dqName+"_depth"), WithDataDIR(tmpDir), WithMaxDepth(2), WithLogf(l))
+	defer dq.Close()
+	Nil(t, dq.Put([]byte{0}))
+	Nil(t, dq.Put([]byte{1}))
+	Equal(t, ErrFull, dq.Put([]byte{2}))
+	Equal(t, ErrFull, dq.PutBatch([][]byte{{2}}))
+	Equal(t, []byte{0}, <-dq.ReadChan())
+	Nil(t, dq.Put([]byte{2}))
+
+	// 2 messages of 1 byte
+	dq = New(WithName(dqName+"_bytes"), WithDataDIR(tmpDir), WithMaxBytes(2*(1+recordHeaderSize)),
+		WithMaxBytesPerFile(1+recordHeaderSize), WithLogf(l))
+	defer dq.Close()
+	Nil(t, dq.PutBatch([][]byte{{0}, {1}}))
+	Equal(t, ErrFull, dq.Put([]byte{2}))
+	Equal(t, []byte{0}, <-dq.ReadChan())
+	Nil(t, dq.Put([]byte{2}))
+
+	dq = New(WithName(dqName+"_block"), WithDataDIR(tmpDir), WithMaxDepth(1), WithBlockOnFull(true),
+		WithLowWaterMark(1), WithLogf(l))
+	defer dq.Close()
+	Nil(t, dq.Put([]byte{0}))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	Equal(t, context.DeadlineExceeded, dq.PutCtx(ctx, []byte{1}))
+
+	done := make(chan error)
+	go func() {
+		done <- dq.Put([]byte{1})
+	}()
+	select {
+	case <-done:
+		t.Fatal("put should block on a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	data, ack, _, err := dq.GetCtx(context.Background())
+	Nil(t, err)
+	Equal(t, []byte{0}, data)
+	ack()
+	<-dq.LowWaterChan()
+	Nil(t, <-done)
+	Equal(t, int64(1), dq.Depth())
+
+	Equal(t, []byte{1}, <-dq.ReadChan())
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, _, _, err = dq.GetCtx(ctx)
+	Equal(t, context.Canceled, err)
+}
+
+type typedOrder struct {
+	ID     int
+	Amount float64
+}
+
+func TestTyped(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_typed" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts := []Option{WithDataDIR(tmpDir), WithLogf(l)}
+
+	for i, codec := range []Codec[typedOrder]{JSONCodec[typedOrder]{}, GobCodec[typedOrder]{}} {
+		q := NewTyped[typedOrder](New(append(opts, WithName(dqName+strconv.Itoa(i)))...), codec)
+		Nil(t, q.Put(typedOrder{ID: 1, Amount: 1.5}))
+		Nil(t, q.PutBatch([]typedOrder{{ID: 2}, {ID: 3}}))
+		Equal(t, int64(3), q.Depth())
+
+		v, err := q.Get(context.Background())
+		Nil(t, err)
+		Equal(t, typedOrder{ID: 1, Amount: 1.5}, v)
+		Equal(t, typedOrder{ID: 2}, <-q.ReadChan())
+		Equal(t, typedOrder{ID: 3}, <-q.ReadChan())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err = q.Get(ctx)
+		cancel()
+		Equal(t, context.DeadlineExceeded, err)
+		Nil(t, q.Close())
+	}
+
+	// a message decoded ahead by ReadChan but not received is kept
+	queue := New(append(opts, WithName(dqName+"_proto"))...)
+	q := NewTyped[*wrapperspb.StringValue](queue, ProtobufCodec[*wrapperspb.StringValue]{})
+	Nil(t, queue.Put([]byte("garbage")))
+	Nil(t, q.Put(wrapperspb.String("a")))
+	Nil(t, q.Put(wrapperspb.String("b")))
+	Equal(t, "a", (<-q.ReadChan()).GetValue())
+	Nil(t, q.Close())
+
+	q = NewTyped[*wrapperspb.StringValue](New(append(opts, WithName(dqName+"_proto"))...),
+		ProtobufCodec[*wrapperspb.StringValue]{})
+	defer q.Close()
+	v, err := q.Get(context.Background())
+	Nil(t, err)
+	Equal(t, "b", v.GetValue())
+}
+
+func TestTypedCloseAfterReceive(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_typed_close" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := os.MkdirTemp("", dqName)
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts := []Option{WithDataDIR(tmpDir), WithName(dqName), WithLogf(l)}
+
+	q := NewTyped[typedOrder](New(opts...), JSONCodec[typedOrder]{})
+	for i := 0; i < 20; i++ {
+		Nil(t, q.Put(typedOrder{ID: i}))
+	}
+	Nil(t, q.Close())
+
+	// a value received from ReadChan right before Close is not redelivered
+	for i := 0; i < 20; i++ {
+		q = NewTyped[typedOrder](New(opts...), JSONCodec[typedOrder]{})
+		Equal(t, typedOrder{ID: i}, <-q.ReadChan())
+		Nil(t, q.Close())
+	}
+}
+
 func BenchmarkDiskQueuePut16(b *testing.B) {
 	benchmarkDiskQueuePut(16, b)
 }
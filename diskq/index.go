@@ -0,0 +1,191 @@
+package diskq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// index format, one file per data file
+//
+// entry: pos(8) | count(8) | time(8)
+//
+// an entry is appended for every indexInterval-th record of a data file, with
+// the position of the record, the number of records before it in the file and
+// the time it was written, a last entry with the size of the file and the
+// number of records in it is appended when the writer moves to the next file
+//
+// the index is advisory, missing entries are recovered by scanning records
+const indexEntrySize = 24
+
+type indexEntry struct {
+	pos   int64
+	count int64
+	time  int64 // unix nano
+}
+
+func appendIndexEntry(buf []byte, e indexEntry) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.pos))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.count))
+	return binary.BigEndian.AppendUint64(buf, uint64(e.time))
+}
+
+func (d *DiskQueue) indexFileName(fileNum int64) string {
+	return path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.%06d.idx", d.name, fileNum))
+}
+
+// readIndex returns the entries of a data file, ignoring a partially written one
+func (d *DiskQueue) readIndex(fileNum int64) []indexEntry {
+	bs, err := os.ReadFile(d.indexFileName(fileNum))
+	if err != nil {
+		return nil
+	}
+	entries := make([]indexEntry, 0, len(bs)/indexEntrySize)
+	for i := 0; i+indexEntrySize <= len(bs); i += indexEntrySize {
+		entries = append(entries, indexEntry{
+			pos:   int64(binary.BigEndian.Uint64(bs[i:])),
+			count: int64(binary.BigEndian.Uint64(bs[i+8:])),
+			time:  int64(binary.BigEndian.Uint64(bs[i+16:])),
+		})
+	}
+	return entries
+}
+
+// indexRecords indexes the count records just written from buf at start
+func (d *DiskQueue) indexRecords(start int64, buf []byte, count int64) {
+	now := time.Now().UnixNano()
+	d.indexBuf = d.indexBuf[:0]
+	var off int64
+	for i := int64(0); i < count; i++ {
+		if d.writeCount%d.indexInterval == 0 {
+			d.indexBuf = appendIndexEntry(d.indexBuf, indexEntry{pos: start + off, count: d.writeCount, time: now})
+		}
+		d.writeCount++
+		off += recordHeaderSize + int64(binary.BigEndian.Uint32(buf[off+2:off+6]))
+	}
+	d.writeIndex()
+}
+
+// finishIndex appends the last entry of the write file and closes its index
+func (d *DiskQueue) finishIndex() {
+	d.indexBuf = appendIndexEntry(d.indexBuf[:0], indexEntry{
+		pos:   d.writePos,
+		count: d.writeCount,
+		time:  time.Now().UnixNano(),
+	})
+	d.writeIndex()
+	d.closeIndex()
+	d.writeCount = 0
+}
+
+func (d *DiskQueue) writeIndex() {
+	if len(d.indexBuf) == 0 {
+		return
+	}
+	var err error
+	if d.indexFile == nil {
+		d.indexFile, err = os.OpenFile(d.indexFileName(d.writeFileNum), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to open index - %s", d.name, err)
+			return
+		}
+	}
+	_, err = d.indexFile.Write(d.indexBuf)
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to write index - %s", d.name, err)
+		d.closeIndex()
+	}
+}
+
+func (d *DiskQueue) closeIndex() {
+	if d.indexFile != nil {
+		d.indexFile.Close()
+		d.indexFile = nil
+	}
+}
+
+// loadWriteIndex restores the number of records in the write file
+func (d *DiskQueue) loadWriteIndex() {
+	d.writeCount = d.countBefore(d.writeFileNum, d.writePos)
+}
+
+// countBefore returns the number of records before pos in a data file, pos
+// -1 meaning the end of the file
+func (d *DiskQueue) countBefore(fileNum int64, pos int64) int64 {
+	var from indexEntry
+	for _, e := range d.readIndex(fileNum) {
+		if pos >= 0 && e.pos > pos {
+			break
+		}
+		from = e
+	}
+	return from.count + d.countRecords(fileNum, from.pos, pos)
+}
+
+// countRecords counts the records in [from, to) of a data file, to -1
+// meaning the end of the file
+func (d *DiskQueue) countRecords(fileNum int64, from int64, to int64) int64 {
+	if to >= 0 && from >= to {
+		return 0
+	}
+	r, _, err := d.openSegment(fileNum, from)
+	if err != nil {
+		return 0
+	}
+	defer r.Close()
+
+	var count int64
+	reader := bufio.NewReader(r)
+	for pos := from; to < 0 || pos < to; count++ {
+		_, n, err := decodeRecord(reader, d.minMsgSize, d.maxMsgSize)
+		if err != nil {
+			break
+		}
+		pos += n
+	}
+	return count
+}
+
+// countBetween returns the number of records between two offsets
+func (d *DiskQueue) countBetween(from Offset, to Offset) int64 {
+	if from.FileNum == to.FileNum {
+		return d.countBefore(to.FileNum, to.Pos) - d.countBefore(from.FileNum, from.Pos)
+	}
+	count := d.countBefore(from.FileNum, -1) - d.countBefore(from.FileNum, from.Pos)
+	for i := from.FileNum + 1; i < to.FileNum; i++ {
+		count += d.countBefore(i, -1)
+	}
+	return count + d.countBefore(to.FileNum, to.Pos)
+}
+
+// offsetAtTime returns the offset of the indexed record preceding the first
+// record written at or after t, or end if there is none
+func (d *DiskQueue) offsetAtTime(t time.Time, fromFileNum int64, end Offset) Offset {
+	for i := fromFileNum; i <= end.FileNum; i++ {
+		entries := d.readIndex(i)
+		// the time of the last record of a file without a last entry is unknown
+		last := time.Now()
+		if i < end.FileNum {
+			stat, err := d.statSegment(i)
+			if err != nil {
+				continue
+			}
+			last = stat.ModTime()
+		}
+		entries = append(entries, indexEntry{pos: -1, time: last.UnixNano()})
+
+		for j, e := range entries {
+			if e.time < t.UnixNano() {
+				continue
+			}
+			if j == 0 {
+				return Offset{FileNum: i}
+			}
+			return Offset{FileNum: i, Pos: entries[j-1].pos}
+		}
+	}
+	return end
+}
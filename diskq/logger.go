@@ -0,0 +1,36 @@
+package diskq
+
+import (
+	"fmt"
+
+	"github.com/ccheers/xpkg/xlogger"
+)
+
+// NewAppLogFunc adapts an xlogger.Logger, the formatted line is logged under
+// the "msg" key
+func NewAppLogFunc(logger xlogger.Logger) AppLogFunc {
+	return func(lvl LogLevel, f string, args ...interface{}) {
+		_ = logger.Log(lvl.xloggerLevel(), "msg", fmt.Sprintf(f, args...))
+	}
+}
+
+// WithLogger logs through an xlogger.Logger, see NewAppLogFunc
+func WithLogger(logger xlogger.Logger) Option {
+	return WithLogf(NewAppLogFunc(logger))
+}
+
+func (l LogLevel) xloggerLevel() xlogger.Level {
+	switch l {
+	case DEBUG:
+		return xlogger.LevelDebug
+	case INFO:
+		return xlogger.LevelInfo
+	case WARN:
+		return xlogger.LevelWarn
+	case ERROR:
+		return xlogger.LevelError
+	case FATAL:
+		return xlogger.LevelFatal
+	}
+	return xlogger.LevelInfo
+}
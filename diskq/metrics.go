@@ -0,0 +1,132 @@
+package diskq
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+const meterName = "github.com/ccheers/xpkg/diskq"
+
+// metrics reports the activity of a queue, every attribute set carries the
+// name of the queue, reads also carry the reader, "" for the default reader
+type metrics struct {
+	attrs metric.MeasurementOption
+
+	bytesWritten metric.Int64Counter
+	bytesRead    metric.Int64Counter
+	fsync        metric.Float64Histogram
+	rotations    metric.Int64Counter
+	corruptions  metric.Int64Counter
+	registration metric.Registration
+}
+
+// newMetrics registers the instruments of a queue, it falls back to no-op
+// instruments if the meter provider rejects one of them
+func (d *DiskQueue) newMetrics(mp metric.MeterProvider) *metrics {
+	m, err := d.registerMetrics(mp)
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to register metrics - %s", d.name, err)
+		m, _ = d.registerMetrics(noop.NewMeterProvider())
+	}
+	return m
+}
+
+func (d *DiskQueue) registerMetrics(mp metric.MeterProvider) (*metrics, error) {
+	meter := mp.Meter(meterName)
+	m := &metrics{
+		attrs: metric.WithAttributeSet(attribute.NewSet(attribute.String("queue", d.name))),
+	}
+
+	var err error
+	m.bytesWritten, err = meter.Int64Counter("diskq_bytes_written",
+		metric.WithUnit("By"), metric.WithDescription("bytes written to the data files"))
+	if err != nil {
+		return nil, err
+	}
+	m.bytesRead, err = meter.Int64Counter("diskq_bytes_read",
+		metric.WithUnit("By"), metric.WithDescription("bytes read from the data files by the default reader and the cursors"))
+	if err != nil {
+		return nil, err
+	}
+	m.fsync, err = meter.Float64Histogram("diskq_fsync_duration",
+		metric.WithUnit("s"), metric.WithDescription("duration of the fsyncs of the write file and the metadata"))
+	if err != nil {
+		return nil, err
+	}
+	m.rotations, err = meter.Int64Counter("diskq_file_rotations",
+		metric.WithDescription("number of times the writer moved to a new data file"))
+	if err != nil {
+		return nil, err
+	}
+	m.corruptions, err = meter.Int64Counter("diskq_corruption_events",
+		metric.WithDescription("number of corrupt ranges skipped by the default reader"))
+	if err != nil {
+		return nil, err
+	}
+
+	depth, err := meter.Int64ObservableGauge("diskq_depth",
+		metric.WithDescription("number of messages not consumed by the default reader"))
+	if err != nil {
+		return nil, err
+	}
+	diskBytes, err := meter.Int64ObservableGauge("diskq_disk_bytes",
+		metric.WithUnit("By"), metric.WithDescription("size on disk of the data files"))
+	if err != nil {
+		return nil, err
+	}
+	m.registration, err = meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		observer.ObserveInt64(depth, d.Depth(), m.attrs)
+		observer.ObserveInt64(diskBytes, d.Stats().DiskBytes, m.attrs)
+		return nil
+	}, depth, diskBytes)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *metrics) unregister() {
+	if m == nil {
+		return
+	}
+	m.registration.Unregister()
+}
+
+func (m *metrics) written(n int) {
+	if m == nil {
+		return
+	}
+	m.bytesWritten.Add(context.Background(), int64(n), m.attrs)
+}
+
+func (m *metrics) read(reader string, n int64) {
+	if m == nil {
+		return
+	}
+	m.bytesRead.Add(context.Background(), n, m.attrs, metric.WithAttributes(attribute.String("reader", reader)))
+}
+
+func (m *metrics) synced(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.fsync.Record(context.Background(), time.Since(start).Seconds(), m.attrs)
+}
+
+func (m *metrics) rotated() {
+	if m == nil {
+		return
+	}
+	m.rotations.Add(context.Background(), 1, m.attrs)
+}
+
+func (m *metrics) corrupted() {
+	if m == nil {
+		return
+	}
+	m.corruptions.Add(context.Background(), 1, m.attrs)
+}
@@ -0,0 +1,224 @@
+package diskq
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var ErrInvalidPriority = errors.New("invalid priority")
+
+type priorityOptions struct {
+	weights      []int
+	queueOptions []Option
+}
+
+type PriorityOption interface {
+	apply(*priorityOptions)
+}
+
+type priorityOptionFunc func(*priorityOptions)
+
+func (f priorityOptionFunc) apply(opt *priorityOptions) {
+	f(opt)
+}
+
+// WithLaneWeights sets the number of messages read from each lane per round,
+// indexed by priority, the default weight of priority p is 2^p
+func WithLaneWeights(weights ...int) PriorityOption {
+	return priorityOptionFunc(func(opt *priorityOptions) {
+		opt.weights = weights
+	})
+}
+
+// WithLaneQueueOptions sets the options of the queues of the lanes, lane p is
+// named <name>_lane<p>
+func WithLaneQueueOptions(opts ...Option) PriorityOption {
+	return priorityOptionFunc(func(opt *priorityOptions) {
+		opt.queueOptions = opts
+	})
+}
+
+// PriorityQueue is a set of queues (lanes), a message is put into the lane of
+// its priority and the lanes of higher priority are read first
+//
+// reads are scheduled in rounds, each lane with messages may be read as many
+// times per round as its weight, higher priorities first, a new round starts
+// once every lane with messages has used its weight, so that lower priorities
+// are not starved
+type PriorityQueue struct {
+	lanes   []*DiskQueue
+	weights []int
+	credits []int
+
+	readOnce sync.Once
+	readChan chan []byte
+	exitOnce sync.Once
+	exitChan chan struct{}
+	doneChan chan struct{}
+}
+
+// NewPriorityQueue opens a queue with the given number of lanes, the
+// priorities go from 0 (lowest) to lanes-1 (highest)
+func NewPriorityQueue(lanes int, opts ...PriorityOption) *PriorityQueue {
+	_options := &priorityOptions{}
+	for _, o := range opts {
+		o.apply(_options)
+	}
+	lanes = max(lanes, 1)
+	queueOptions := defaultOptions()
+	for _, o := range _options.queueOptions {
+		o.apply(queueOptions)
+	}
+
+	q := &PriorityQueue{
+		lanes:    make([]*DiskQueue, lanes),
+		weights:  make([]int, lanes),
+		credits:  make([]int, lanes),
+		readChan: make(chan []byte),
+		exitChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+	for p := range q.lanes {
+		laneOptions := *queueOptions
+		laneOptions.name = fmt.Sprintf("%s_lane%d", queueOptions.name, p)
+		q.lanes[p] = newDiskqWithOptions(&laneOptions)
+
+		q.weights[p] = 1 << min(p, 30)
+		if p < len(_options.weights) {
+			q.weights[p] = max(_options.weights[p], 1)
+		}
+	}
+	return q
+}
+
+// Lanes returns the number of lanes
+func (q *PriorityQueue) Lanes() int {
+	return len(q.lanes)
+}
+
+// Lane returns the queue of a lane, reading it directly bypasses the scheduling
+func (q *PriorityQueue) Lane(priority int) Interface {
+	return q.lanes[priority]
+}
+
+func (q *PriorityQueue) Put(priority int, data []byte) error {
+	if priority < 0 || priority >= len(q.lanes) {
+		return fmt.Errorf("%w: %d", ErrInvalidPriority, priority)
+	}
+	return q.lanes[priority].Put(data)
+}
+
+func (q *PriorityQueue) PutBatch(priority int, data [][]byte) error {
+	if priority < 0 || priority >= len(q.lanes) {
+		return fmt.Errorf("%w: %d", ErrInvalidPriority, priority)
+	}
+	return q.lanes[priority].PutBatch(data)
+}
+
+// ReadChan returns the messages of every lane in scheduling order, it is
+// expected to be an *unbuffered* channel
+func (q *PriorityQueue) ReadChan() <-chan []byte {
+	q.readOnce.Do(func() {
+		go q.readLoop()
+	})
+	return q.readChan
+}
+
+// Depth returns the number of messages of every lane
+func (q *PriorityQueue) Depth() int64 {
+	var depth int64
+	for _, lane := range q.lanes {
+		depth += lane.Depth()
+	}
+	return depth
+}
+
+// LaneDepth returns the number of messages of a lane
+func (q *PriorityQueue) LaneDepth(priority int) int64 {
+	if priority < 0 || priority >= len(q.lanes) {
+		return 0
+	}
+	return q.lanes[priority].Depth()
+}
+
+// Close stops ReadChan and closes every lane, the message being handed out
+// is read again after a restart
+func (q *PriorityQueue) Close() error {
+	q.exitOnce.Do(func() {
+		close(q.exitChan)
+	})
+	q.readOnce.Do(func() {
+		close(q.doneChan)
+	})
+	<-q.doneChan
+
+	var err error
+	for _, lane := range q.lanes {
+		innerErr := lane.Close()
+		if innerErr != nil {
+			err = innerErr
+		}
+	}
+	return err
+}
+
+// pick returns the lane to read next, or -1 if every lane is empty
+func (q *PriorityQueue) pick() int {
+	depths := make([]int64, len(q.lanes))
+	for p, lane := range q.lanes {
+		depths[p] = lane.Depth()
+	}
+	for round := 0; round < 2; round++ {
+		for p := len(q.lanes) - 1; p >= 0; p-- {
+			if depths[p] > 0 && q.credits[p] > 0 {
+				return p
+			}
+		}
+		// every lane with messages has used its weight
+		copy(q.credits, q.weights)
+	}
+	return -1
+}
+
+// readLoop gets a message from the picked lane, or from the first lane
+// receiving one if they are all empty, and acks it once it has been
+// received from ReadChan
+func (q *PriorityQueue) readLoop() {
+	defer close(q.doneChan)
+
+	cases := make([]reflect.SelectCase, 0, len(q.lanes)+1)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.exitChan)})
+	for _, lane := range q.lanes {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(lane.getChan)})
+	}
+
+	for {
+		var p int
+		var m delivery
+		if p = q.pick(); p >= 0 {
+			select {
+			case m = <-q.lanes[p].getChan:
+			case <-q.exitChan:
+				return
+			}
+		} else {
+			chosen, v, _ := reflect.Select(cases)
+			if chosen == 0 {
+				return
+			}
+			p = chosen - 1
+			m = v.Interface().(delivery)
+		}
+		q.credits[p] = max(q.credits[p]-1, 0)
+
+		select {
+		case q.readChan <- m.data:
+			q.lanes[p].sendAck(ackRequest{id: m.id, attempt: m.attempt, ack: true})
+		case <-q.exitChan:
+			q.lanes[p].sendAck(ackRequest{id: m.id, attempt: m.attempt, ack: false})
+			return
+		}
+	}
+}
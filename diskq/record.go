@@ -0,0 +1,152 @@
+package diskq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// record format
+//
+// v1:     magic(1) | version(1) | size(4) | crc32c(version, size, body)(4) | body
+// legacy: size(4) | body
+//
+// the first byte of a legacy record is the high byte of a positive int32 and
+// never equals recordMagic, so files written before v1 remain readable and
+// old and new records may be mixed in the same file
+const (
+	recordMagic      byte = 0xD7
+	recordVersion    byte = 1
+	recordHeaderSize      = 10
+	legacyHeaderSize      = 4
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+// encodeRecord appends the v1 encoding of data to buf
+func encodeRecord(buf []byte, data []byte) []byte {
+	var header [recordHeaderSize]byte
+	header[0] = recordMagic
+	header[1] = recordVersion
+	binary.BigEndian.PutUint32(header[2:6], uint32(len(data)))
+	crc := crc32.Update(0, crcTable, header[1:6])
+	crc = crc32.Update(crc, crcTable, data)
+	binary.BigEndian.PutUint32(header[6:10], crc)
+	buf = append(buf, header[:]...)
+	return append(buf, data...)
+}
+
+// decodeRecord reads a single record, returning its body and its total size
+// on disk, a truncated record returns io.EOF or io.ErrUnexpectedEOF and an
+// invalid one errCorruptRecord
+func decodeRecord(r *bufio.Reader, minMsgSize int32, maxMsgSize int32) ([]byte, int64, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	if first[0] != recordMagic {
+		return decodeLegacyRecord(r, minMsgSize, maxMsgSize)
+	}
+
+	var header [recordHeaderSize]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	if header[1] != recordVersion {
+		return nil, 0, fmt.Errorf("%w: unknown version %d", errCorruptRecord, header[1])
+	}
+	msgSize := int32(binary.BigEndian.Uint32(header[2:6]))
+	if msgSize < minMsgSize || msgSize > maxMsgSize {
+		return nil, 0, fmt.Errorf("%w: invalid message read size (%d)", errCorruptRecord, msgSize)
+	}
+	data := make([]byte, msgSize)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	crc := crc32.Update(0, crcTable, header[1:6])
+	crc = crc32.Update(crc, crcTable, data)
+	if crc != binary.BigEndian.Uint32(header[6:10]) {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch", errCorruptRecord)
+	}
+	return data, int64(recordHeaderSize) + int64(msgSize), nil
+}
+
+func decodeLegacyRecord(r *bufio.Reader, minMsgSize int32, maxMsgSize int32) ([]byte, int64, error) {
+	var msgSize int32
+	err := binary.Read(r, binary.BigEndian, &msgSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if msgSize < minMsgSize || msgSize > maxMsgSize {
+		// this file is corrupt and we have no reasonable guarantee on
+		// where a new message should begin
+		return nil, 0, fmt.Errorf("%w: invalid message read size (%d)", errCorruptRecord, msgSize)
+	}
+	data := make([]byte, msgSize)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, int64(legacyHeaderSize) + int64(msgSize), nil
+}
+
+// validRecordAt reports whether a complete v1 record ends before limit at pos
+func validRecordAt(f io.ReaderAt, pos int64, limit int64, minMsgSize int32, maxMsgSize int32) bool {
+	if limit-pos < recordHeaderSize {
+		return false
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, pos, limit-pos))
+	_, _, err := decodeRecord(r, minMsgSize, maxMsgSize)
+	return err == nil
+}
+
+// resync returns the position of the first valid v1 record in [from, limit),
+// or limit if there is none
+func resync(f io.ReaderAt, from int64, limit int64, minMsgSize int32, maxMsgSize int32) int64 {
+	buf := make([]byte, 64*1024)
+	for pos := from; pos < limit; {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), limit-pos)], pos)
+		for i := 0; i < n; i++ {
+			if buf[i] == recordMagic && validRecordAt(f, pos+int64(i), limit, minMsgSize, maxMsgSize) {
+				return pos + int64(i)
+			}
+		}
+		if err != nil || n == 0 {
+			break
+		}
+		pos += int64(n)
+	}
+	return limit
+}
+
+// badFileName is the sidecar holding the quarantined bytes of a data file
+func (d *DiskQueue) badFileName(fileNum int64) string {
+	return d.fileName(fileNum) + ".bad"
+}
+
+// quarantine appends the bytes in [start, end) of a data file to its sidecar
+func quarantine(f io.ReaderAt, badFileName string, start int64, end int64) error {
+	if end <= start {
+		return nil
+	}
+	bad, err := os.OpenFile(badFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(bad, io.NewSectionReader(f, start, end-start))
+	if err != nil {
+		bad.Close()
+		return err
+	}
+	return bad.Close()
+}
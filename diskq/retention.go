@@ -0,0 +1,216 @@
+package diskq
+
+import (
+	"bufio"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DropReasonMaxBytes = "max_bytes"
+	DropReasonMaxAge   = "max_age"
+)
+
+// RetentionPolicy drops the oldest closed data files, unread messages
+// included, once the queue exceeds one of its limits, a zero limit is
+// disabled, the file being written is never dropped
+type RetentionPolicy struct {
+	// MaxBytes bounds the size on disk of the data files
+	MaxBytes int64
+	// MaxAge bounds the time since a data file was last written
+	MaxAge time.Duration
+	// OnDrop is called by the queue goroutine after a data file is dropped,
+	// it must not call back into the queue
+	OnDrop func(DroppedFile)
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.MaxBytes > 0 || p.MaxAge > 0
+}
+
+// DroppedFile describes a data file dropped by the retention policy
+type DroppedFile struct {
+	FileNum int64
+	// Bytes is the size of the file on disk
+	Bytes int64
+	// Messages is the number of messages in the file
+	Messages int64
+	// Unread is the number of messages the default reader had not consumed
+	Unread int64
+	Reason string
+}
+
+// Stats is a snapshot of the size of a queue
+type Stats struct {
+	// DiskBytes is the size on disk of the data files and their .bad sidecars
+	DiskBytes int64
+	// Files is the number of data files
+	Files int64
+	// DroppedFiles and DroppedMessages count what the retention policy dropped
+	// since the queue was opened
+	DroppedFiles    int64
+	DroppedMessages int64
+}
+
+// Stats returns the size of the queue on disk
+func (d *DiskQueue) Stats() Stats {
+	d.cursors.Lock()
+	from, to := d.cursors.gcFileNum, d.cursors.writeFileNum
+	d.cursors.Unlock()
+
+	stats := Stats{
+		DroppedFiles:    atomic.LoadInt64(&d.droppedFiles),
+		DroppedMessages: atomic.LoadInt64(&d.droppedMessages),
+	}
+	for i := from; i <= to; i++ {
+		if stat, err := d.statSegment(i); err == nil {
+			stats.DiskBytes += stat.Size()
+			stats.Files++
+		}
+		if stat, err := os.Stat(d.badFileName(i)); err == nil {
+			stats.DiskBytes += stat.Size()
+		}
+	}
+	return stats
+}
+
+// statSegment returns the file info of a data file as stored on disk
+func (d *DiskQueue) statSegment(fileNum int64) (os.FileInfo, error) {
+	stat, err := os.Stat(d.fileName(fileNum))
+	if !os.IsNotExist(err) {
+		return stat, err
+	}
+	for _, c := range compressionExts {
+		stat, cerr := os.Stat(d.compressedFileName(fileNum, c.compression))
+		if cerr == nil {
+			return stat, nil
+		}
+	}
+	return nil, err
+}
+
+// applyRetention drops the oldest closed data files while a limit is exceeded
+func (d *DiskQueue) applyRetention() {
+	if !d.retention.enabled() {
+		return
+	}
+
+	for {
+		d.cursors.Lock()
+		oldest := d.cursors.gcFileNum
+		d.cursors.Unlock()
+		if oldest >= d.writeFileNum {
+			return
+		}
+
+		stat, err := d.statSegment(oldest)
+		if os.IsNotExist(err) {
+			// skipped as a bad file, nothing left to drop
+			d.dropFile(oldest)
+			continue
+		}
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to stat %s - %s", d.name, d.fileName(oldest), err)
+			return
+		}
+
+		var reason string
+		if d.retention.MaxBytes > 0 && d.Stats().DiskBytes > d.retention.MaxBytes {
+			reason = DropReasonMaxBytes
+		} else if d.retention.MaxAge > 0 && time.Since(stat.ModTime()) > d.retention.MaxAge {
+			reason = DropReasonMaxAge
+		} else {
+			return
+		}
+
+		dropped := DroppedFile{
+			FileNum:  oldest,
+			Bytes:    stat.Size(),
+			Messages: d.countMessages(oldest, 0),
+			Reason:   reason,
+		}
+		d.logf(WARN, "DISKQUEUE(%s) retention dropping %s (%d bytes, %d messages), reason %s",
+			d.name, d.fileName(oldest), dropped.Bytes, dropped.Messages, reason)
+		dropped.Unread = d.dropFile(oldest)
+		atomic.AddInt64(&d.droppedFiles, 1)
+		atomic.AddInt64(&d.droppedMessages, dropped.Messages)
+		if d.retention.OnDrop != nil {
+			d.retention.OnDrop(dropped)
+		}
+	}
+}
+
+// dropFile moves every reader still before the end of a data file to the
+// next file and removes it, messages in flight are forgotten, it returns the
+// number of messages the default reader had not consumed
+func (d *DiskQueue) dropFile(fileNum int64) int64 {
+	var unread int64
+	if d.commitFileNum <= fileNum {
+		if d.commitFileNum == fileNum {
+			unread = d.countMessages(fileNum, d.commitPos)
+		}
+		d.depth -= unread
+
+		if d.readFile != nil {
+			d.readFile.Close()
+			d.readFile = nil
+		}
+		d.resetInFlight()
+		d.commitFileNum = fileNum + 1
+		d.commitPos = 0
+		d.readFileNum = fileNum + 1
+		d.readPos = 0
+		d.nextReadFileNum = fileNum + 1
+		d.nextReadPos = 0
+		d.needSync = true
+	}
+
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	for _, c := range d.cursors.cursors {
+		if c.readFileNum > fileNum {
+			continue
+		}
+		if c.readFileNum == fileNum {
+			c.depth -= d.countMessages(fileNum, c.readPos)
+		}
+		c.readFileNum = fileNum + 1
+		c.readPos = 0
+		c.dirty = true
+		c.reset = true
+	}
+	d.cursors.commitFileNum = d.commitFileNum
+	if d.cursors.gcFileNum == fileNum {
+		// retained segments are only removed here
+		err := d.removeSegment(fileNum)
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, d.fileName(fileNum), err)
+		}
+		d.cursors.gcFileNum++
+	}
+	d.gcLocked()
+	close(d.cursors.written)
+	d.cursors.written = make(chan struct{})
+	return unread
+}
+
+// countMessages counts the valid records of a data file after pos
+func (d *DiskQueue) countMessages(fileNum int64, pos int64) int64 {
+	r, _, err := d.openSegment(fileNum, pos)
+	if err != nil {
+		return 0
+	}
+	defer r.Close()
+
+	var count int64
+	reader := bufio.NewReader(r)
+	for {
+		_, _, err = decodeRecord(reader, d.minMsgSize, d.maxMsgSize)
+		if err != nil {
+			return count
+		}
+		count++
+	}
+}
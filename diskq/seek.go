@@ -0,0 +1,209 @@
+package diskq
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrInvalidOffset = errors.New("invalid offset")
+
+// Offset is the position of a message in the queue
+type Offset struct {
+	FileNum int64
+	Pos     int64
+}
+
+func (o Offset) String() string {
+	return fmt.Sprintf("%d:%d", o.FileNum, o.Pos)
+}
+
+// Message is a message read together with its offset
+type Message struct {
+	Offset Offset
+	Data   []byte
+}
+
+type seekRequest struct {
+	offset   Offset
+	time     time.Time
+	byTime   bool
+	response chan error
+}
+
+// MessageChan returns the messages with their offsets, it consumes the queue
+// like ReadChan, it is expected to be an *unbuffered* channel
+func (d *DiskQueue) MessageChan() <-chan Message {
+	return d.msgChan
+}
+
+// SeekTo moves the default reader to offset, which must be the offset of a
+// message not removed yet or the end of the queue, the messages in flight are
+// forgotten and the depth becomes the number of messages after offset
+//
+// the data files before the committed position are only kept with
+// WithRetainSegments, otherwise only the current file can be replayed
+func (d *DiskQueue) SeekTo(offset Offset) error {
+	return d.sendSeek(seekRequest{offset: offset})
+}
+
+// SeekToTime moves the default reader like SeekTo to the first message
+// written at or after t, up to index interval messages earlier, or to the
+// end of the queue if there is none
+func (d *DiskQueue) SeekToTime(t time.Time) error {
+	return d.sendSeek(seekRequest{time: t, byTime: true})
+}
+
+func (d *DiskQueue) sendSeek(req seekRequest) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	req.response = make(chan error, 1)
+	d.seekChan <- req
+	return <-req.response
+}
+
+// seek is called by ioLoop
+func (d *DiskQueue) seek(req seekRequest) error {
+	d.cursors.Lock()
+	gcFileNum := d.cursors.gcFileNum
+	d.cursors.Unlock()
+
+	end := Offset{FileNum: d.writeFileNum, Pos: d.writePos}
+	offset := req.offset
+	if req.byTime {
+		offset = d.offsetAtTime(req.time, gcFileNum, end)
+	}
+	offset, err := d.checkOffset(offset, gcFileNum, end)
+	if err != nil {
+		return err
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s): seeking to %s", d.name, offset)
+
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.resetInFlight()
+	d.readFileNum = offset.FileNum
+	d.readPos = offset.Pos
+	d.nextReadFileNum = offset.FileNum
+	d.nextReadPos = offset.Pos
+	d.commitFileNum = offset.FileNum
+	d.commitPos = offset.Pos
+	d.depth = d.countBetween(offset, end)
+	d.needSync = true
+	d.moveCursorsCommit(offset.FileNum)
+	return nil
+}
+
+// checkOffset validates an offset between the oldest data file and end, the
+// end of a complete file is normalized to the start of the next one
+func (d *DiskQueue) checkOffset(offset Offset, gcFileNum int64, end Offset) (Offset, error) {
+	invalid := fmt.Errorf("%w: %s", ErrInvalidOffset, offset)
+	if offset.FileNum < gcFileNum || offset.FileNum > end.FileNum || offset.Pos < 0 {
+		return offset, invalid
+	}
+	if offset.FileNum == end.FileNum {
+		if offset.Pos == end.Pos {
+			return offset, nil
+		}
+		if offset.Pos > end.Pos {
+			return offset, invalid
+		}
+	} else {
+		size, err := d.segmentSize(offset.FileNum)
+		if err != nil || offset.Pos > size {
+			return offset, invalid
+		}
+		if offset.Pos == size {
+			return Offset{FileNum: offset.FileNum + 1}, nil
+		}
+	}
+
+	r, _, err := d.openSegment(offset.FileNum, offset.Pos)
+	if err != nil {
+		return offset, invalid
+	}
+	defer r.Close()
+	_, _, err = decodeRecord(bufio.NewReader(r), d.minMsgSize, d.maxMsgSize)
+	if err != nil {
+		return offset, invalid
+	}
+	return offset, nil
+}
+
+// firstFileNum returns the lowest data file on disk, or the write file
+func (d *DiskQueue) firstFileNum() int64 {
+	first := d.writeFileNum
+	pattern := path.Join(d.dataDIR, fmt.Sprintf("%s.diskqueue.[0-9]*.dat*", d.name))
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		d.logf(WARN, "DISKQUEUE(%s) failed to glob data files - %s", d.name, err)
+		return first
+	}
+	for _, fn := range matches {
+		var fileNum int64
+		_, err = fmt.Sscanf(strings.TrimPrefix(filepath.Base(fn), d.name+".diskqueue."), "%d.dat", &fileNum)
+		if err == nil {
+			first = min(first, fileNum)
+		}
+	}
+	return first
+}
+
+func (c *cursor) MessageChan() <-chan Message {
+	return c.msgChan
+}
+
+// SeekTo moves the cursor like DiskQueue.SeekTo
+func (c *cursor) SeekTo(offset Offset) error {
+	return c.seek(seekRequest{offset: offset})
+}
+
+// SeekToTime moves the cursor like DiskQueue.SeekToTime
+func (c *cursor) SeekToTime(t time.Time) error {
+	return c.seek(seekRequest{time: t, byTime: true})
+}
+
+func (c *cursor) seek(req seekRequest) error {
+	d := c.d
+	select {
+	case <-c.doneChan:
+		return ErrExiting
+	default:
+	}
+
+	d.cursors.Lock()
+	defer d.cursors.Unlock()
+
+	end := Offset{FileNum: d.cursors.writeFileNum, Pos: d.cursors.writePos}
+	offset := req.offset
+	if req.byTime {
+		offset = d.offsetAtTime(req.time, d.cursors.gcFileNum, end)
+	}
+	offset, err := d.checkOffset(offset, d.cursors.gcFileNum, end)
+	if err != nil {
+		return err
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s): cursor %s seeking to %s", d.name, c.name, offset)
+
+	c.readFileNum = offset.FileNum
+	c.readPos = offset.Pos
+	c.depth = d.countBetween(offset, end)
+	c.dirty = true
+	c.reset = true
+	close(d.cursors.written)
+	d.cursors.written = make(chan struct{})
+	return nil
+}
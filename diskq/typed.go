@@ -0,0 +1,217 @@
+package diskq
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrDecode = fmt.Errorf("decode")
+
+// Codec converts the messages of a Typed queue to and from bytes
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// ProtobufCodec T is a pointer to a generated message, e.g. *pb.Order
+type ProtobufCodec[T proto.Message] struct{}
+
+func (ProtobufCodec[T]) Marshal(v T) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+func (ProtobufCodec[T]) Unmarshal(data []byte) (T, error) {
+	var zero T
+	v := reflect.New(reflect.TypeOf(zero).Elem()).Interface().(T)
+	err := proto.Unmarshal(data, v)
+	return v, err
+}
+
+type typedOptions struct {
+	onDecodeError func(data []byte, err error)
+}
+
+type TypedOption interface {
+	apply(*typedOptions)
+}
+
+type typedOptionFunc func(*typedOptions)
+
+func (f typedOptionFunc) apply(opt *typedOptions) {
+	f(opt)
+}
+
+// WithDecodeErrorHandler is called with the messages read from ReadChan
+// which cannot be decoded, they are dropped
+func WithDecodeErrorHandler(onDecodeError func(data []byte, err error)) TypedOption {
+	return typedOptionFunc(func(opt *typedOptions) {
+		opt.onDecodeError = onDecodeError
+	})
+}
+
+// Typed wraps a queue to put and read values of type T encoded by a Codec
+//
+// ReadChan and Get both consume the underlying queue, a consumer should use
+// one of them
+type Typed[T any] struct {
+	queue   Interface
+	codec   Codec[T]
+	options *typedOptions
+
+	readOnce sync.Once
+	readChan chan T
+	exitChan chan struct{}
+	doneChan chan struct{}
+	// readCtx is cancelled by Close to stop readLoop waiting for a message
+	readCtx    context.Context
+	readCancel context.CancelFunc
+}
+
+func NewTyped[T any](queue Interface, codec Codec[T], opts ...TypedOption) *Typed[T] {
+	_options := &typedOptions{
+		onDecodeError: func(data []byte, err error) {},
+	}
+	for _, o := range opts {
+		o.apply(_options)
+	}
+	readCtx, readCancel := context.WithCancel(context.Background())
+	return &Typed[T]{
+		queue:      queue,
+		codec:      codec,
+		options:    _options,
+		readChan:   make(chan T),
+		exitChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
+		readCtx:    readCtx,
+		readCancel: readCancel,
+	}
+}
+
+// Queue returns the underlying queue
+func (x *Typed[T]) Queue() Interface {
+	return x.queue
+}
+
+func (x *Typed[T]) Put(v T) error {
+	data, err := x.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return x.queue.Put(data)
+}
+
+func (x *Typed[T]) PutBatch(vs []T) error {
+	batch := make([][]byte, 0, len(vs))
+	for _, v := range vs {
+		data, err := x.codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, data)
+	}
+	return x.queue.PutBatch(batch)
+}
+
+// ReadChan returns the decoded messages, it is expected to be an *unbuffered* channel
+func (x *Typed[T]) ReadChan() <-chan T {
+	x.readOnce.Do(func() {
+		go x.readLoop()
+	})
+	return x.readChan
+}
+
+// Get blocks until a message is available or ctx is done, a message which
+// cannot be decoded is consumed and returned as an ErrDecode error
+func (x *Typed[T]) Get(ctx context.Context) (T, error) {
+	var zero T
+	select {
+	case data := <-x.queue.ReadChan():
+		return x.decode(data)
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case <-x.exitChan:
+		return zero, ErrExiting
+	}
+}
+
+func (x *Typed[T]) Depth() int64 {
+	return x.queue.Depth()
+}
+
+// Close stops ReadChan and closes the underlying queue, it waits for readLoop
+// to exit first so the ack of a value already received is not lost
+func (x *Typed[T]) Close() error {
+	close(x.exitChan)
+	x.readCancel()
+	x.readOnce.Do(func() {
+		close(x.doneChan)
+	})
+	<-x.doneChan
+	return x.queue.Close()
+}
+
+func (x *Typed[T]) decode(data []byte) (T, error) {
+	v, err := x.codec.Unmarshal(data)
+	if err != nil {
+		return v, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	return v, nil
+}
+
+// readLoop acks a message once it has been received from ReadChan, the
+// message decoded ahead is redelivered after a restart
+func (x *Typed[T]) readLoop() {
+	defer close(x.doneChan)
+	for {
+		data, ack, nack, err := x.queue.GetCtx(x.readCtx)
+		if err != nil {
+			return
+		}
+		v, err := x.decode(data)
+		if err != nil {
+			x.options.onDecodeError(data, err)
+			ack()
+			continue
+		}
+		select {
+		case x.readChan <- v:
+			ack()
+		case <-x.exitChan:
+			nack()
+			return
+		}
+	}
+}
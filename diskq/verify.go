@@ -0,0 +1,319 @@
+package diskq
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Range is a byte range [Start, End) of a data file
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// FileReport is the result of scanning a single data file
+type FileReport struct {
+	FileNum int64
+	Size    int64
+	// Missing means the file is referenced by the metadata but does not exist
+	Missing bool
+	// Compressed files are scanned up to their first corrupt record
+	Compressed bool
+	// Records is the number of valid records after the committed position
+	Records int64
+	// Corrupt holds the byte ranges that are not valid records
+	Corrupt []Range
+
+	valid []Range
+	start int64
+}
+
+// Report is the result of Verify and Repair
+type Report struct {
+	Files []*FileReport
+	// Depth is the number of valid messages after the committed position
+	Depth int64
+}
+
+// Corrupt reports whether any corrupt or missing data was found
+func (r *Report) Corrupt() bool {
+	for _, f := range r.Files {
+		if f.Missing || len(f.Corrupt) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify scans the data files of a closed queue from the committed position
+// and reports the corrupt byte ranges, it never modifies any file
+func Verify(opts ...Option) (*Report, error) {
+	d, err := openOffline(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return d.verify()
+}
+
+// Repair scans the data files of a closed queue like Verify, moves the corrupt
+// bytes to the .bad sidecar of each file, rewrites the files with the valid
+// records only and fixes the depth and write position in the metadata,
+// it must not be called while the queue is open
+func Repair(opts ...Option) (*Report, error) {
+	d, err := openOffline(opts...)
+	if err != nil {
+		return nil, err
+	}
+	report, err := d.verify()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, file := range report.Files {
+		if len(file.Corrupt) == 0 {
+			continue
+		}
+		if file.Compressed {
+			// resync needs random access, repair the decompressed file
+			err = d.decompressSegment(file.FileNum)
+			if err != nil {
+				return nil, err
+			}
+			report.Depth -= file.Records
+			file, err = d.scanFile(file.FileNum, file.start)
+			if err != nil {
+				return nil, err
+			}
+			report.Files[i] = file
+			report.Depth += file.Records
+		}
+		err = d.repairFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// records written after the last metadata sync are recovered as well
+	last := report.Files[len(report.Files)-1]
+	d.writePos = last.Size
+	for _, r := range last.Corrupt {
+		d.writePos -= r.End - r.Start
+	}
+	d.depth = report.Depth
+	d.readFileNum = d.commitFileNum
+	d.readPos = d.commitPos
+	err = d.persistMetaData()
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// openOffline loads the metadata of a queue without starting it
+func openOffline(opts ...Option) (*DiskQueue, error) {
+	_options := defaultOptions()
+	for _, o := range opts {
+		o.apply(_options)
+	}
+	d := &DiskQueue{
+		name:       _options.name,
+		dataDIR:    _options.dataDIR,
+		minMsgSize: _options.minMsgSize,
+		maxMsgSize: _options.maxMsgSize,
+		logf:       _options.logf,
+	}
+
+	f, err := os.Open(d.metaDataFileName())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+		&d.depth,
+		&d.commitFileNum, &d.commitPos,
+		&d.writeFileNum, &d.writePos)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DiskQueue) verify() (*Report, error) {
+	report := &Report{}
+	for i := d.commitFileNum; i <= d.writeFileNum; i++ {
+		var start int64
+		if i == d.commitFileNum {
+			start = d.commitPos
+		}
+		file, err := d.scanFile(i, start)
+		if err != nil {
+			return nil, err
+		}
+		report.Files = append(report.Files, file)
+		report.Depth += file.Records
+	}
+	return report, nil
+}
+
+// scanFile scans a data file from start, resyncing at the next valid record
+// after each corrupt one
+func (d *DiskQueue) scanFile(fileNum int64, start int64) (*FileReport, error) {
+	report := &FileReport{FileNum: fileNum, start: start}
+	f, err := os.Open(d.fileName(fileNum))
+	if os.IsNotExist(err) {
+		return d.scanCompressedFile(report)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	report.Size = stat.Size()
+
+	pos := start
+	r := bufio.NewReader(io.NewSectionReader(f, pos, report.Size-pos))
+	for pos < report.Size {
+		_, n, err := decodeRecord(r, d.minMsgSize, d.maxMsgSize)
+		if err == nil {
+			report.Records++
+			report.valid = append(report.valid, Range{Start: pos, End: pos + n})
+			pos += n
+			continue
+		}
+		next := resync(f, pos+1, report.Size, d.minMsgSize, d.maxMsgSize)
+		report.Corrupt = append(report.Corrupt, Range{Start: pos, End: next})
+		pos = next
+		r.Reset(io.NewSectionReader(f, pos, report.Size-pos))
+	}
+	return report, nil
+}
+
+func (d *DiskQueue) scanCompressedFile(report *FileReport) (*FileReport, error) {
+	r, size, err := d.openSegment(report.FileNum, report.start)
+	if os.IsNotExist(err) {
+		report.Missing = true
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	report.Size = size
+	report.Compressed = true
+
+	pos := report.start
+	reader := bufio.NewReader(r)
+	for pos < report.Size {
+		_, n, err := decodeRecord(reader, d.minMsgSize, d.maxMsgSize)
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, Range{Start: pos, End: report.Size})
+			break
+		}
+		report.Records++
+		report.valid = append(report.valid, Range{Start: pos, End: pos + n})
+		pos += n
+	}
+	return report, nil
+}
+
+// decompressSegment replaces a compressed data file by the bytes which can
+// still be decompressed
+func (d *DiskQueue) decompressSegment(fileNum int64) error {
+	r, _, err := d.openSegment(fileNum, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fn := d.fileName(fileNum)
+	tmpFileName := fn + ".repair.tmp"
+	tmp, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		d.logf(WARN, "DISKQUEUE(%s) repair: failed to decompress %s - %s", d.name, fn, err)
+	}
+	err = tmp.Sync()
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	err = os.Rename(tmpFileName, fn)
+	if err != nil {
+		return err
+	}
+	for _, c := range compressionExts {
+		err = os.Remove(d.compressedFileName(fileNum, c.compression))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairFile quarantines the corrupt ranges of a data file and atomically
+// replaces it with the bytes before the scan start and the valid records
+func (d *DiskQueue) repairFile(report *FileReport) error {
+	fn := d.fileName(report.FileNum)
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, r := range report.Corrupt {
+		d.logf(WARN, "DISKQUEUE(%s) repair: moving %d corrupt bytes at %d of %s to %s",
+			d.name, r.End-r.Start, r.Start, fn, d.badFileName(report.FileNum))
+		err = quarantine(f, d.badFileName(report.FileNum), r.Start, r.End)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmpFileName := fn + ".repair.tmp"
+	tmp, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	ranges := append([]Range{{Start: 0, End: report.start}}, report.valid...)
+	for _, r := range ranges {
+		_, err = io.Copy(tmp, io.NewSectionReader(f, r.Start, r.End-r.Start))
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpFileName)
+			return err
+		}
+	}
+	err = tmp.Sync()
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	err = os.Rename(tmpFileName, fn)
+	if err != nil {
+		return err
+	}
+	// the positions of the records have moved, they are counted by scanning
+	err = os.Remove(d.indexFileName(report.FileNum))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package lru
+
+import (
+	"container/heap"
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	v2 "github.com/ccheers/xpkg/lru/v2"
+)
+
+var _ ILRUCache = (*Cache[string, interface{}])(nil)
+
+type cacheOptions[K comparable, V any] struct {
+	shards          int
+	hasher          func(K) uint64
+	onEvict         v2.EvictCallback[K, V]
+	cleanupInterval time.Duration
+}
+
+type CacheOption[K comparable, V any] interface {
+	apply(*cacheOptions[K, V])
+}
+
+type cacheOptionFunc[K comparable, V any] func(*cacheOptions[K, V])
+
+func (f cacheOptionFunc[K, V]) apply(opt *cacheOptions[K, V]) {
+	f(opt)
+}
+
+// WithShards sets the number of shards, rounded up to a power of 2, each
+// shard holds size/shards entries, it defaults to 4*GOMAXPROCS
+func WithShards[K comparable, V any](shards int) CacheOption[K, V] {
+	return cacheOptionFunc[K, V](func(opt *cacheOptions[K, V]) {
+		opt.shards = shards
+	})
+}
+
+// WithHasher sets the hash spreading the keys over the shards, defaults to
+// v2.NewHasher
+func WithHasher[K comparable, V any](hasher func(K) uint64) CacheOption[K, V] {
+	return cacheOptionFunc[K, V](func(opt *cacheOptions[K, V]) {
+		opt.hasher = hasher
+	})
+}
+
+// WithOnEvict is called, with the shard locked, for every entry leaving the
+// cache, evicted, expired or removed
+func WithOnEvict[K comparable, V any](onEvict v2.EvictCallback[K, V]) CacheOption[K, V] {
+	return cacheOptionFunc[K, V](func(opt *cacheOptions[K, V]) {
+		opt.onEvict = onEvict
+	})
+}
+
+// WithCleanupInterval starts a goroutine removing the expired entries at
+// this interval, they are otherwise removed by Set and on read, Close stops it
+func WithCleanupInterval[K comparable, V any](interval time.Duration) CacheOption[K, V] {
+	return cacheOptionFunc[K, V](func(opt *cacheOptions[K, V]) {
+		opt.cleanupInterval = interval
+	})
+}
+
+// Cache is a thread-safe LRU cache with a TTL per entry, the keys are spread
+// over shards each with its own lock, LRU and expiry heap
+//
+// an expired entry is never returned, it is removed on read, by the Set
+// calls on its shard and by the cleanup goroutine
+type Cache[K comparable, V any] struct {
+	shards   []*cacheShard[K, V]
+	mask     uint64
+	hasher   func(K) uint64
+	exitChan chan struct{}
+	doneChan chan struct{}
+	exitOnce sync.Once
+}
+
+type cacheShard[K comparable, V any] struct {
+	mu      sync.Mutex
+	lru     *v2.LRU[K, *cacheItem[K, V]]
+	expiry  expiryHeap[K, V]
+	onEvict v2.EvictCallback[K, V]
+}
+
+type cacheItem[K comparable, V any] struct {
+	key      K
+	value    V
+	expireAt time.Time // zero never expires
+	index    int       // index in the expiry heap, -1 if not in it
+}
+
+// NewCache creates a cache of the given total size
+func NewCache[K comparable, V any](size int, opts ...CacheOption[K, V]) (*Cache[K, V], error) {
+	if size <= 0 {
+		return nil, v2.ErrMustProvidePositiveSize
+	}
+	_options := &cacheOptions[K, V]{
+		shards: 4 * runtime.GOMAXPROCS(0),
+		hasher: v2.NewHasher[K](),
+	}
+	for _, o := range opts {
+		o.apply(_options)
+	}
+
+	shards := 1
+	for shards < min(_options.shards, size) {
+		shards <<= 1
+	}
+	shardSize := (size + shards - 1) / shards
+
+	c := &Cache[K, V]{
+		shards:   make([]*cacheShard[K, V], shards),
+		mask:     uint64(shards - 1),
+		hasher:   _options.hasher,
+		exitChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+	for i := range c.shards {
+		s := &cacheShard[K, V]{onEvict: _options.onEvict}
+		lru, err := v2.NewLRU[K, *cacheItem[K, V]](shardSize, s.evicted)
+		if err != nil {
+			return nil, err
+		}
+		s.lru = lru
+		c.shards[i] = s
+	}
+
+	if _options.cleanupInterval > 0 {
+		go c.cleanupLoop(_options.cleanupInterval)
+	} else {
+		close(c.doneChan)
+	}
+	return c, nil
+}
+
+func (c *Cache[K, V]) shard(key K) *cacheShard[K, V] {
+	return c.shards[c.hasher(key)&c.mask]
+}
+
+// Set adds or replaces an entry expiring at expireAt, a zero expireAt never
+// expires
+func (c *Cache[K, V]) Set(ctx context.Context, key K, value V, expireAt time.Time) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeExpired(time.Now())
+	if it, ok := s.lru.Peek(key); ok {
+		it.value = value
+		s.setExpireAt(it, expireAt)
+		s.lru.Get(key)
+		return
+	}
+	it := &cacheItem[K, V]{key: key, value: value, index: -1}
+	s.setExpireAt(it, expireAt)
+	s.lru.Add(key, it)
+}
+
+// SetWithTTL adds or replaces an entry expiring after ttl, a ttl <= 0 never
+// expires
+func (c *Cache[K, V]) SetWithTTL(ctx context.Context, key K, value V, ttl time.Duration) {
+	var expireAt time.Time
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl)
+	}
+	c.Set(ctx, key, value, expireAt)
+}
+
+// Get returns the value of an entry which has not expired
+func (c *Cache[K, V]) Get(ctx context.Context, key K) (V, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var zero V
+	it, ok := s.lru.Get(key)
+	if !ok {
+		return zero, false
+	}
+	if it.expired(time.Now()) {
+		s.lru.Remove(key)
+		return zero, false
+	}
+	return it.value, true
+}
+
+// GetWithExpireAt is Get also returning the expiration of the entry
+func (c *Cache[K, V]) GetWithExpireAt(ctx context.Context, key K) (V, time.Time, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var zero V
+	it, ok := s.lru.Get(key)
+	if !ok {
+		return zero, time.Time{}, false
+	}
+	if it.expired(time.Now()) {
+		s.lru.Remove(key)
+		return zero, time.Time{}, false
+	}
+	return it.value, it.expireAt, true
+}
+
+func (c *Cache[K, V]) Del(ctx context.Context, key K) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lru.Remove(key)
+}
+
+// Len returns the number of entries which have not expired
+func (c *Cache[K, V]) Len() int {
+	now := time.Now()
+	var n int
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.removeExpired(now)
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Purge removes every entry
+func (c *Cache[K, V]) Purge() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.lru.Purge()
+		s.mu.Unlock()
+	}
+}
+
+// Close stops the cleanup goroutine, the cache remains usable
+func (c *Cache[K, V]) Close() {
+	c.exitOnce.Do(func() {
+		close(c.exitChan)
+	})
+	<-c.doneChan
+}
+
+func (c *Cache[K, V]) cleanupLoop(interval time.Duration) {
+	defer close(c.doneChan)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, s := range c.shards {
+				s.mu.Lock()
+				s.removeExpired(now)
+				s.mu.Unlock()
+			}
+		case <-c.exitChan:
+			return
+		}
+	}
+}
+
+// evicted is the eviction callback of the LRU of the shard
+func (s *cacheShard[K, V]) evicted(key K, it *cacheItem[K, V]) {
+	if it.index >= 0 {
+		heap.Remove(&s.expiry, it.index)
+	}
+	if s.onEvict != nil {
+		s.onEvict(key, it.value)
+	}
+}
+
+func (s *cacheShard[K, V]) setExpireAt(it *cacheItem[K, V], expireAt time.Time) {
+	it.expireAt = expireAt
+	switch {
+	case it.index >= 0 && expireAt.IsZero():
+		heap.Remove(&s.expiry, it.index)
+	case it.index >= 0:
+		heap.Fix(&s.expiry, it.index)
+	case !expireAt.IsZero():
+		heap.Push(&s.expiry, it)
+	}
+}
+
+// removeExpired pops the entries expired at now from the expiry heap
+func (s *cacheShard[K, V]) removeExpired(now time.Time) {
+	for len(s.expiry) > 0 && s.expiry[0].expired(now) {
+		s.lru.Remove(s.expiry[0].key)
+	}
+}
+
+func (it *cacheItem[K, V]) expired(now time.Time) bool {
+	return !it.expireAt.IsZero() && !now.Before(it.expireAt)
+}
+
+// expiryHeap orders the entries with a TTL by expiration
+type expiryHeap[K comparable, V any] []*cacheItem[K, V]
+
+func (h expiryHeap[K, V]) Len() int { return len(h) }
+
+func (h expiryHeap[K, V]) Less(i, j int) bool { return h[i].expireAt.Before(h[j].expireAt) }
+
+func (h expiryHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap[K, V]) Push(x any) {
+	it := x.(*cacheItem[K, V])
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *expiryHeap[K, V]) Pop() any {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	it.index = -1
+	*h = old[:n-1]
+	return it
+}
@@ -0,0 +1,124 @@
+package lru
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.TODO()
+	var evicted []string
+	cache, err := NewCache[string, int](2, WithShards[string, int](1),
+		WithOnEvict[string, int](func(key string, value int) {
+			evicted = append(evicted, key)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Set(ctx, "1", 1, time.Now().Add(time.Minute))
+	cache.SetWithTTL(ctx, "2", 2, 0)
+	if v, ok := cache.Get(ctx, "1"); !ok || v != 1 {
+		t.Fatalf("got %v %v, want 1", v, ok)
+	}
+	// "2" is the least recently used
+	cache.Set(ctx, "3", 3, time.Time{})
+	if _, ok := cache.Get(ctx, "2"); ok {
+		t.Fatal("2 should be evicted")
+	}
+	if len(evicted) != 1 || evicted[0] != "2" {
+		t.Fatalf("evicted %v, want [2]", evicted)
+	}
+
+	// the TTL is checked on read
+	cache.SetWithTTL(ctx, "1", 1, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := cache.Get(ctx, "1"); ok {
+		t.Fatal("1 should be expired")
+	}
+
+	// Set removes the expired entries of its shard
+	cache.SetWithTTL(ctx, "1", 1, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	cache.Set(ctx, "3", 3, time.Time{})
+	if len(cache.shards[0].expiry) != 0 || cache.shards[0].lru.Len() != 1 {
+		t.Fatal("1 should be removed")
+	}
+
+	cache.Del(ctx, "3")
+	if cache.Len() != 0 {
+		t.Fatalf("len %d, want 0", cache.Len())
+	}
+}
+
+func TestCacheCleanup(t *testing.T) {
+	ctx := context.TODO()
+	cache, err := NewCache[int, int](100, WithCleanupInterval[int, int](10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		cache.SetWithTTL(ctx, i, i, 10*time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, s := range cache.shards {
+		s.mu.Lock()
+		n := s.lru.Len()
+		s.mu.Unlock()
+		if n != 0 {
+			t.Fatal("expired entries should be removed")
+		}
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	ctx := context.TODO()
+	cache, err := NewCache[string, int](128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa((g * i) % 256)
+				cache.SetWithTTL(ctx, key, i, time.Millisecond*time.Duration(i%3))
+				cache.Get(ctx, key)
+				if i%10 == 0 {
+					cache.Del(ctx, key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if cache.Len() > 128+len(cache.shards) {
+		t.Fatalf("len %d exceeds the size", cache.Len())
+	}
+}
+
+func BenchmarkCache(b *testing.B) {
+	ctx := context.TODO()
+	cache, _ := NewCache[string, int](1024)
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if _, ok := cache.Get(ctx, key); !ok {
+				cache.SetWithTTL(ctx, key, i, time.Minute)
+			}
+			i++
+		}
+	})
+}
@@ -2,6 +2,7 @@ package lru
 
 import (
 	"context"
+	"math/rand"
 	"time"
 	"unsafe"
 
@@ -17,18 +18,145 @@ type CacheFunc[T any] func(ctx context.Context) (T, error)
 
 var sf singleflight.Group
 
-func FuncCacheCall[T any](ctx context.Context, cache ILRUCache, key string, cacheFunc CacheFunc[T], expireDuration time.Duration) (T, error) {
+type funcCallOptions struct {
+	softTTL  time.Duration
+	errorTTL time.Duration
+	group    *singleflight.Group
+	jitter   float64
+}
+
+type FuncCallOption interface {
+	apply(*funcCallOptions)
+}
+
+type funcCallOptionFunc func(*funcCallOptions)
+
+func (f funcCallOptionFunc) apply(opt *funcCallOptions) {
+	f(opt)
+}
+
+// WithSoftTTL makes a value stale after ttl, a stale value is still returned
+// but the first read triggers a background refresh, the expire duration of
+// FuncCacheCall remains the hard limit after which callers wait for cacheFunc
+// again, a failed refresh is retried by the next read
+func WithSoftTTL(ttl time.Duration) FuncCallOption {
+	return funcCallOptionFunc(func(opt *funcCallOptions) {
+		opt.softTTL = ttl
+	})
+}
+
+// WithErrorTTL caches the errors of cacheFunc for ttl, they are returned
+// without calling cacheFunc until they expire
+func WithErrorTTL(ttl time.Duration) FuncCallOption {
+	return funcCallOptionFunc(func(opt *funcCallOptions) {
+		opt.errorTTL = ttl
+	})
+}
+
+// WithSingleflightGroup sets the group deduplicating the calls to cacheFunc,
+// it defaults to a group shared by every FuncCacheCall
+func WithSingleflightGroup(group *singleflight.Group) FuncCallOption {
+	return funcCallOptionFunc(func(opt *funcCallOptions) {
+		opt.group = group
+	})
+}
+
+// WithJitter shortens every TTL by a random fraction of up to jitter (0 to 1),
+// so that the entries cached together do not expire together
+func WithJitter(jitter float64) FuncCallOption {
+	return funcCallOptionFunc(func(opt *funcCallOptions) {
+		opt.jitter = min(max(jitter, 0), 1)
+	})
+}
+
+// funcCallEntry is cached instead of the value when the value can be stale
+// or when it is an error
+type funcCallEntry struct {
+	value   interface{}
+	err     error
+	staleAt time.Time
+}
+
+// FuncCacheCall returns the value of key cached, or else calls cacheFunc and
+// caches its value for expireDuration, concurrent calls for the same key
+// share a single call to cacheFunc
+func FuncCacheCall[T any](ctx context.Context, cache ILRUCache, key string, cacheFunc CacheFunc[T], expireDuration time.Duration, opts ...FuncCallOption) (T, error) {
+	_options := &funcCallOptions{
+		group: &sf,
+	}
+	for _, o := range opts {
+		o.apply(_options)
+	}
+
 	res, ok := cache.Get(ctx, key)
 	if ok {
-		return res.(T), nil
-	}
-	res, err, _ := sf.Do(key, func() (interface{}, error) {
-		res, err := cacheFunc(ctx)
-		if err != nil {
-			return res, err
+		e, ok := res.(*funcCallEntry)
+		if !ok {
+			return res.(T), nil
+		}
+		if e.err != nil {
+			var zero T
+			return zero, e.err
 		}
-		cache.Set(ctx, key, res, time.Now().Add(expireDuration))
-		return res, nil
+		if !e.staleAt.IsZero() && !time.Now().Before(e.staleAt) {
+			// the result is dropped, the refresh outlives the caller
+			refreshCtx := context.WithoutCancel(ctx)
+			_options.group.DoChan(key, func() (interface{}, error) {
+				return _options.call(refreshCtx, cache, key, wrap(cacheFunc), expireDuration, true)
+			})
+		}
+		return e.value.(T), nil
+	}
+
+	res, err, _ := _options.group.Do(key, func() (interface{}, error) {
+		return _options.call(ctx, cache, key, wrap(cacheFunc), expireDuration, false)
 	})
-	return res.(T), err
+	v, _ := res.(T)
+	return v, err
+}
+
+func wrap[T any](cacheFunc CacheFunc[T]) CacheFunc[interface{}] {
+	return func(ctx context.Context) (interface{}, error) {
+		return cacheFunc(ctx)
+	}
+}
+
+// call calls cacheFunc and caches its result, the error of a refresh is not
+// cached so that the stale value keeps being returned
+func (o *funcCallOptions) call(ctx context.Context, cache ILRUCache, key string, cacheFunc CacheFunc[interface{}], expireDuration time.Duration, refresh bool) (interface{}, error) {
+	res, err := cacheFunc(ctx)
+	now := time.Now()
+	if err != nil {
+		if o.errorTTL > 0 && !refresh {
+			cache.Set(ctx, key, &funcCallEntry{err: err}, now.Add(o.jittered(o.errorTTL)))
+		}
+		return res, err
+	}
+
+	// a single jitter factor for both TTLs keeps the value stale before it
+	// expires, otherwise the refresh may never get a chance to run
+	factor := o.jitterFactor()
+	expireAt := now.Add(scaled(expireDuration, factor))
+	if o.softTTL > 0 {
+		cache.Set(ctx, key, &funcCallEntry{value: res, staleAt: now.Add(scaled(o.softTTL, factor))}, expireAt)
+	} else {
+		cache.Set(ctx, key, res, expireAt)
+	}
+	return res, nil
+}
+
+func (o *funcCallOptions) jittered(ttl time.Duration) time.Duration {
+	return scaled(ttl, o.jitterFactor())
+}
+
+// jitterFactor returns the fraction of the TTLs kept, between 1-jitter and 1
+func (o *funcCallOptions) jitterFactor() float64 {
+	if o.jitter <= 0 {
+		return 1
+	}
+	return 1 - rand.Float64()*o.jitter
+}
+
+func scaled(ttl time.Duration, factor float64) time.Duration {
+	return time.Duration(factor * float64(ttl))
 }
@@ -2,9 +2,13 @@ package lru
 
 import (
 	"context"
+	"errors"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 func TestFuncCacheCall(t *testing.T) {
@@ -89,3 +93,110 @@ func TestFuncCacheCall(t *testing.T) {
 		})
 	}
 }
+
+func TestFuncCacheCallWithCache(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewCache[string, interface{}](8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	cacheFunc := func(ctx context.Context) (int, error) {
+		calls++
+		return calls, nil
+	}
+	for i := 0; i < 2; i++ {
+		got, err := FuncCacheCall[int](ctx, cache, "key", cacheFunc, 20*time.Millisecond)
+		if err != nil || got != 1 {
+			t.Fatalf("FuncCacheCall() got = %v, %v, want 1", got, err)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	got, err := FuncCacheCall[int](ctx, cache, "key", cacheFunc, time.Minute)
+	if err != nil || got != 2 {
+		t.Fatalf("FuncCacheCall() got = %v, %v, want 2", got, err)
+	}
+}
+
+func TestFuncCacheCallOptions(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewCache[string, interface{}](8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stale value is returned while a single refresh runs
+	var calls atomic.Int32
+	release := make(chan struct{})
+	cacheFunc := func(ctx context.Context) (int, error) {
+		n := calls.Add(1)
+		if n > 1 {
+			<-release
+		}
+		return int(n), nil
+	}
+	opts := []FuncCallOption{WithSoftTTL(10 * time.Millisecond), WithSingleflightGroup(&singleflight.Group{})}
+	if got, _ := FuncCacheCall[int](ctx, cache, "soft", cacheFunc, time.Minute, opts...); got != 1 {
+		t.Fatalf("FuncCacheCall() got = %v, want 1", got)
+	}
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if got, _ := FuncCacheCall[int](ctx, cache, "soft", cacheFunc, time.Minute, opts...); got != 1 {
+			t.Fatalf("FuncCacheCall() got = %v, want the stale 1", got)
+		}
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		got, _ := FuncCacheCall[int](ctx, cache, "soft", cacheFunc, time.Minute, opts...)
+		if got == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the stale value should be refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("cacheFunc called %d times, want 2", calls.Load())
+	}
+
+	// errors are cached for the error TTL
+	var errCalls int
+	errFunc := func(ctx context.Context) (int, error) {
+		errCalls++
+		return 0, errors.New("failed")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := FuncCacheCall[int](ctx, cache, "err", errFunc, time.Minute, WithErrorTTL(20*time.Millisecond)); err == nil {
+			t.Fatal("FuncCacheCall() should fail")
+		}
+	}
+	if errCalls != 1 {
+		t.Fatalf("errFunc called %d times, want 1", errCalls)
+	}
+	time.Sleep(30 * time.Millisecond)
+	FuncCacheCall[int](ctx, cache, "err", errFunc, time.Minute, WithErrorTTL(20*time.Millisecond))
+	if errCalls != 2 {
+		t.Fatalf("errFunc called %d times, want 2 once the error expired", errCalls)
+	}
+
+	// the expiry is shortened by up to the jitter
+	FuncCacheCall[int](ctx, cache, "jitter", cacheFunc, time.Minute, WithJitter(0.5))
+	_, expireAt, _ := cache.GetWithExpireAt(ctx, "jitter")
+	if ttl := time.Until(expireAt); ttl > time.Minute || ttl < 29*time.Second {
+		t.Fatalf("ttl %v, want between 30s and 1m", ttl)
+	}
+
+	// the jittered value still goes stale before it expires
+	opts = []FuncCallOption{WithSoftTTL(59 * time.Second), WithJitter(1)}
+	for i := 0; i < 100; i++ {
+		cache.Del(ctx, "jitter")
+		FuncCacheCall[int](ctx, cache, "jitter", cacheFunc, time.Minute, opts...)
+		res, expireAt, _ := cache.GetWithExpireAt(ctx, "jitter")
+		if staleAt := res.(*funcCallEntry).staleAt; staleAt.After(expireAt) {
+			t.Fatalf("stale at %v, after the expiry %v", staleAt, expireAt)
+		}
+	}
+}
@@ -21,6 +21,10 @@ type T struct {
 	mm         map[string]time.Time
 }
 
+// NewLRUCache creates an ILRUCache whose expired entries are swept at most
+// every 10 seconds, Get may return them until then
+//
+// Deprecated: use NewCache, which never returns an expired entry.
 func NewLRUCache(maxLen int) ILRUCache {
 	cache, _ := v2.NewARC(int(uint32(maxLen)))
 	return &T{
@@ -4,74 +4,112 @@ import (
 	"sync"
 )
 
-// ARCCache is a thread-safe fixed size Adaptive Replacement Cache (ARC).
+var (
+	_ LRUCache[string, interface{}] = (*LRU[string, interface{}])(nil)
+	_ LRUCache[string, interface{}] = (*ARC[string, interface{}])(nil)
+)
+
+// ARC is a non-thread safe fixed size Adaptive Replacement Cache (ARC).
 // ARC is an enhancement over the standard LRU cache in that tracks both
 // frequency and recency of use. This avoids a burst in access to new
 // entries from evicting the frequently used older entries. It adds some
 // additional tracking overhead to a standard LRU cache, computationally
 // it is roughly 2x the cost, and the extra memory overhead is linear
 // with the size of the cache. ARC has been patented by IBM, but is
-// similar to the TwoQueueCache (2Q) which requires setting parameters.
-type ARCCache struct {
-	size int // Size is the total capacity of the cache
-	p    int // P is the dynamic preference towards T1 or T2
-
-	t1 LRUCache[string, interface{}] // T1 is the LRU for recently accessed items
-	b1 LRUCache[string, struct{}]    // B1 is the LRU for evictions from t1
+// similar to the TwoQueue (2Q) which requires setting parameters.
+//
+// The size and P are in cost units, every entry costs 1 unless the cache
+// has a weigher.
+type ARC[K comparable, V any] struct {
+	size int64 // Size is the total capacity of the cache
+	p    int64 // P is the dynamic preference towards T1 or T2
+
+	t1 *LRU[K, V]     // T1 is the LRU for recently accessed items
+	b1 *LRU[K, int64] // B1 is the LRU for evictions from t1, holding their cost
+
+	t2 *LRU[K, V]     // T2 is the LRU for frequently accessed items
+	b2 *LRU[K, int64] // B2 is the LRU for evictions from t2, holding their cost
+
+	weigher     Weigher[K, V]
+	onEvict     EvictCallback[K, V]
+	onCostEvict CostEvictCallback[K, V]
+}
 
-	t2 LRUCache[string, interface{}] // T2 is the LRU for frequently accessed items
-	b2 LRUCache[string, struct{}]    // B2 is the LRU for evictions from t2
+// NewGenericARC creates an ARC of the given size, onEvict is called for the
+// entries evicted or removed
+func NewGenericARC[K comparable, V any](size int, onEvict EvictCallback[K, V]) (*ARC[K, V], error) {
+	c, err := newARC[K, V](int64(size), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.onEvict = onEvict
+	return c, nil
+}
 
-	lock sync.RWMutex
+// NewWeightedARC creates an ARC bounding the total cost of its entries to
+// maxCost, entries are evicted until the cost fits and an entry costing more
+// than maxCost is evicted right away. Cap and Resize are in cost units.
+func NewWeightedARC[K comparable, V any](maxCost int64, weigher Weigher[K, V], onEvict CostEvictCallback[K, V]) (*ARC[K, V], error) {
+	c, err := newARC[K, V](maxCost, weigher)
+	if err != nil {
+		return nil, err
+	}
+	c.onCostEvict = onEvict
+	return c, nil
 }
 
-// NewARC creates an ARC of the given size
-func NewARC(size int) (*ARCCache, error) {
+func newARC[K comparable, V any](size int64, weigher Weigher[K, V]) (*ARC[K, V], error) {
+	// The ghost entries cost as much as the entries they replace
+	var ghostWeigher Weigher[K, int64]
+	if weigher != nil {
+		ghostWeigher = func(key K, cost int64) int64 {
+			return cost
+		}
+	}
+
 	// Create the sub LRUs
-	b1, err := NewLRU[string, struct{}](size, nil)
+	b1, err := NewWeightedLRU[K, int64](size, ghostWeigher, nil)
 	if err != nil {
 		return nil, err
 	}
-	b2, err := NewLRU[string, struct{}](size, nil)
+	b2, err := NewWeightedLRU[K, int64](size, ghostWeigher, nil)
 	if err != nil {
 		return nil, err
 	}
-	t1, err := NewLRU[string, interface{}](size, nil)
+	t1, err := NewWeightedLRU[K, V](size, weigher, nil)
 	if err != nil {
 		return nil, err
 	}
-	t2, err := NewLRU[string, interface{}](size, nil)
+	t2, err := NewWeightedLRU[K, V](size, weigher, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	// Initialize the ARC
-	x := &ARCCache{
-		size: size,
-		p:    0,
-		t1:   t1,
-		b1:   b1,
-		t2:   t2,
-		b2:   b2,
+	c := &ARC[K, V]{
+		size:    size,
+		p:       0,
+		t1:      t1,
+		b1:      b1,
+		t2:      t2,
+		b2:      b2,
+		weigher: weigher,
 	}
-	return x, nil
+	return c, nil
 }
 
 // Get looks up a key's value from the cache.
-func (x *ARCCache) Get(key string) (value interface{}, ok bool) {
-	x.lock.Lock()
-	defer x.lock.Unlock()
-
+func (c *ARC[K, V]) Get(key K) (value V, ok bool) {
 	// If the value is contained in T1 (recent), then
 	// promote it to T2 (frequent)
-	if val, ok := x.t1.Peek(key); ok {
-		x.t1.Remove(key)
-		x.t2.Add(key, val)
+	if val, ok := c.t1.Peek(key); ok {
+		c.t1.Remove(key)
+		c.t2.Add(key, val)
 		return val, ok
 	}
 
 	// Check if the value is contained in T2 (frequent)
-	if val, ok := x.t2.Get(key); ok {
+	if val, ok := c.t2.Get(key); ok {
 		return val, ok
 	}
 
@@ -79,173 +117,335 @@ func (x *ARCCache) Get(key string) (value interface{}, ok bool) {
 	return
 }
 
-// Add adds a value to the cache.
-func (x *ARCCache) Add(key string, value interface{}) {
-	x.lock.Lock()
-	defer x.lock.Unlock()
+// Add adds a value to the cache. Returns true if an eviction occurred.
+func (c *ARC[K, V]) Add(key K, value V) (evicted bool) {
+	cost := c.weigh(key, value)
+	if cost > c.size {
+		c.Remove(key)
+		c.evicted(key, value, cost)
+		return true
+	}
 
 	// Check if the value is contained in T1 (recent), and potentially
 	// promote it to frequent T2
-	if x.t1.Contains(key) {
-		x.t1.Remove(key)
-		x.t2.Add(key, value)
-		return
+	if c.t1.Contains(key) {
+		c.t1.Remove(key)
+		evicted = c.ensureSpace(cost, false)
+		c.t2.Add(key, value)
+		return evicted
 	}
 
 	// Check if the value is already in T2 (frequent) and update it
-	if x.t2.Contains(key) {
-		x.t2.Add(key, value)
-		return
+	if c.t2.Contains(key) {
+		c.t2.Remove(key)
+		evicted = c.ensureSpace(cost, false)
+		c.t2.Add(key, value)
+		return evicted
 	}
 
 	// Check if this value was recently evicted as part of the
 	// recently used list
-	if x.b1.Contains(key) {
+	if c.b1.Contains(key) {
 		// T1 set is too small, increase P appropriately
-		delta := 1
-		b1Len := x.b1.Len()
-		b2Len := x.b2.Len()
-		if b2Len > b1Len {
-			delta = b2Len / b1Len
+		delta := cost
+		b1Cost := c.b1.Cost()
+		b2Cost := c.b2.Cost()
+		if b2Cost > b1Cost && b1Cost > 0 {
+			delta = b2Cost / b1Cost * cost
 		}
-		if x.p+delta >= x.size {
-			x.p = x.size
+		if c.p+delta >= c.size {
+			c.p = c.size
 		} else {
-			x.p += delta
+			c.p += delta
 		}
 
 		// Potentially need to make room in the cache
-		if x.t1.Len()+x.t2.Len() >= x.size {
-			x.replace(false)
-		}
+		evicted = c.ensureSpace(cost, false)
 
 		// Remove from B1
-		x.b1.Remove(key)
+		c.b1.Remove(key)
 
 		// Add the key to the frequently used list
-		x.t2.Add(key, value)
-		return
+		c.t2.Add(key, value)
+		return evicted
 	}
 
 	// Check if this value was recently evicted as part of the
 	// frequently used list
-	if x.b2.Contains(key) {
+	if c.b2.Contains(key) {
 		// T2 set is too small, decrease P appropriately
-		delta := 1
-		b1Len := x.b1.Len()
-		b2Len := x.b2.Len()
-		if b1Len > b2Len {
-			delta = b1Len / b2Len
+		delta := cost
+		b1Cost := c.b1.Cost()
+		b2Cost := c.b2.Cost()
+		if b1Cost > b2Cost && b2Cost > 0 {
+			delta = b1Cost / b2Cost * cost
 		}
-		if delta >= x.p {
-			x.p = 0
+		if delta >= c.p {
+			c.p = 0
 		} else {
-			x.p -= delta
+			c.p -= delta
 		}
 
 		// Potentially need to make room in the cache
-		if x.t1.Len()+x.t2.Len() >= x.size {
-			x.replace(true)
-		}
+		evicted = c.ensureSpace(cost, true)
 
 		// Remove from B2
-		x.b2.Remove(key)
+		c.b2.Remove(key)
 
 		// Add the key to the frequently used list
-		x.t2.Add(key, value)
-		return
+		c.t2.Add(key, value)
+		return evicted
 	}
 
 	// Potentially need to make room in the cache
-	if x.t1.Len()+x.t2.Len() >= x.size {
-		x.replace(false)
-	}
+	evicted = c.ensureSpace(cost, false)
 
 	// Keep the size of the ghost buffers trim
-	if x.b1.Len() > x.size-x.p {
-		x.b1.RemoveOldest()
+	for c.b1.Cost() > c.size-c.p {
+		c.b1.RemoveOldest()
 	}
-	if x.b2.Len() > x.p {
-		x.b2.RemoveOldest()
+	for c.b2.Cost() > c.p {
+		c.b2.RemoveOldest()
 	}
 
 	// Add to the recently seen list
-	x.t1.Add(key, value)
+	c.t1.Add(key, value)
+	return evicted
+}
+
+func (c *ARC[K, V]) weigh(key K, value V) int64 {
+	if c.weigher == nil {
+		return 1
+	}
+	return c.weigher(key, value)
+}
+
+// ensureSpace evicts until an entry of the given cost fits in the cache.
+// Returns true if an eviction occurred.
+func (c *ARC[K, V]) ensureSpace(cost int64, b2ContainsKey bool) (evicted bool) {
+	for c.Len() > 0 && c.Cost()+cost > c.size {
+		c.replace(b2ContainsKey)
+		evicted = true
+	}
+	return evicted
 }
 
 // replace is used to adaptively evict from either T1 or T2
 // based on the current learned value of P
-func (x *ARCCache) replace(b2ContainsKey bool) {
-	t1Len := x.t1.Len()
-	if t1Len > 0 && (t1Len > x.p || (t1Len == x.p && b2ContainsKey)) {
-		k, _, ok := x.t1.RemoveOldest()
+func (c *ARC[K, V]) replace(b2ContainsKey bool) bool {
+	t1Cost := c.t1.Cost()
+	if c.t1.Len() > 0 && (t1Cost > c.p || (t1Cost == c.p && b2ContainsKey) || c.t2.Len() == 0) {
+		k, v, cost, ok := removeOldest(c.t1)
 		if ok {
-			x.b1.Add(k, struct{}{})
+			c.b1.Add(k, cost)
+			c.evicted(k, v, cost)
 		}
-	} else {
-		k, _, ok := x.t2.RemoveOldest()
-		if ok {
-			x.b2.Add(k, struct{}{})
+		return ok
+	}
+	k, v, cost, ok := removeOldest(c.t2)
+	if ok {
+		c.b2.Add(k, cost)
+		c.evicted(k, v, cost)
+	}
+	return ok
+}
+
+// removeOldest removes the oldest entry of a sub LRU, returning its cost
+func removeOldest[K comparable, V any](l *LRU[K, V]) (key K, value V, cost int64, ok bool) {
+	if key, value, ok = l.GetOldest(); ok {
+		cost = l.costOf(key)
+		l.Remove(key)
+	}
+	return
+}
+
+func (c *ARC[K, V]) evicted(key K, value V, cost int64) {
+	if c.onEvict != nil {
+		c.onEvict(key, value)
+	}
+	if c.onCostEvict != nil {
+		c.onCostEvict(key, value, cost)
+	}
+}
+
+// Contains is used to check if the cache contains a key
+// without updating recency or frequency.
+func (c *ARC[K, V]) Contains(key K) bool {
+	return c.t1.Contains(key) || c.t2.Contains(key)
+}
+
+// Peek is used to inspect the cache value of a key
+// without updating recency or frequency.
+func (c *ARC[K, V]) Peek(key K) (value V, ok bool) {
+	if val, ok := c.t1.Peek(key); ok {
+		return val, ok
+	}
+	return c.t2.Peek(key)
+}
+
+// Remove is used to purge a key from the cache, returning if the
+// key was contained.
+func (c *ARC[K, V]) Remove(key K) bool {
+	for _, t := range []*LRU[K, V]{c.t1, c.t2} {
+		if val, ok := t.Peek(key); ok {
+			cost := t.costOf(key)
+			t.Remove(key)
+			c.evicted(key, val, cost)
+			return true
+		}
+	}
+	if c.b1.Remove(key) {
+		return false
+	}
+	c.b2.Remove(key)
+	return false
+}
+
+// RemoveOldest removes the oldest entry of T1, or of T2 if T1 is empty.
+func (c *ARC[K, V]) RemoveOldest() (key K, value V, ok bool) {
+	var cost int64
+	if key, value, cost, ok = removeOldest(c.t1); !ok {
+		key, value, cost, ok = removeOldest(c.t2)
+	}
+	if ok {
+		c.evicted(key, value, cost)
+	}
+	return
+}
+
+// GetOldest returns the oldest entry of T1, or of T2 if T1 is empty.
+func (c *ARC[K, V]) GetOldest() (key K, value V, ok bool) {
+	if key, value, ok = c.t1.GetOldest(); ok {
+		return
+	}
+	return c.t2.GetOldest()
+}
+
+// Keys returns the keys of T1 then of T2, each from oldest to newest.
+func (c *ARC[K, V]) Keys() []K {
+	return append(c.t1.Keys(), c.t2.Keys()...)
+}
+
+// Values returns the values of T1 then of T2, each from oldest to newest.
+func (c *ARC[K, V]) Values() []V {
+	return append(c.t1.Values(), c.t2.Values()...)
+}
+
+// Len returns the number of cached entries
+func (c *ARC[K, V]) Len() int {
+	return c.t1.Len() + c.t2.Len()
+}
+
+// Cost returns the total cost of the cached entries, their number without
+// weigher
+func (c *ARC[K, V]) Cost() int64 {
+	return c.t1.Cost() + c.t2.Cost()
+}
+
+// Cap returns the capacity of the cache
+func (c *ARC[K, V]) Cap() int {
+	return int(c.size)
+}
+
+// Purge is used to clear the cache
+func (c *ARC[K, V]) Purge() {
+	for _, t := range []*LRU[K, V]{c.t1, c.t2} {
+		for _, k := range t.Keys() {
+			v, _ := t.Peek(k)
+			c.evicted(k, v, t.costOf(k))
 		}
 	}
+	c.t1.Purge()
+	c.t2.Purge()
+	c.b1.Purge()
+	c.b2.Purge()
+	c.p = 0
+}
+
+// Resize changes the cache size, returning the number of entries evicted.
+func (c *ARC[K, V]) Resize(size int) (evicted int) {
+	c.size = int64(size)
+	c.p = min(c.p, c.size)
+	for c.Len() > 0 && c.Cost() > c.size {
+		c.replace(false)
+		evicted++
+	}
+	c.t1.Resize(size)
+	c.t2.Resize(size)
+	c.b1.Resize(size)
+	c.b2.Resize(size)
+	return evicted
+}
+
+// ARCCache is a thread-safe ARC keyed by string
+type ARCCache struct {
+	arc  *ARC[string, interface{}]
+	lock sync.RWMutex
+}
+
+// NewARC creates an ARCCache of the given size
+func NewARC(size int) (*ARCCache, error) {
+	arc, err := NewGenericARC[string, interface{}](size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ARCCache{arc: arc}, nil
+}
+
+// Get looks up a key's value from the cache.
+func (x *ARCCache) Get(key string) (value interface{}, ok bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.arc.Get(key)
+}
+
+// Add adds a value to the cache.
+func (x *ARCCache) Add(key string, value interface{}) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.arc.Add(key, value)
 }
 
 // Len returns the number of cached entries
 func (x *ARCCache) Len() int {
 	x.lock.RLock()
 	defer x.lock.RUnlock()
-	return x.t1.Len() + x.t2.Len()
+	return x.arc.Len()
 }
 
 // Cap returns the capacity of the cache
 func (x *ARCCache) Cap() int {
-	return x.size
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.arc.Cap()
 }
 
 // Keys returns all the cached keys
 func (x *ARCCache) Keys() []string {
 	x.lock.RLock()
 	defer x.lock.RUnlock()
-	k1 := x.t1.Keys()
-	k2 := x.t2.Keys()
-	return append(k1, k2...)
+	return x.arc.Keys()
 }
 
 // Values returns all the cached values
 func (x *ARCCache) Values() []interface{} {
 	x.lock.RLock()
 	defer x.lock.RUnlock()
-	v1 := x.t1.Values()
-	v2 := x.t2.Values()
-	return append(v1, v2...)
+	return x.arc.Values()
 }
 
 // Remove is used to purge a key from the cache
 func (x *ARCCache) Remove(key string) {
 	x.lock.Lock()
 	defer x.lock.Unlock()
-	if x.t1.Remove(key) {
-		return
-	}
-	if x.t2.Remove(key) {
-		return
-	}
-	if x.b1.Remove(key) {
-		return
-	}
-	if x.b2.Remove(key) {
-		return
-	}
+	x.arc.Remove(key)
 }
 
 // Purge is used to clear the cache
 func (x *ARCCache) Purge() {
 	x.lock.Lock()
 	defer x.lock.Unlock()
-	x.t1.Purge()
-	x.t2.Purge()
-	x.b1.Purge()
-	x.b2.Purge()
+	x.arc.Purge()
 }
 
 // Contains is used to check if the cache contains a key
@@ -253,7 +453,7 @@ func (x *ARCCache) Purge() {
 func (x *ARCCache) Contains(key string) bool {
 	x.lock.RLock()
 	defer x.lock.RUnlock()
-	return x.t1.Contains(key) || x.t2.Contains(key)
+	return x.arc.Contains(key)
 }
 
 // Peek is used to inspect the cache value of a key
@@ -261,8 +461,5 @@ func (x *ARCCache) Contains(key string) bool {
 func (x *ARCCache) Peek(key string) (value interface{}, ok bool) {
 	x.lock.RLock()
 	defer x.lock.RUnlock()
-	if val, ok := x.t1.Peek(key); ok {
-		return val, ok
-	}
-	return x.t2.Peek(key)
+	return x.arc.Peek(key)
 }
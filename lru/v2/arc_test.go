@@ -0,0 +1,138 @@
+package v2
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestARC(t *testing.T) {
+	var evicted []int
+	c, err := NewGenericARC[int, string](4, func(key int, value string) {
+		evicted = append(evicted, key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		c.Add(i, strconv.Itoa(i))
+	}
+	// 0 and 1 are frequently used
+	c.Get(0)
+	c.Get(1)
+	for i := 4; i < 8; i++ {
+		c.Add(i, strconv.Itoa(i))
+	}
+	if c.Len() != 4 {
+		t.Fatalf("len %d, want 4", c.Len())
+	}
+	for _, key := range []int{0, 1} {
+		if v, ok := c.Get(key); !ok || v != strconv.Itoa(key) {
+			t.Fatalf("%d should survive the scan", key)
+		}
+	}
+	if len(evicted) != 4 {
+		t.Fatalf("evicted %v, want 4 keys", evicted)
+	}
+
+	// an evicted key comes back as frequently used
+	if c.Add(2, "2") != true {
+		t.Fatal("adding 2 should evict")
+	}
+	if !c.t2.Contains(2) {
+		t.Fatal("2 should be in T2")
+	}
+
+	if !c.Remove(2) || c.Remove(2) {
+		t.Fatal("2 should be removed once")
+	}
+	if n := c.Resize(1); n != 2 || c.Len() != 1 {
+		t.Fatalf("evicted %d, len %d after resize, want 2 and 1", n, c.Len())
+	}
+	c.Purge()
+	if c.Len() != 0 || len(c.Keys()) != 0 {
+		t.Fatal("purge should empty the cache")
+	}
+}
+
+func TestARCCache(t *testing.T) {
+	c, err := NewARC(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3)
+	if c.Len() != 2 || c.Contains("a") {
+		t.Fatal("a should be evicted")
+	}
+	if v, ok := c.Peek("c"); !ok || v != 3 {
+		t.Fatalf("got %v %v, want 3", v, ok)
+	}
+}
+
+func TestSyncCache(t *testing.T) {
+	arc, err := NewGenericARC[int, int](64, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewSyncCache[int, int](arc)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := (g * i) % 128
+				if _, ok := c.Get(key); !ok {
+					c.Add(key, i)
+				}
+				c.Len()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if c.Len() > 64 {
+		t.Fatalf("len %d exceeds the size", c.Len())
+	}
+}
+
+func TestWeightedARC(t *testing.T) {
+	var freed int64
+	c, err := NewWeightedARC[int, []byte](10, func(key int, value []byte) int64 {
+		return int64(len(value))
+	}, func(key int, value []byte, cost int64) {
+		freed += cost
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.Add(i, make([]byte, 3))
+	}
+	// 0 is frequently used
+	c.Get(0)
+	if !c.Add(3, make([]byte, 4)) || c.Cost() > 10 || !c.Contains(0) {
+		t.Fatalf("keys %v, cost %d, want 0 kept and cost <= 10", c.Keys(), c.Cost())
+	}
+	if freed != 3 {
+		t.Fatalf("freed %d, want 3", freed)
+	}
+
+	// an entry costing more than the cache is evicted right away
+	if !c.Add(4, make([]byte, 11)) || c.Contains(4) || freed != 14 {
+		t.Fatalf("freed %d, want 14", freed)
+	}
+
+	if n := c.Resize(4); c.Cost() > 4 || n == 0 || c.Cap() != 4 {
+		t.Fatalf("evicted %d, cost %d after resize, want cost <= 4", n, c.Cost())
+	}
+	// every added entry has been freed
+	c.Purge()
+	if c.Len() != 0 || freed != 24 {
+		t.Fatalf("freed %d after purge, want 24", freed)
+	}
+}
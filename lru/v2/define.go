@@ -55,12 +55,26 @@ type LRUCache[K comparable, V any] interface {
 // EvictCallback is used to get a callback when a cache entry is evicted
 type EvictCallback[K comparable, V any] func(key K, value V)
 
+// CostEvictCallback is an EvictCallback also given the cost freed by the
+// eviction
+type CostEvictCallback[K comparable, V any] func(key K, value V, cost int64)
+
+// Weigher returns the cost of an entry, it is called once when the entry is
+// added or updated
+type Weigher[K comparable, V any] func(key K, value V) int64
+
 // LRU implements a non-thread safe fixed size LRU cache
+//
+// the size bounds the total cost of the entries, every entry costs 1 unless
+// the cache has a weigher
 type LRU[K comparable, V any] struct {
-	size      int
-	evictList *internal.LruList[K, V]
-	items     map[K]*internal.Entry[K, V]
-	onEvict   EvictCallback[K, V]
+	size        int64
+	cost        int64
+	evictList   *internal.LruList[K, V]
+	items       map[K]*internal.Entry[K, V]
+	weigher     Weigher[K, V]
+	onEvict     EvictCallback[K, V]
+	onCostEvict CostEvictCallback[K, V]
 }
 
 // NewLRU constructs an LRU of the given size
@@ -70,7 +84,7 @@ func NewLRU[K comparable, V any](size int, onEvict EvictCallback[K, V]) (*LRU[K,
 	}
 
 	c := &LRU[K, V]{
-		size:      size,
+		size:      int64(size),
 		evictList: internal.NewList[K, V](),
 		items:     make(map[K]*internal.Entry[K, V]),
 		onEvict:   onEvict,
@@ -78,36 +92,73 @@ func NewLRU[K comparable, V any](size int, onEvict EvictCallback[K, V]) (*LRU[K,
 	return c, nil
 }
 
+// NewWeightedLRU constructs an LRU bounding the total cost of its entries to
+// maxCost, the oldest entries are evicted until the cost fits and an entry
+// costing more than maxCost is evicted right away. Cap and Resize are in
+// cost units.
+func NewWeightedLRU[K comparable, V any](maxCost int64, weigher Weigher[K, V], onEvict CostEvictCallback[K, V]) (*LRU[K, V], error) {
+	if maxCost <= 0 {
+		return nil, ErrMustProvidePositiveSize
+	}
+
+	c := &LRU[K, V]{
+		size:        maxCost,
+		evictList:   internal.NewList[K, V](),
+		items:       make(map[K]*internal.Entry[K, V]),
+		weigher:     weigher,
+		onCostEvict: onEvict,
+	}
+	return c, nil
+}
+
 // Purge is used to completely clear the cache.
 func (c *LRU[K, V]) Purge() {
 	for k, v := range c.items {
-		if c.onEvict != nil {
-			c.onEvict(k, v.Value)
-		}
+		c.evicted(v)
 		delete(c.items, k)
 	}
 	c.evictList.Init()
+	c.cost = 0
 }
 
 // Add adds a value to the cache.  Returns true if an eviction occurred.
 func (c *LRU[K, V]) Add(key K, value V) (evicted bool) {
+	cost := c.weigh(key, value)
+	// An entry costing more than the cache is dropped up front instead of
+	// evicting every other entry first
+	if cost > c.size {
+		c.Remove(key)
+		c.evicted(&internal.Entry[K, V]{Key: key, Value: value, Cost: cost})
+		return true
+	}
+
 	// Check for existing item
 	if ent, ok := c.items[key]; ok {
 		c.evictList.MoveToFront(ent)
 		ent.Value = value
-		return false
+		c.cost += cost - ent.Cost
+		ent.Cost = cost
+	} else {
+		// Add new item
+		ent := c.evictList.PushFront(key, value)
+		ent.Cost = cost
+		c.items[key] = ent
+		c.cost += cost
 	}
 
-	// Add new item
-	ent := c.evictList.PushFront(key, value)
-	c.items[key] = ent
-
-	evict := c.evictList.Length() > c.size
 	// Verify size not exceeded
-	if evict {
+	for c.cost > c.size && c.Len() > 0 {
 		c.removeOldest()
+		evicted = true
 	}
-	return evict
+	return evicted
+}
+
+func (c *LRU[K, V]) weigh(key K, value V) int64 {
+	if c.weigher == nil {
+		return 1
+	}
+	return c.weigher(key, value)
 }
 
 // Get looks up a key's value from the cache.
@@ -190,22 +241,25 @@ func (c *LRU[K, V]) Len() int {
 	return c.evictList.Length()
 }
 
+// Cost returns the total cost of the items in the cache, their number
+// without weigher.
+func (c *LRU[K, V]) Cost() int64 {
+	return c.cost
+}
+
 // Cap returns the capacity of the cache
 func (c *LRU[K, V]) Cap() int {
-	return c.size
+	return int(c.size)
 }
 
 // Resize changes the cache size.
 func (c *LRU[K, V]) Resize(size int) (evicted int) {
-	diff := c.Len() - size
-	if diff < 0 {
-		diff = 0
-	}
-	for i := 0; i < diff; i++ {
+	for c.cost > int64(size) && c.Len() > 0 {
 		c.removeOldest()
+		evicted++
 	}
-	c.size = size
-	return diff
+	c.size = int64(size)
+	return evicted
 }
 
 // removeOldest removes the oldest item from the cache.
@@ -219,7 +273,23 @@ func (c *LRU[K, V]) removeOldest() {
 func (c *LRU[K, V]) removeElement(e *internal.Entry[K, V]) {
 	c.evictList.Remove(e)
 	delete(c.items, e.Key)
+	c.cost -= e.Cost
+	c.evicted(e)
+}
+
+func (c *LRU[K, V]) evicted(e *internal.Entry[K, V]) {
 	if c.onEvict != nil {
 		c.onEvict(e.Key, e.Value)
 	}
+	if c.onCostEvict != nil {
+		c.onCostEvict(e.Key, e.Value, e.Cost)
+	}
+}
+
+// costOf returns the cost of a cached item, 0 if it is not cached
+func (c *LRU[K, V]) costOf(key K) int64 {
+	if ent, ok := c.items[key]; ok {
+		return ent.Cost
+	}
+	return 0
 }
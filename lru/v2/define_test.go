@@ -0,0 +1,86 @@
+package v2
+
+import (
+	"testing"
+)
+
+func TestWeightedLRU(t *testing.T) {
+	freed := map[string]int64{}
+	c, err := NewWeightedLRU[string, []byte](10, func(key string, value []byte) int64 {
+		return int64(len(value))
+	}, func(key string, value []byte, cost int64) {
+		freed[key] = cost
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewWeightedLRU[string, []byte](0, nil, nil); err != ErrMustProvidePositiveSize {
+		t.Fatalf("got %v, want ErrMustProvidePositiveSize", err)
+	}
+
+	c.Add("a", make([]byte, 3))
+	c.Add("b", make([]byte, 3))
+	c.Add("c", make([]byte, 3))
+	if c.Cost() != 9 || c.Cap() != 10 {
+		t.Fatalf("cost %d, cap %d, want 9 and 10", c.Cost(), c.Cap())
+	}
+
+	// evicts a and b to fit 6
+	if !c.Add("d", make([]byte, 6)) {
+		t.Fatal("adding d should evict")
+	}
+	if c.Contains("a") || c.Contains("b") || c.Cost() != 9 {
+		t.Fatalf("keys %v, cost %d, want [c d] and 9", c.Keys(), c.Cost())
+	}
+	if freed["a"] != 3 || freed["b"] != 3 {
+		t.Fatalf("freed %v, want 3 for a and b", freed)
+	}
+
+	// updating a value updates its cost
+	if !c.Add("c", make([]byte, 5)) || c.Contains("d") || c.Cost() != 5 {
+		t.Fatalf("keys %v, cost %d, want [c] and 5", c.Keys(), c.Cost())
+	}
+
+	// an entry costing more than the cache is evicted right away, the other
+	// entries are kept
+	if !c.Add("e", make([]byte, 11)) || c.Contains("e") || freed["e"] != 11 {
+		t.Fatalf("keys %v, freed %v, want e evicted", c.Keys(), freed)
+	}
+	if !c.Contains("c") || c.Cost() != 5 {
+		t.Fatalf("keys %v, cost %d, want [c] and 5", c.Keys(), c.Cost())
+	}
+	c.Remove("c")
+
+	c.Add("a", make([]byte, 4))
+	c.Add("b", make([]byte, 4))
+	if n := c.Resize(5); n != 1 || c.Cost() != 4 || c.Cap() != 5 {
+		t.Fatalf("evicted %d, cost %d after resize, want 1 and 4", n, c.Cost())
+	}
+	c.Purge()
+	if c.Cost() != 0 || freed["b"] != 4 {
+		t.Fatal("purge should free b")
+	}
+}
+
+func TestWeightedLRUOversized(t *testing.T) {
+	c, err := NewWeightedLRU[string, int64](10, func(key string, value int64) int64 {
+		return value
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add("a", 3)
+	c.Add("b", 3)
+	if !c.Add("big", 11) {
+		t.Fatal("adding big should evict it")
+	}
+	if c.Contains("big") || !c.Contains("a") || !c.Contains("b") || c.Cost() != 6 {
+		t.Fatalf("keys %v, cost %d, want [a b] and 6", c.Keys(), c.Cost())
+	}
+
+	// replacing an entry with an oversized value drops the old one too
+	c.Add("a", 11)
+	if c.Contains("a") || !c.Contains("b") || c.Cost() != 3 {
+		t.Fatalf("keys %v, cost %d, want [b] and 3", c.Keys(), c.Cost())
+	}
+}
@@ -0,0 +1,35 @@
+package v2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+)
+
+// NewHasher returns a seeded hash of keys, strings and integers are hashed
+// without allocating, other keys are hashed through fmt.Sprint
+func NewHasher[K comparable]() func(K) uint64 {
+	seed := maphash.MakeSeed()
+	return func(key K) uint64 {
+		var buf [8]byte
+		switch k := any(key).(type) {
+		case string:
+			return maphash.String(seed, k)
+		case int:
+			binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		case int32:
+			binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		case int64:
+			binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		case uint:
+			binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		case uint32:
+			binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		case uint64:
+			binary.LittleEndian.PutUint64(buf[:], k)
+		default:
+			return maphash.String(seed, fmt.Sprint(key))
+		}
+		return maphash.Bytes(seed, buf[:])
+	}
+}
@@ -29,6 +29,9 @@ type Entry[K comparable, V any] struct {
 
 	// The expiry bucket item was put in, optional
 	ExpireBucket uint8
+
+	// The cost of this element given by the weigher, 1 without weigher
+	Cost int64
 }
 
 // PrevEntry returns the previous list element or nil.
@@ -0,0 +1,86 @@
+package v2
+
+const (
+	sketchDepth    = 4
+	sketchMaxCount = 15
+)
+
+// cmSketch is a count-min sketch estimating how often the keys were accessed,
+// each row has 8 counters per entry of the cache, saturating at 15, they are
+// halved every resetAt increments so that the estimates follow the recent
+// popularity of the keys
+type cmSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCMSketch(size int) *cmSketch {
+	width := 16
+	for width < 8*size {
+		width <<= 1
+	}
+	s := &cmSketch{mask: uint64(width - 1)}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	s.setSize(size)
+	return s
+}
+
+// setSize sets the number of increments between two halvings, 10 per entry
+// of the cache
+func (s *cmSketch) setSize(size int) {
+	s.resetAt = max(10*size, 1)
+}
+
+// index returns the counter of row i, the rows are indexed by
+// double hashing the two halves of h
+func (s *cmSketch) index(h uint64, i int) uint64 {
+	h1, h2 := h&0xffffffff, h>>32
+	return (h1 + uint64(i)*h2) & s.mask
+}
+
+func (s *cmSketch) estimate(h uint64) uint8 {
+	count := uint8(sketchMaxCount)
+	for i := range s.rows {
+		count = min(count, s.rows[i][s.index(h, i)])
+	}
+	return count
+}
+
+// increment only increments the counters equal to the estimate (conservative
+// update), which limits the overestimation caused by the collisions
+func (s *cmSketch) increment(h uint64) {
+	count := s.estimate(h)
+	if count < sketchMaxCount {
+		for i := range s.rows {
+			if c := &s.rows[i][s.index(h, i)]; *c == count {
+				*c++
+			}
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+// reset halves every counter
+func (s *cmSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+func (s *cmSketch) clear() {
+	for i := range s.rows {
+		clear(s.rows[i])
+	}
+	s.additions = 0
+}
@@ -0,0 +1,98 @@
+package v2
+
+import (
+	"sync"
+)
+
+var _ LRUCache[string, interface{}] = (*SyncCache[string, interface{}])(nil)
+
+// SyncCache makes an LRUCache thread-safe, the eviction callback of the
+// wrapped cache is called with the lock held
+type SyncCache[K comparable, V any] struct {
+	cache LRUCache[K, V]
+	lock  sync.RWMutex
+}
+
+// NewSyncCache wraps cache, which must not be used directly afterwards
+func NewSyncCache[K comparable, V any](cache LRUCache[K, V]) *SyncCache[K, V] {
+	return &SyncCache[K, V]{cache: cache}
+}
+
+func (x *SyncCache[K, V]) Add(key K, value V) bool {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.cache.Add(key, value)
+}
+
+// Get takes the write lock, it updates the recent-ness of the key
+func (x *SyncCache[K, V]) Get(key K) (V, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.cache.Get(key)
+}
+
+func (x *SyncCache[K, V]) Contains(key K) bool {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.cache.Contains(key)
+}
+
+func (x *SyncCache[K, V]) Peek(key K) (V, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.cache.Peek(key)
+}
+
+func (x *SyncCache[K, V]) Remove(key K) bool {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.cache.Remove(key)
+}
+
+func (x *SyncCache[K, V]) RemoveOldest() (K, V, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.cache.RemoveOldest()
+}
+
+func (x *SyncCache[K, V]) GetOldest() (K, V, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.cache.GetOldest()
+}
+
+func (x *SyncCache[K, V]) Keys() []K {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.cache.Keys()
+}
+
+func (x *SyncCache[K, V]) Values() []V {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.cache.Values()
+}
+
+func (x *SyncCache[K, V]) Len() int {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.cache.Len()
+}
+
+func (x *SyncCache[K, V]) Cap() int {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.cache.Cap()
+}
+
+func (x *SyncCache[K, V]) Purge() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.cache.Purge()
+}
+
+func (x *SyncCache[K, V]) Resize(size int) int {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.cache.Resize(size)
+}
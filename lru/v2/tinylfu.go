@@ -0,0 +1,304 @@
+package v2
+
+var _ LRUCache[string, interface{}] = (*TinyLFU[string, interface{}])(nil)
+
+const (
+	// DefaultTinyLFUWindowRatio is the ratio of the TinyLFU cache dedicated
+	// to the window LRU receiving the new entries
+	DefaultTinyLFUWindowRatio = 0.01
+
+	// DefaultTinyLFUProtectedRatio is the ratio of the main area of the
+	// TinyLFU cache holding the entries accessed more than once
+	DefaultTinyLFUProtectedRatio = 0.80
+)
+
+// TinyLFU is a non-thread safe fixed size W-TinyLFU cache.
+// New entries go into a small window LRU, the entries leaving the window
+// are admitted into the main area only if they were accessed more often
+// than the entry the main area would evict, the access frequencies are
+// estimated by a count-min sketch. The main area is a segmented LRU, the
+// entries admitted wait in probation and move to protected once accessed
+// again. This keeps the frequently used entries in the cache through scans
+// and bursts of new entries, while the window lets the recent entries build
+// up their frequency.
+type TinyLFU[K comparable, V any] struct {
+	size          int
+	windowSize    int
+	protectedSize int
+
+	window    *LRU[K, V] // newly added entries
+	probation *LRU[K, V] // entries admitted into the main area
+	protected *LRU[K, V] // entries of the main area accessed again
+
+	sketch *cmSketch
+	hasher func(K) uint64
+
+	onEvict EvictCallback[K, V]
+}
+
+// NewTinyLFU creates a TinyLFU of the given size, onEvict is called for the
+// entries evicted or removed
+func NewTinyLFU[K comparable, V any](size int, onEvict EvictCallback[K, V]) (*TinyLFU[K, V], error) {
+	if size <= 0 {
+		return nil, ErrMustProvidePositiveSize
+	}
+
+	// The sub LRUs never evict by themselves, the window holds one extra
+	// entry while it is being added
+	window, err := NewLRU[K, V](size+1, nil)
+	if err != nil {
+		return nil, err
+	}
+	probation, err := NewLRU[K, V](size+1, nil)
+	if err != nil {
+		return nil, err
+	}
+	protected, err := NewLRU[K, V](size+1, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &TinyLFU[K, V]{
+		window:    window,
+		probation: probation,
+		protected: protected,
+		sketch:    newCMSketch(size),
+		hasher:    NewHasher[K](),
+		onEvict:   onEvict,
+	}
+	c.setSize(size)
+	return c, nil
+}
+
+func (c *TinyLFU[K, V]) setSize(size int) {
+	c.size = size
+	c.windowSize = max(int(float64(size)*DefaultTinyLFUWindowRatio), 1)
+	c.protectedSize = int(float64(size-c.windowSize) * DefaultTinyLFUProtectedRatio)
+	c.sketch.setSize(size)
+}
+
+// Get looks up a key's value from the cache.
+func (c *TinyLFU[K, V]) Get(key K) (value V, ok bool) {
+	if val, ok := c.window.Get(key); ok {
+		c.sketch.increment(c.hasher(key))
+		return val, ok
+	}
+
+	// An entry of probation accessed again is protected
+	if val, ok := c.probation.Peek(key); ok {
+		c.sketch.increment(c.hasher(key))
+		c.promote(key, val)
+		return val, ok
+	}
+
+	if val, ok := c.protected.Get(key); ok {
+		c.sketch.increment(c.hasher(key))
+		return val, ok
+	}
+
+	// No hit
+	return
+}
+
+// Add adds a value to the cache. Returns true if an eviction occurred.
+func (c *TinyLFU[K, V]) Add(key K, value V) (evicted bool) {
+	c.sketch.increment(c.hasher(key))
+
+	// Update the value of a cached entry
+	if c.window.Contains(key) {
+		c.window.Add(key, value)
+		return false
+	}
+	if c.probation.Contains(key) {
+		c.promote(key, value)
+		return false
+	}
+	if c.protected.Contains(key) {
+		c.protected.Add(key, value)
+		return false
+	}
+
+	// New entries go into the window, the ones leaving it compete for the
+	// main area
+	c.window.Add(key, value)
+	for c.window.Len() > c.windowSize {
+		k, v, _ := c.window.RemoveOldest()
+		if c.admit(k, v) {
+			evicted = true
+		}
+	}
+	return evicted
+}
+
+// admit moves an entry leaving the window into probation, when the main
+// area is full the least frequently accessed of the entry and of the victim
+// of the main area is evicted. Returns true if an eviction occurred.
+func (c *TinyLFU[K, V]) admit(key K, value V) bool {
+	if c.probation.Len()+c.protected.Len() < c.size-c.windowSize {
+		c.probation.Add(key, value)
+		return false
+	}
+
+	victim, victimValue, ok := c.probation.GetOldest()
+	if !ok {
+		victim, victimValue, ok = c.protected.GetOldest()
+	}
+	if !ok || c.sketch.estimate(c.hasher(key)) <= c.sketch.estimate(c.hasher(victim)) {
+		c.evicted(key, value)
+		return true
+	}
+
+	if !c.probation.Remove(victim) {
+		c.protected.Remove(victim)
+	}
+	c.evicted(victim, victimValue)
+	c.probation.Add(key, value)
+	return true
+}
+
+// promote moves an entry from probation to protected, demoting the oldest
+// entries of protected back to probation if it is full
+func (c *TinyLFU[K, V]) promote(key K, value V) {
+	c.probation.Remove(key)
+	c.protected.Add(key, value)
+	for c.protected.Len() > c.protectedSize {
+		k, v, _ := c.protected.RemoveOldest()
+		c.probation.Add(k, v)
+	}
+}
+
+func (c *TinyLFU[K, V]) evicted(key K, value V) {
+	if c.onEvict != nil {
+		c.onEvict(key, value)
+	}
+}
+
+// Contains is used to check if the cache contains a key
+// without updating recency or frequency.
+func (c *TinyLFU[K, V]) Contains(key K) bool {
+	return c.window.Contains(key) || c.probation.Contains(key) || c.protected.Contains(key)
+}
+
+// Peek is used to inspect the cache value of a key
+// without updating recency or frequency.
+func (c *TinyLFU[K, V]) Peek(key K) (value V, ok bool) {
+	if val, ok := c.window.Peek(key); ok {
+		return val, ok
+	}
+	if val, ok := c.probation.Peek(key); ok {
+		return val, ok
+	}
+	return c.protected.Peek(key)
+}
+
+// Remove is used to purge a key from the cache, returning if the
+// key was contained.
+func (c *TinyLFU[K, V]) Remove(key K) bool {
+	for _, l := range c.lists() {
+		if val, ok := l.Peek(key); ok {
+			l.Remove(key)
+			c.evicted(key, val)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveOldest removes the oldest entry of probation, or of protected if
+// probation is empty, or of the window if the main area is empty.
+func (c *TinyLFU[K, V]) RemoveOldest() (key K, value V, ok bool) {
+	for _, l := range c.lists() {
+		if key, value, ok = l.RemoveOldest(); ok {
+			c.evicted(key, value)
+			return
+		}
+	}
+	return
+}
+
+// GetOldest returns the oldest entry of probation, or of protected if
+// probation is empty, or of the window if the main area is empty.
+func (c *TinyLFU[K, V]) GetOldest() (key K, value V, ok bool) {
+	for _, l := range c.lists() {
+		if key, value, ok = l.GetOldest(); ok {
+			return
+		}
+	}
+	return
+}
+
+// Keys returns the keys of probation, protected then of the window, each
+// from oldest to newest.
+func (c *TinyLFU[K, V]) Keys() []K {
+	keys := make([]K, 0, c.Len())
+	for _, l := range c.lists() {
+		keys = append(keys, l.Keys()...)
+	}
+	return keys
+}
+
+// Values returns the values of probation, protected then of the window, each
+// from oldest to newest.
+func (c *TinyLFU[K, V]) Values() []V {
+	values := make([]V, 0, c.Len())
+	for _, l := range c.lists() {
+		values = append(values, l.Values()...)
+	}
+	return values
+}
+
+// lists returns the LRUs in eviction order
+func (c *TinyLFU[K, V]) lists() []*LRU[K, V] {
+	return []*LRU[K, V]{c.probation, c.protected, c.window}
+}
+
+// Len returns the number of cached entries
+func (c *TinyLFU[K, V]) Len() int {
+	return c.window.Len() + c.probation.Len() + c.protected.Len()
+}
+
+// Cap returns the capacity of the cache
+func (c *TinyLFU[K, V]) Cap() int {
+	return c.size
+}
+
+// Purge is used to clear the cache
+func (c *TinyLFU[K, V]) Purge() {
+	if c.onEvict != nil {
+		for _, l := range c.lists() {
+			for _, k := range l.Keys() {
+				v, _ := l.Peek(k)
+				c.onEvict(k, v)
+			}
+		}
+	}
+	c.window.Purge()
+	c.probation.Purge()
+	c.protected.Purge()
+	c.sketch.clear()
+}
+
+// Resize changes the cache size, returning the number of entries evicted.
+func (c *TinyLFU[K, V]) Resize(size int) (evicted int) {
+	c.setSize(size)
+
+	// The entries overflowing the window and protected move to probation,
+	// the main area then evicts its oldest entries
+	for c.window.Len() > c.windowSize {
+		k, v, _ := c.window.RemoveOldest()
+		c.probation.Add(k, v)
+	}
+	for c.protected.Len() > c.protectedSize {
+		k, v, _ := c.protected.RemoveOldest()
+		c.probation.Add(k, v)
+	}
+	for c.probation.Len()+c.protected.Len() > size-c.windowSize {
+		c.RemoveOldest()
+		evicted++
+	}
+
+	c.window.Resize(size + 1)
+	c.probation.Resize(size + 1)
+	c.protected.Resize(size + 1)
+	return evicted
+}
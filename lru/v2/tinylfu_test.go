@@ -0,0 +1,241 @@
+package v2
+
+import (
+	"bufio"
+	"flag"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+)
+
+var traceFile = flag.String("lru.trace", "", "file of keys, one per line, replayed by BenchmarkHitRatio")
+
+func TestTinyLFU(t *testing.T) {
+	var evicted []int
+	c, err := NewTinyLFU[int, int](100, func(key int, value int) {
+		evicted = append(evicted, key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a fixed hash makes the collisions of the sketch, and so the entries
+	// admitted, the same on every run
+	c.hasher = splitMix64
+
+	// 0..49 are frequently used
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 50; i++ {
+			if _, ok := c.Get(i); !ok {
+				c.Add(i, i)
+			}
+		}
+	}
+	// a scan of keys used once, long enough for the sketch to halve its
+	// counters with the default reset interval of 10 increments per entry
+	for i := 1000; i < 2000; i++ {
+		c.Add(i, i)
+	}
+	if c.sketch.additions >= 1150 {
+		t.Fatal("the sketch should have halved its counters during the scan")
+	}
+	if c.Len() != 100 {
+		t.Fatalf("len %d, want 100", c.Len())
+	}
+	for i := 0; i < 50; i++ {
+		if !c.Contains(i) {
+			t.Fatalf("%d should survive the scan", i)
+		}
+	}
+	if len(evicted) != 950 {
+		t.Fatalf("evicted %d keys, want 950", len(evicted))
+	}
+
+	if v, ok := c.Peek(10); !ok || v != 10 {
+		t.Fatalf("peek 10 = %d, %v", v, ok)
+	}
+	c.Add(10, 11)
+	if v, _ := c.Get(10); v != 11 {
+		t.Fatalf("get 10 = %d, want 11", v)
+	}
+	if !c.Remove(10) || c.Contains(10) || c.Remove(10) {
+		t.Fatal("10 should be removed once")
+	}
+	if len(c.Keys()) != c.Len() || len(c.Values()) != c.Len() {
+		t.Fatal("keys and values should hold every entry")
+	}
+
+	if n := c.Resize(10); n != 89 || c.Len() != 10 {
+		t.Fatalf("evicted %d, len %d after resize, want 89 and 10", n, c.Len())
+	}
+	k, _, _ := c.GetOldest()
+	if k2, _, ok := c.RemoveOldest(); !ok || k2 != k || c.Contains(k) {
+		t.Fatal("the oldest key should be removed")
+	}
+	c.Purge()
+	if c.Len() != 0 {
+		t.Fatal("purge should empty the cache")
+	}
+
+	// a cache of a single entry only has a window
+	c, _ = NewTinyLFU[int, int](1, nil)
+	c.Add(1, 1)
+	if !c.Add(2, 2) || c.Contains(1) || !c.Contains(2) {
+		t.Fatal("2 should replace 1")
+	}
+}
+
+// splitMix64 is a deterministic hash of the int keys
+func splitMix64(key int) uint64 {
+	h := uint64(key) + 0x9e3779b97f4a7c15
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
+
+func TestTinyLFUHitRatio(t *testing.T) {
+	trace := zipfScanTrace(200000, 100000, 1000)
+	lru, _ := NewLRU[string, interface{}](1000, nil)
+	tinyLFU, _ := NewTinyLFU[string, interface{}](1000, nil)
+
+	lruRatio := hitRatio(lru, trace)
+	tinyLFURatio := hitRatio(tinyLFU, trace)
+	t.Logf("lru %.2f%%, tinylfu %.2f%%", lruRatio*100, tinyLFURatio*100)
+	if tinyLFURatio <= lruRatio {
+		t.Fatalf("tinylfu hit ratio %.4f should beat lru %.4f", tinyLFURatio, lruRatio)
+	}
+}
+
+// BenchmarkHitRatio replays traces against the caches and reports their hit
+// ratios, -lru.trace adds a trace recorded in a file
+func BenchmarkHitRatio(b *testing.B) {
+	traces := []struct {
+		name string
+		keys []string
+	}{
+		{"zipf", zipfTrace(200000, 100000)},
+		{"zipf_scan", zipfScanTrace(200000, 100000, 1000)},
+		{"loop", loopTrace(200000, 1200)},
+	}
+	if *traceFile != "" {
+		keys, err := readTrace(*traceFile)
+		if err != nil {
+			b.Fatal(err)
+		}
+		traces = append(traces, struct {
+			name string
+			keys []string
+		}{"file", keys})
+	}
+
+	caches := []struct {
+		name string
+		new  func(size int) traceCache
+	}{
+		{"lru", func(size int) traceCache {
+			c, _ := NewLRU[string, interface{}](size, nil)
+			return c
+		}},
+		{"arc", func(size int) traceCache {
+			c, _ := NewARC(size)
+			return arcTraceCache{c}
+		}},
+		{"tinylfu", func(size int) traceCache {
+			c, _ := NewTinyLFU[string, interface{}](size, nil)
+			return c
+		}},
+	}
+
+	for _, trace := range traces {
+		for _, cache := range caches {
+			b.Run(trace.name+"/"+cache.name, func(b *testing.B) {
+				var ratio float64
+				for i := 0; i < b.N; i++ {
+					ratio = hitRatio(cache.new(1000), trace.keys)
+				}
+				b.ReportMetric(ratio*100, "hit%")
+			})
+		}
+	}
+}
+
+type traceCache interface {
+	Get(key string) (interface{}, bool)
+	Add(key string, value interface{}) bool
+}
+
+// arcTraceCache adapts the Add of ARCCache, which returns nothing
+type arcTraceCache struct {
+	*ARCCache
+}
+
+func (c arcTraceCache) Add(key string, value interface{}) bool {
+	c.ARCCache.Add(key, value)
+	return false
+}
+
+// hitRatio looks every key of the trace up, adding the missing ones
+func hitRatio(c traceCache, trace []string) float64 {
+	var hits int
+	for _, key := range trace {
+		if _, ok := c.Get(key); ok {
+			hits++
+		} else {
+			c.Add(key, nil)
+		}
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+// zipfTrace returns n accesses to keys following a Zipf distribution
+func zipfTrace(n int, keys uint64) []string {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.01, 1, keys-1)
+	trace := make([]string, n)
+	for i := range trace {
+		trace[i] = strconv.FormatUint(zipf.Uint64(), 10)
+	}
+	return trace
+}
+
+// zipfScanTrace is zipfTrace interleaved with scans of scanLen keys accessed
+// once, every 10000 accesses
+func zipfScanTrace(n int, keys uint64, scanLen int) []string {
+	trace := make([]string, 0, n+n/10000*scanLen)
+	scanKey := keys
+	for i, key := range zipfTrace(n, keys) {
+		trace = append(trace, key)
+		if i%10000 == 9999 {
+			for j := 0; j < scanLen; j++ {
+				trace = append(trace, strconv.FormatUint(scanKey, 10))
+				scanKey++
+			}
+		}
+	}
+	return trace
+}
+
+// loopTrace returns n accesses looping over keys keys, the worst case of LRU
+// once keys exceeds the cache size
+func loopTrace(n int, keys int) []string {
+	trace := make([]string, n)
+	for i := range trace {
+		trace[i] = strconv.Itoa(i % keys)
+	}
+	return trace
+}
+
+func readTrace(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var trace []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		trace = append(trace, scanner.Text())
+	}
+	return trace, scanner.Err()
+}
@@ -0,0 +1,271 @@
+package v2
+
+import (
+	"errors"
+)
+
+const (
+	// Default2QRecentRatio is the ratio of the 2Q cache dedicated
+	// to recently added entries that have only been accessed once.
+	Default2QRecentRatio = 0.25
+
+	// Default2QGhostEntries is the default ratio of ghost
+	// entries kept to track entries recently evicted
+	Default2QGhostEntries = 0.50
+)
+
+var ErrInvalidRatio = errors.New("invalid ratio")
+
+var _ LRUCache[string, interface{}] = (*TwoQueue[string, interface{}])(nil)
+
+// TwoQueue is a non-thread safe fixed size 2Q cache.
+// 2Q is an enhancement over the standard LRU cache in that it tracks both
+// frequently and recently used entries separately. This avoids a burst in
+// access to new entries from evicting frequently used entries. It adds some
+// additional tracking overhead to the standard LRU cache, and is
+// computationally about 2x the cost, and adds some metadata over head.
+// The ARC is similar, but does not require setting any parameters.
+type TwoQueue[K comparable, V any] struct {
+	size        int
+	recentSize  int
+	recentRatio float64
+	ghostRatio  float64
+
+	recent      *LRU[K, V]        // recently added entries accessed once
+	frequent    *LRU[K, V]        // entries accessed more than once
+	recentEvict *LRU[K, struct{}] // ghost entries evicted from recent
+
+	onEvict EvictCallback[K, V]
+}
+
+// NewTwoQueue creates a TwoQueue of the given size with the default
+// parameters, onEvict is called for the entries evicted or removed
+func NewTwoQueue[K comparable, V any](size int, onEvict EvictCallback[K, V]) (*TwoQueue[K, V], error) {
+	return NewTwoQueueParams[K, V](size, Default2QRecentRatio, Default2QGhostEntries, onEvict)
+}
+
+// NewTwoQueueParams creates a TwoQueue of the given size, recentRatio is the
+// share of the size holding the entries accessed once and ghostRatio the
+// number of evicted keys remembered relative to the size
+func NewTwoQueueParams[K comparable, V any](size int, recentRatio, ghostRatio float64, onEvict EvictCallback[K, V]) (*TwoQueue[K, V], error) {
+	if size <= 0 {
+		return nil, ErrMustProvidePositiveSize
+	}
+	if recentRatio < 0.0 || recentRatio > 1.0 || ghostRatio < 0.0 || ghostRatio > 1.0 {
+		return nil, ErrInvalidRatio
+	}
+
+	recent, err := NewLRU[K, V](size, nil)
+	if err != nil {
+		return nil, err
+	}
+	frequent, err := NewLRU[K, V](size, nil)
+	if err != nil {
+		return nil, err
+	}
+	recentEvict, err := NewLRU[K, struct{}](ghostSize(size, ghostRatio), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &TwoQueue[K, V]{
+		size:        size,
+		recentSize:  int(float64(size) * recentRatio),
+		recentRatio: recentRatio,
+		ghostRatio:  ghostRatio,
+		recent:      recent,
+		frequent:    frequent,
+		recentEvict: recentEvict,
+		onEvict:     onEvict,
+	}
+	return c, nil
+}
+
+func ghostSize(size int, ghostRatio float64) int {
+	return max(int(float64(size)*ghostRatio), 1)
+}
+
+// Get looks up a key's value from the cache.
+func (c *TwoQueue[K, V]) Get(key K) (value V, ok bool) {
+	// Check if this is a frequent value
+	if val, ok := c.frequent.Get(key); ok {
+		return val, ok
+	}
+
+	// If the value is contained in recent, then we
+	// promote it to frequent
+	if val, ok := c.recent.Peek(key); ok {
+		c.recent.Remove(key)
+		c.frequent.Add(key, val)
+		return val, ok
+	}
+
+	// No hit
+	return
+}
+
+// Add adds a value to the cache. Returns true if an eviction occurred.
+func (c *TwoQueue[K, V]) Add(key K, value V) (evicted bool) {
+	// Check if the value is frequently used already,
+	// and just update the value
+	if c.frequent.Contains(key) {
+		c.frequent.Add(key, value)
+		return false
+	}
+
+	// Check if the value is recently used, and promote
+	// the value into the frequent list
+	if c.recent.Contains(key) {
+		c.recent.Remove(key)
+		c.frequent.Add(key, value)
+		return false
+	}
+
+	// If the value was recently evicted, add it to the
+	// frequently used list
+	if c.recentEvict.Contains(key) {
+		evicted = c.ensureSpace(true)
+		c.recentEvict.Remove(key)
+		c.frequent.Add(key, value)
+		return evicted
+	}
+
+	// Add to the recently seen list
+	evicted = c.ensureSpace(false)
+	c.recent.Add(key, value)
+	return evicted
+}
+
+// ensureSpace is used to ensure we have space in the cache
+func (c *TwoQueue[K, V]) ensureSpace(recentEvict bool) bool {
+	// If we have space, nothing to do
+	recentLen := c.recent.Len()
+	freqLen := c.frequent.Len()
+	if recentLen+freqLen < c.size {
+		return false
+	}
+
+	// If the recent buffer is larger than
+	// the target, evict from there
+	if recentLen > 0 && (recentLen > c.recentSize || (recentLen == c.recentSize && !recentEvict) || freqLen == 0) {
+		k, v, _ := c.recent.RemoveOldest()
+		c.recentEvict.Add(k, struct{}{})
+		c.evicted(k, v)
+		return true
+	}
+
+	// Remove from the frequent list otherwise
+	k, v, _ := c.frequent.RemoveOldest()
+	c.evicted(k, v)
+	return true
+}
+
+func (c *TwoQueue[K, V]) evicted(key K, value V) {
+	if c.onEvict != nil {
+		c.onEvict(key, value)
+	}
+}
+
+// Contains is used to check if the cache contains a key
+// without updating recency or frequency.
+func (c *TwoQueue[K, V]) Contains(key K) bool {
+	return c.frequent.Contains(key) || c.recent.Contains(key)
+}
+
+// Peek is used to inspect the cache value of a key
+// without updating recency or frequency.
+func (c *TwoQueue[K, V]) Peek(key K) (value V, ok bool) {
+	if val, ok := c.frequent.Peek(key); ok {
+		return val, ok
+	}
+	return c.recent.Peek(key)
+}
+
+// Remove removes the provided key from the cache, returning if the
+// key was contained.
+func (c *TwoQueue[K, V]) Remove(key K) bool {
+	if val, ok := c.frequent.Peek(key); ok {
+		c.frequent.Remove(key)
+		c.evicted(key, val)
+		return true
+	}
+	if val, ok := c.recent.Peek(key); ok {
+		c.recent.Remove(key)
+		c.evicted(key, val)
+		return true
+	}
+	c.recentEvict.Remove(key)
+	return false
+}
+
+// RemoveOldest removes the oldest entry of the recent list, or of the
+// frequent list if the recent one is empty.
+func (c *TwoQueue[K, V]) RemoveOldest() (key K, value V, ok bool) {
+	if key, value, ok = c.recent.RemoveOldest(); !ok {
+		key, value, ok = c.frequent.RemoveOldest()
+	}
+	if ok {
+		c.evicted(key, value)
+	}
+	return
+}
+
+// GetOldest returns the oldest entry of the recent list, or of the
+// frequent list if the recent one is empty.
+func (c *TwoQueue[K, V]) GetOldest() (key K, value V, ok bool) {
+	if key, value, ok = c.recent.GetOldest(); ok {
+		return
+	}
+	return c.frequent.GetOldest()
+}
+
+// Keys returns the keys of the recent list then of the frequent list,
+// each from oldest to newest.
+func (c *TwoQueue[K, V]) Keys() []K {
+	return append(c.recent.Keys(), c.frequent.Keys()...)
+}
+
+// Values returns the values of the recent list then of the frequent list,
+// each from oldest to newest.
+func (c *TwoQueue[K, V]) Values() []V {
+	return append(c.recent.Values(), c.frequent.Values()...)
+}
+
+// Len returns the number of items in the cache.
+func (c *TwoQueue[K, V]) Len() int {
+	return c.recent.Len() + c.frequent.Len()
+}
+
+// Cap returns the capacity of the cache
+func (c *TwoQueue[K, V]) Cap() int {
+	return c.size
+}
+
+// Purge is used to completely clear the cache.
+func (c *TwoQueue[K, V]) Purge() {
+	if c.onEvict != nil {
+		for _, t := range []*LRU[K, V]{c.recent, c.frequent} {
+			for _, k := range t.Keys() {
+				v, _ := t.Peek(k)
+				c.onEvict(k, v)
+			}
+		}
+	}
+	c.recent.Purge()
+	c.frequent.Purge()
+	c.recentEvict.Purge()
+}
+
+// Resize changes the cache size, returning the number of entries evicted.
+func (c *TwoQueue[K, V]) Resize(size int) (evicted int) {
+	c.size = size
+	c.recentSize = int(float64(size) * c.recentRatio)
+	for c.Len() > size {
+		c.ensureSpace(false)
+		evicted++
+	}
+	c.recent.Resize(size)
+	c.frequent.Resize(size)
+	c.recentEvict.Resize(ghostSize(size, c.ghostRatio))
+	return evicted
+}
@@ -0,0 +1,55 @@
+package v2
+
+import (
+	"testing"
+)
+
+func TestTwoQueue(t *testing.T) {
+	var evicted []int
+	c, err := NewTwoQueue[int, int](4, func(key int, value int) {
+		evicted = append(evicted, key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewTwoQueueParams[int, int](4, 2, 0.5, nil); err != ErrInvalidRatio {
+		t.Fatalf("got %v, want ErrInvalidRatio", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		c.Add(i, i)
+	}
+	// 0 and 1 are frequently used
+	c.Get(0)
+	c.Get(1)
+	for i := 4; i < 8; i++ {
+		c.Add(i, i)
+	}
+	if c.Len() != 4 {
+		t.Fatalf("len %d, want 4", c.Len())
+	}
+	if !c.Contains(0) || !c.Contains(1) {
+		t.Fatal("0 and 1 should survive the scan")
+	}
+	if len(evicted) != 4 {
+		t.Fatalf("evicted %v, want 4 keys", evicted)
+	}
+
+	// a key evicted from the recent list comes back as frequently used
+	ghost := evicted[len(evicted)-1]
+	c.Add(ghost, 0)
+	if !c.frequent.Contains(ghost) {
+		t.Fatal("the ghost key should be in the frequent list")
+	}
+
+	if n := c.Resize(2); n != 2 || c.Len() != 2 {
+		t.Fatalf("evicted %d, len %d after resize, want 2 and 2", n, c.Len())
+	}
+	if k, _, ok := c.RemoveOldest(); !ok || c.Contains(k) {
+		t.Fatal("the oldest key should be removed")
+	}
+	c.Purge()
+	if c.Len() != 0 {
+		t.Fatal("purge should empty the cache")
+	}
+}
@@ -0,0 +1,125 @@
+package xmsgbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+	// ContentTypeRaw WithEncodeFunc 产生的数据，编码方式未知，订阅者必须通过 WithDecodeFunc 解码
+	ContentTypeRaw = "application/octet-stream"
+)
+
+var (
+	ErrCodecNotFound   = fmt.Errorf("codec not found")
+	ErrNotProtoMessage = fmt.Errorf("not proto message")
+	// ErrDecodeFuncRequired 消息体由 WithEncodeFunc 编码，订阅者没有设置 WithDecodeFunc
+	ErrDecodeFuncRequired = fmt.Errorf("decode func required")
+)
+
+// Codec 消息体编解码器，ContentType 会记录在 Event 中用于订阅者选择解码器
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(ProtobufCodec{})
+	RegisterCodec(MsgpackCodec{})
+}
+
+// RegisterCodec 注册编解码器，相同 ContentType 的编解码器会被覆盖
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// GetCodec 通过 ContentType 获取编解码器，为空时返回 JSON 编解码器
+func GetCodec(contentType string) (Codec, error) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrCodecNotFound, contentType)
+	}
+	return codec, nil
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufCodec 要求消息类型实现 proto.Message
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal v 可以是 proto.Message 或者指向 proto.Message 指针的指针，后者为 nil 时会自动分配
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Ptr {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		if m, ok := rv.Elem().Interface().(proto.Message); ok {
+			return proto.Unmarshal(data, m)
+		}
+	}
+	return fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+}
+
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
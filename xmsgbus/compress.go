@@ -0,0 +1,180 @@
+package xmsgbus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+)
+
+// DefaultMaxDecompressedSize 解压后消息体的默认大小上限（字节），防止压缩炸弹耗尽内存
+const DefaultMaxDecompressedSize = 64 << 20
+
+var (
+	ErrCompressorNotFound = fmt.Errorf("compressor not found")
+	// ErrDecompressedTooLarge 解压后的消息体超过大小上限
+	ErrDecompressedTooLarge = fmt.Errorf("decompressed size exceeds limit")
+)
+
+// Compressor 消息体压缩算法，Name 会记录在 Event.ContentEncoding 中
+type Compressor interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = make(map[string]Compressor)
+)
+
+func init() {
+	RegisterCompressor(GzipCompressor{})
+	RegisterCompressor(SnappyCompressor{})
+	zstdCompressor, err := NewZstdCompressor(DefaultMaxDecompressedSize)
+	if err != nil {
+		panic(err)
+	}
+	RegisterCompressor(zstdCompressor)
+}
+
+// decompressLimit size 小于等于 0 时使用 DefaultMaxDecompressedSize
+func decompressLimit(size int) int {
+	if size <= 0 {
+		return DefaultMaxDecompressedSize
+	}
+	return size
+}
+
+// RegisterCompressor 注册压缩算法，相同名称的压缩算法会被覆盖
+func RegisterCompressor(compressor Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[compressor.Name()] = compressor
+}
+
+func GetCompressor(name string) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	compressor, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrCompressorNotFound, name)
+	}
+	return compressor, nil
+}
+
+// GzipCompressor 通过 RegisterCompressor 重新注册可以修改解压大小上限
+type GzipCompressor struct {
+	// MaxDecompressedSize 解压后消息体的大小上限（字节），为 0 时使用 DefaultMaxDecompressedSize
+	MaxDecompressedSize int
+}
+
+func (GzipCompressor) Name() string {
+	return CompressionGzip
+}
+
+func (GzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (x GzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	limit := decompressLimit(x.MaxDecompressedSize)
+	// 多读一个字节用于判断是否超过上限
+	bs, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) > limit {
+		return nil, fmt.Errorf("%w: limit=%d", ErrDecompressedTooLarge, limit)
+	}
+	return bs, nil
+}
+
+// SnappyCompressor 通过 RegisterCompressor 重新注册可以修改解压大小上限
+type SnappyCompressor struct {
+	// MaxDecompressedSize 解压后消息体的大小上限（字节），为 0 时使用 DefaultMaxDecompressedSize
+	MaxDecompressedSize int
+}
+
+func (SnappyCompressor) Name() string {
+	return CompressionSnappy
+}
+
+func (SnappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (x SnappyCompressor) Decompress(src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	limit := decompressLimit(x.MaxDecompressedSize)
+	if n > limit {
+		return nil, fmt.Errorf("%w: limit=%d", ErrDecompressedTooLarge, limit)
+	}
+	return snappy.Decode(nil, src)
+}
+
+// ZstdCompressor encoder 与 decoder 都是并发安全的，可以复用
+type ZstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// NewZstdCompressor maxDecompressedSize 为解压后消息体的大小上限（字节），小于等于 0 时使用 DefaultMaxDecompressedSize
+// 通过 RegisterCompressor 重新注册可以修改解压大小上限
+func NewZstdCompressor(maxDecompressedSize int) (*ZstdCompressor, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(decompressLimit(maxDecompressedSize))))
+	if err != nil {
+		return nil, err
+	}
+	return &ZstdCompressor{
+		encoder: encoder,
+		decoder: decoder,
+	}, nil
+}
+
+func (x *ZstdCompressor) Name() string {
+	return CompressionZstd
+}
+
+func (x *ZstdCompressor) Compress(src []byte) ([]byte, error) {
+	return x.encoder.EncodeAll(src, nil), nil
+}
+
+func (x *ZstdCompressor) Decompress(src []byte) ([]byte, error) {
+	bs, err := x.decoder.DecodeAll(src, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, fmt.Errorf("%w: %v", ErrDecompressedTooLarge, err)
+	}
+	return bs, err
+}
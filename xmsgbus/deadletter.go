@@ -0,0 +1,111 @@
+package xmsgbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ccheers/xpkg/net/netutil"
+)
+
+// RetryPolicy 订阅者处理失败时的重试策略
+type RetryPolicy struct {
+	// MaxAttempts 最大处理次数（包含首次处理），小于等于 1 表示不重试
+	MaxAttempts int
+	// Backoff 两次处理之间的退避间隔
+	Backoff netutil.BackoffConfig
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 1,
+		Backoff:     netutil.DefaultBackoffConfig,
+	}
+}
+
+// DeadLetter 重试耗尽后投递到死信 topic 的消息
+type DeadLetter struct {
+	// DeadLetterTopic 死信 topic
+	DeadLetterTopic string
+	// SourceTopic 原始消息的 topic
+	SourceTopic string
+	// SourceChannel 原始消息的 channel
+	SourceChannel string
+	// Event 原始消息
+	Event Event
+	// Attempts 已经尝试处理的次数
+	Attempts int
+	// Error 最后一次处理失败的原因
+	Error string
+	// FailedAt 进入死信的时间
+	FailedAt time.Time
+}
+
+func (x *DeadLetter) Topic() string {
+	return x.DeadLetterTopic
+}
+
+// retry 按照重试策略调用 fn，返回实际调用次数以及最后一次的错误
+func (x *Subscriber[T]) retry(ctx context.Context, fn func() error) (int, error) {
+	policy := x.options.RetryPolicy
+	attempts := 0
+	for {
+		attempts++
+		err := fn()
+		if err == nil || attempts >= policy.MaxAttempts {
+			return attempts, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempts, err
+		case <-time.After(policy.Backoff.Backoff(attempts - 1)):
+		}
+	}
+}
+
+// deadLetter 将处理失败的消息投递到死信 topic 后确认消息
+// 死信投递失败时不确认消息，以便支持重投的后端再次投递
+func (x *Subscriber[T]) deadLetter(ctx context.Context, src *Event, ack func(), attempts int, cause error) error {
+	err := x.pushDeadLetter(ctx, src, attempts, cause)
+	if err != nil {
+		return err
+	}
+	ack()
+	return cause
+}
+
+// pushDeadLetter 投递死信，未配置死信 topic 时直接丢弃，与之前的行为保持一致
+func (x *Subscriber[T]) pushDeadLetter(ctx context.Context, src *Event, attempts int, cause error) error {
+	topic := x.options.DeadLetterTopic
+	if topic == "" {
+		return nil
+	}
+	payload, err := json.Marshal(&DeadLetter{
+		DeadLetterTopic: topic,
+		SourceTopic:     x.topic,
+		SourceChannel:   x.channel,
+		Event:           *src,
+		Attempts:        attempts,
+		Error:           cause.Error(),
+		FailedAt:        time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	bs, err := EncodeEvent(&Event{
+		ID:          src.ID,
+		Metadata:    src.Metadata,
+		Topic:       topic,
+		Payload:     payload,
+		ContentType: ContentTypeJSON,
+	})
+	if err != nil {
+		return err
+	}
+	err = x.msgBus.Push(ctx, topic, bs)
+	if err != nil {
+		return fmt.Errorf("[Subscriber][deadLetter] push to %s failed: %w, cause=%v", topic, err, cause)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package xmsgbus
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ccheers/xpkg/xbloom"
+	"github.com/ccheers/xpkg/xlogger"
+)
+
+// DedupState 认领消息的结果
+type DedupState int
+
+const (
+	// DedupClaimed 认领成功，可以处理该消息
+	DedupClaimed DedupState = iota
+	// DedupInProgress 消息正在被其他消费者处理，不能确认，处理失败或者进程退出之后由后端重新投递
+	DedupInProgress
+	// DedupDone 消息已经处理完成，直接确认并跳过
+	DedupDone
+)
+
+// IDeduplicator 记录已经处理过的消息 ID，用于在至少一次投递的后端上实现幂等消费
+// 认领只表示消息正在被处理，消息确认之前通过 Commit 记录为处理完成
+type IDeduplicator interface {
+	// Claim 原子地认领 key 对应的消息
+	Claim(ctx context.Context, key string) (DedupState, error)
+	// Commit 将认领的消息记录为处理完成
+	Commit(ctx context.Context, key string) error
+	// Release 释放认领，消息没有被确认时调用，重新投递之后可以再次认领
+	Release(ctx context.Context, key string) error
+}
+
+const (
+	dedupKeyPrefix      = "xmsgbus:dedup:"
+	dedupClaimKeyPrefix = "xmsgbus:dedup:claim:"
+)
+
+// StorageDeduplicator 基于 ISharedStorage 的去重，多个实例之间共享
+// 认领通过 SetNX 写入一条 claimTTL 之后过期的记录，进程在处理过程中退出时认领随之过期，重新投递的消息可以再次处理
+// 处理完成的记录单独保存，在 ttl 之后过期，claimTTL 应该大于消息的处理时间
+type StorageDeduplicator struct {
+	storage  ISharedStorage
+	claimTTL time.Duration
+	ttl      time.Duration
+}
+
+func NewStorageDeduplicator(storage ISharedStorage, claimTTL, ttl time.Duration) *StorageDeduplicator {
+	return &StorageDeduplicator{storage: storage, claimTTL: claimTTL, ttl: ttl}
+}
+
+func (x *StorageDeduplicator) Claim(ctx context.Context, key string) (DedupState, error) {
+	done, err := x.storage.Exists(ctx, dedupKeyPrefix+key)
+	if err != nil {
+		return DedupClaimed, err
+	}
+	if done {
+		return DedupDone, nil
+	}
+	claimed, err := x.storage.SetNX(ctx, dedupClaimKeyPrefix+key, 1, x.claimTTL)
+	if err != nil {
+		return DedupClaimed, err
+	}
+	if !claimed {
+		return DedupInProgress, nil
+	}
+	// 其他消费者可能在两次查询之间处理完成并释放了认领
+	done, err = x.storage.Exists(ctx, dedupKeyPrefix+key)
+	if err != nil {
+		return DedupClaimed, err
+	}
+	if done {
+		return DedupDone, x.storage.Del(ctx, dedupClaimKeyPrefix+key)
+	}
+	return DedupClaimed, nil
+}
+
+func (x *StorageDeduplicator) Commit(ctx context.Context, key string) error {
+	err := x.storage.SetEx(ctx, dedupKeyPrefix+key, 1, x.ttl)
+	if err != nil {
+		return err
+	}
+	return x.storage.Del(ctx, dedupClaimKeyPrefix+key)
+}
+
+func (x *StorageDeduplicator) Release(ctx context.Context, key string) error {
+	return x.storage.Del(ctx, dedupClaimKeyPrefix+key)
+}
+
+// BloomDeduplicator 基于本地布隆过滤器的去重，只对当前进程生效
+// 布隆过滤器存在假阳性，极少数未处理过的消息会被当作重复消息跳过
+// 每隔 ttl 轮换一次过滤器，记录最少保留 ttl，最多保留 2*ttl
+// 正在处理的消息记录在 map 中，只有 Commit 之后才加入过滤器
+type BloomDeduplicator struct {
+	mu                sync.Mutex
+	expectedItems     uint64
+	falsePositiveRate float64
+	ttl               time.Duration
+	rotatedAt         time.Time
+	current           *xbloom.BloomFilter
+	previous          *xbloom.BloomFilter
+	claimed           map[string]struct{}
+}
+
+// NewBloomDeduplicator expectedItems 为每个 ttl 周期内预期的消息数量
+func NewBloomDeduplicator(expectedItems uint64, falsePositiveRate float64, ttl time.Duration) *BloomDeduplicator {
+	return &BloomDeduplicator{
+		expectedItems:     expectedItems,
+		falsePositiveRate: falsePositiveRate,
+		ttl:               ttl,
+		rotatedAt:         time.Now(),
+		current:           xbloom.New(expectedItems, falsePositiveRate),
+		claimed:           make(map[string]struct{}),
+	}
+}
+
+func (x *BloomDeduplicator) Claim(ctx context.Context, key string) (DedupState, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.rotateLocked()
+	data := []byte(key)
+	if x.current.Contains(data) || (x.previous != nil && x.previous.Contains(data)) {
+		return DedupDone, nil
+	}
+	if _, ok := x.claimed[key]; ok {
+		return DedupInProgress, nil
+	}
+	x.claimed[key] = struct{}{}
+	return DedupClaimed, nil
+}
+
+func (x *BloomDeduplicator) Commit(ctx context.Context, key string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.rotateLocked()
+	delete(x.claimed, key)
+	x.current.Add([]byte(key))
+	return nil
+}
+
+func (x *BloomDeduplicator) Release(ctx context.Context, key string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.claimed, key)
+	return nil
+}
+
+func (x *BloomDeduplicator) rotateLocked() {
+	if x.ttl <= 0 || time.Since(x.rotatedAt) < x.ttl {
+		return
+	}
+	// 超过两个周期没有访问，之前的记录全部过期
+	if time.Since(x.rotatedAt) >= 2*x.ttl {
+		x.previous = nil
+	} else {
+		x.previous = x.current
+	}
+	x.current = xbloom.New(x.expectedItems, x.falsePositiveRate)
+	x.rotatedAt = time.Now()
+}
+
+// dedupKey 去重的 key，不同的 topic 和 channel 需要各自处理一次
+func (x *Subscriber[T]) dedupKey(src *Event) string {
+	return x.topic + ":" + x.channel + ":" + src.ID
+}
+
+// settleClaims 包装 ack，claim 认领消息并记录认领成功的 ID
+// 确认之前把认领的消息记录为处理完成，done 在处理结束时调用，释放没有被确认的认领
+// 去重存储异常时按认领成功对待，保证至少一次
+func (x *Subscriber[T]) settleClaims(ctx context.Context, ack func()) (wrappedAck func(), claim func(src *Event) DedupState, done func()) {
+	if x.options.Deduplicator == nil {
+		return ack, func(src *Event) DedupState { return DedupClaimed }, func() {}
+	}
+	// 处理过程中 context 可能已经退出
+	ctx = context.WithoutCancel(ctx)
+	var (
+		keys  []string
+		acked bool
+	)
+	claim = func(src *Event) DedupState {
+		if src.ID == "" {
+			return DedupClaimed
+		}
+		key := x.dedupKey(src)
+		state, err := x.options.Deduplicator.Claim(ctx, key)
+		if err != nil {
+			x.logDedupError(err)
+			return DedupClaimed
+		}
+		switch state {
+		case DedupClaimed:
+			keys = append(keys, key)
+		case DedupDone:
+			x.duplicateCounter.Add(ctx, 1, x.metricAttributes)
+		}
+		return state
+	}
+	wrappedAck = func() {
+		acked = true
+		for _, key := range keys {
+			if err := x.options.Deduplicator.Commit(ctx, key); err != nil {
+				x.logDedupError(err)
+			}
+		}
+		ack()
+	}
+	done = func() {
+		if acked {
+			return
+		}
+		for _, key := range keys {
+			if err := x.options.Deduplicator.Release(ctx, key); err != nil {
+				x.logDedupError(err)
+			}
+		}
+	}
+	return wrappedAck, claim, done
+}
+
+func (x *Subscriber[T]) logDedupError(err error) {
+	xlogger.DefaultLogger.Log(xlogger.LevelError, "err", err, "topic", x.topic, "channel", x.channel, "module", "[Subscriber][dedup]")
+}
@@ -1,9 +1,100 @@
 package xmsgbus
 
-import "google.golang.org/grpc/metadata"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/grpc/metadata"
+)
+
+var ErrInvalidEvent = fmt.Errorf("invalid event")
 
 type Event struct {
+	// ID 发布时生成的消息唯一标识，用于订阅者去重，旧版本的消息为空
+	ID       string `json:",omitempty"`
 	Metadata metadata.MD
 	Topic    string
 	Payload  []byte
+	// ContentType 消息体的编码类型，用于订阅者选择解码器，为空表示 JSON
+	ContentType string `json:",omitempty"`
+	// ContentEncoding 消息体的压缩算法，为空表示未压缩
+	ContentEncoding string `json:",omitempty"`
+}
+
+const (
+	// eventFrameMagic 二进制帧的魔数，JSON 格式的 Event 总是以 '{' 开头，两者不会冲突
+	eventFrameMagic   byte = 0xEB
+	eventFrameVersion byte = 1
+)
+
+// eventHeader 二进制帧的头部，消息体以原始字节追加在头部之后，避免 base64 膨胀
+type eventHeader struct {
+	ID              string      `json:",omitempty"`
+	Metadata        metadata.MD `json:",omitempty"`
+	Topic           string      `json:",omitempty"`
+	ContentType     string      `json:",omitempty"`
+	ContentEncoding string      `json:",omitempty"`
+}
+
+// EncodeEvent 将 Event 编码为 JSON，所有版本的订阅者都能解码
+func EncodeEvent(event *Event) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// EncodeEventFrame 将 Event 编码为二进制帧，只有支持二进制帧的订阅者才能解码
+// 帧格式: magic(1) | version(1) | uvarint(头部长度) | 头部(JSON) | 消息体
+func EncodeEventFrame(event *Event) ([]byte, error) {
+	header, err := json.Marshal(&eventHeader{
+		ID:              event.ID,
+		Metadata:        event.Metadata,
+		Topic:           event.Topic,
+		ContentType:     event.ContentType,
+		ContentEncoding: event.ContentEncoding,
+	})
+	if err != nil {
+		return nil, err
+	}
+	bs := make([]byte, 0, 2+binary.MaxVarintLen64+len(header)+len(event.Payload))
+	bs = append(bs, eventFrameMagic, eventFrameVersion)
+	bs = binary.AppendUvarint(bs, uint64(len(header)))
+	bs = append(bs, header...)
+	bs = append(bs, event.Payload...)
+	return bs, nil
+}
+
+// DecodeEvent 解码 EncodeEvent 生成的 JSON 或 EncodeEventFrame 生成的二进制帧
+func DecodeEvent(bs []byte) (*Event, error) {
+	var event Event
+	if len(bs) > 0 && bs[0] == '{' {
+		err := json.Unmarshal(bs, &event)
+		if err != nil {
+			return nil, err
+		}
+		return &event, nil
+	}
+
+	if len(bs) < 2 || bs[0] != eventFrameMagic {
+		return nil, ErrInvalidEvent
+	}
+	if bs[1] != eventFrameVersion {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrInvalidEvent, bs[1])
+	}
+	headerLen, n := binary.Uvarint(bs[2:])
+	if n <= 0 || uint64(len(bs)-2-n) < headerLen {
+		return nil, fmt.Errorf("%w: bad header length", ErrInvalidEvent)
+	}
+	start := 2 + n
+	var header eventHeader
+	err := json.Unmarshal(bs[start:start+int(headerLen)], &header)
+	if err != nil {
+		return nil, err
+	}
+	event.ID = header.ID
+	event.Metadata = header.Metadata
+	event.Topic = header.Topic
+	event.ContentType = header.ContentType
+	event.ContentEncoding = header.ContentEncoding
+	event.Payload = bs[start+int(headerLen):]
+	return &event, nil
 }
@@ -0,0 +1,12 @@
+package disk
+
+import "time"
+
+const (
+	// batchFillTimeout PopBatch 获取到第一条数据之后，等待后续每条数据的最长时间
+	batchFillTimeout = time.Millisecond * 10
+	// queueName 每个 channel 目录下 diskq 的名字
+	queueName = "channel"
+	// storageFileSuffix 共享存储中每个 key 对应文件的后缀
+	storageFileSuffix = ".kv"
+)
@@ -0,0 +1,309 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ccheers/xpkg/diskq"
+	"github.com/ccheers/xpkg/xmsgbus"
+)
+
+var ErrMsgBusClosed = fmt.Errorf("msgbus closed")
+
+type msgBusOptions struct {
+	dataDIR      string
+	queueOptions []diskq.Option
+}
+
+func defaultMsgBusOptions() msgBusOptions {
+	wd, _ := os.Getwd()
+	return msgBusOptions{dataDIR: filepath.Join(wd, ".xmsgbus")}
+}
+
+type IMsgBusOption interface {
+	apply(*msgBusOptions)
+}
+
+type MsgBusOptionFunc func(*msgBusOptions)
+
+func (fn MsgBusOptionFunc) apply(options *msgBusOptions) {
+	fn(options)
+}
+
+// WithMsgBusDataDIROption 数据目录，每个 topic/channel 对应其中的一个子目录
+func WithMsgBusDataDIROption(dataDIR string) MsgBusOptionFunc {
+	return func(options *msgBusOptions) {
+		options.dataDIR = dataDIR
+	}
+}
+
+// WithMsgBusQueueOption 创建每个 channel 的 diskq 时追加的选项，名字和目录由 MsgBus 管理
+func WithMsgBusQueueOption(opts ...diskq.Option) MsgBusOptionFunc {
+	return func(options *msgBusOptions) {
+		options.queueOptions = append(options.queueOptions, opts...)
+	}
+}
+
+// MsgBus 基于 diskq 的单机持久化 IMsgBus
+// 每个 topic/channel 对应一个 diskq，Push 写入 topic 下所有 channel，重启后从数据目录恢复
+// Pop 返回的数据在 ack 之前不会出队，超过 diskq 的可见性超时（diskq.WithVisibilityTimeout）没有 ack 的数据会被重新投递
+type MsgBus struct {
+	opts msgBusOptions
+
+	mu       sync.RWMutex
+	closed   bool
+	topicSet map[string]map[string]diskq.Interface
+}
+
+// NewMsgBus 创建 MsgBus，并打开数据目录中已经存在的 channel
+func NewMsgBus(options ...IMsgBusOption) (*MsgBus, error) {
+	opts := defaultMsgBusOptions()
+	for _, opt := range options {
+		opt.apply(&opts)
+	}
+	x := &MsgBus{
+		opts:     opts,
+		topicSet: make(map[string]map[string]diskq.Interface),
+	}
+	err := x.recover()
+	if err != nil {
+		_ = x.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// recover 按照目录结构 dataDIR/topic/channel 恢复 channel
+func (x *MsgBus) recover() error {
+	err := os.MkdirAll(x.opts.dataDIR, 0o755)
+	if err != nil {
+		return err
+	}
+	topicDirs, err := os.ReadDir(x.opts.dataDIR)
+	if err != nil {
+		return err
+	}
+	for _, topicDir := range topicDirs {
+		if !topicDir.IsDir() {
+			continue
+		}
+		topic, err := url.PathUnescape(topicDir.Name())
+		if err != nil {
+			continue
+		}
+		channelDirs, err := os.ReadDir(filepath.Join(x.opts.dataDIR, topicDir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, channelDir := range channelDirs {
+			if !channelDir.IsDir() {
+				continue
+			}
+			channel, err := url.PathUnescape(channelDir.Name())
+			if err != nil {
+				continue
+			}
+			_, err = x.queueLocked(topic, channel)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (x *MsgBus) channelDIR(topic, channel string) string {
+	return filepath.Join(x.opts.dataDIR, url.PathEscape(topic), url.PathEscape(channel))
+}
+
+// queueLocked 获取 channel 对应的 diskq，不存在则创建
+func (x *MsgBus) queueLocked(topic, channel string) (diskq.Interface, error) {
+	if x.closed {
+		return nil, ErrMsgBusClosed
+	}
+	if q := x.topicSet[topic][channel]; q != nil {
+		return q, nil
+	}
+	dir := x.channelDIR(topic, channel)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	opts := append([]diskq.Option{}, x.opts.queueOptions...)
+	opts = append(opts, diskq.WithName(queueName), diskq.WithDataDIR(dir))
+	q := diskq.New(opts...)
+	if x.topicSet[topic] == nil {
+		x.topicSet[topic] = make(map[string]diskq.Interface)
+	}
+	x.topicSet[topic][channel] = q
+	return q, nil
+}
+
+func (x *MsgBus) queue(topic, channel string) (diskq.Interface, error) {
+	x.mu.RLock()
+	q := x.topicSet[topic][channel]
+	closed := x.closed
+	x.mu.RUnlock()
+	if closed {
+		return nil, ErrMsgBusClosed
+	}
+	if q != nil {
+		return q, nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.queueLocked(topic, channel)
+}
+
+func (x *MsgBus) Push(ctx context.Context, topic string, bs []byte) error {
+	return x.PushBatch(ctx, topic, [][]byte{bs})
+}
+
+// PushBatch 将数据依次写入 topic 下的每个 channel，没有 channel 时丢弃
+func (x *MsgBus) PushBatch(ctx context.Context, topic string, bss [][]byte) error {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.closed {
+		return ErrMsgBusClosed
+	}
+	for channel, q := range x.topicSet[topic] {
+		for _, bs := range bss {
+			err := q.Put(bs)
+			if err != nil {
+				return fmt.Errorf("push to %s/%s failed: %w", topic, channel, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (x *MsgBus) Pop(ctx context.Context, topic, channel string, blockTimeout time.Duration) ([]byte, func(), error) {
+	bss, ack, err := x.PopBatch(ctx, topic, channel, 1, blockTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bss[0], ack, nil
+}
+
+func (x *MsgBus) PopBatch(ctx context.Context, topic, channel string, max int, blockTimeout time.Duration) ([][]byte, func(), error) {
+	q, err := x.queue(topic, channel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	getCtx := ctx
+	if blockTimeout > 0 {
+		var cancel context.CancelFunc
+		getCtx, cancel = context.WithTimeout(ctx, blockTimeout)
+		defer cancel()
+	}
+	bs, ack, _, err := q.GetCtx(getCtx)
+	if err != nil {
+		return nil, nil, x.popError(ctx, err)
+	}
+	bss := [][]byte{bs}
+	acks := []func(){ack}
+	// 队列中还有数据时短暂等待下一条，避免被其他消费者取走后一直阻塞
+	for len(bss) < max && q.Depth() > 0 {
+		fillCtx, cancel := context.WithTimeout(ctx, batchFillTimeout)
+		bs, ack, _, err := q.GetCtx(fillCtx)
+		cancel()
+		if err != nil {
+			break
+		}
+		bss = append(bss, bs)
+		acks = append(acks, ack)
+	}
+	return bss, func() {
+		for _, ack := range acks {
+			ack()
+		}
+	}, nil
+}
+
+// popError 区分阻塞超时、ctx 退出以及队列关闭
+func (x *MsgBus) popError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, diskq.ErrExiting):
+		return ErrMsgBusClosed
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case errors.Is(err, context.DeadlineExceeded):
+		return xmsgbus.ErrPopTimeout
+	}
+	return err
+}
+
+func (x *MsgBus) AddChannel(ctx context.Context, topic string, channel string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, err := x.queueLocked(topic, channel)
+	return err
+}
+
+// RemoveChannel 删除 channel 以及其中未消费的数据
+func (x *MsgBus) RemoveChannel(ctx context.Context, topic string, channel string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	q := x.topicSet[topic][channel]
+	if q == nil {
+		return nil
+	}
+	delete(x.topicSet[topic], channel)
+	if len(x.topicSet[topic]) == 0 {
+		delete(x.topicSet, topic)
+	}
+	err := q.Empty()
+	if err != nil {
+		return err
+	}
+	err = q.Delete()
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(x.channelDIR(topic, channel))
+	if err != nil {
+		return err
+	}
+	// topic 目录为空时一起删除，忽略非空的错误
+	_ = os.Remove(filepath.Join(x.opts.dataDIR, url.PathEscape(topic)))
+	return nil
+}
+
+func (x *MsgBus) ListChannel(ctx context.Context, topic string) ([]string, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	channels := make([]string, 0, len(x.topicSet[topic]))
+	for channel := range x.topicSet[topic] {
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+// Close 关闭所有 channel 并持久化元数据
+func (x *MsgBus) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return nil
+	}
+	x.closed = true
+	var errList []error
+	for _, channels := range x.topicSet {
+		for _, q := range channels {
+			if err := q.Close(); err != nil {
+				errList = append(errList, err)
+			}
+		}
+	}
+	if len(errList) > 0 {
+		return fmt.Errorf("close msgbus failed: %v", errList)
+	}
+	return nil
+}
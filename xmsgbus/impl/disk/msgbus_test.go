@@ -0,0 +1,135 @@
+package disk
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ccheers/xpkg/diskq"
+	"github.com/ccheers/xpkg/xmsgbus"
+)
+
+func newTestMsgBus(t *testing.T, dir string) *MsgBus {
+	msgbus, err := NewMsgBus(
+		WithMsgBusDataDIROption(dir),
+		WithMsgBusQueueOption(diskq.WithLogf(func(lvl diskq.LogLevel, f string, args ...interface{}) {})),
+	)
+	if err != nil {
+		t.Fatalf("NewMsgBus() error = %v", err)
+	}
+	return msgbus
+}
+
+func TestMsgBus_Restart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	const topic = "test/topic"
+
+	msgbus := newTestMsgBus(t, dir)
+	_ = msgbus.AddChannel(ctx, topic, "channel1")
+	_ = msgbus.AddChannel(ctx, topic, "channel2")
+	err := msgbus.PushBatch(ctx, topic, [][]byte{[]byte("0"), []byte("1"), []byte("2")})
+	if err != nil {
+		t.Fatalf("PushBatch() error = %v", err)
+	}
+	bs, ack, err := msgbus.Pop(ctx, topic, "channel1", time.Second)
+	if err != nil || string(bs) != "0" {
+		t.Fatalf("Pop() got = %s, err = %v", bs, err)
+	}
+	ack()
+	// 没有 ack 的数据重启后重新投递
+	bs, _, err = msgbus.Pop(ctx, topic, "channel2", time.Second)
+	if err != nil || string(bs) != "0" {
+		t.Fatalf("Pop() got = %s, err = %v", bs, err)
+	}
+	if err := msgbus.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// 重启后 channel 和未确认的数据都被恢复
+	msgbus = newTestMsgBus(t, dir)
+	defer msgbus.Close()
+	channels, _ := msgbus.ListChannel(ctx, topic)
+	sort.Strings(channels)
+	if !reflect.DeepEqual(channels, []string{"channel1", "channel2"}) {
+		t.Fatalf("ListChannel() got = %v", channels)
+	}
+	for channel, want := range map[string][]string{
+		"channel1": {"1", "2"},
+		"channel2": {"0", "1", "2"},
+	} {
+		bss, _, err := msgbus.PopBatch(ctx, topic, channel, 10, time.Second)
+		if err != nil {
+			t.Fatalf("PopBatch() error = %v", err)
+		}
+		var got []string
+		for _, bs := range bss {
+			got = append(got, string(bs))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("PopBatch(%s) got = %v, want %v", channel, got, want)
+		}
+	}
+	_, _, err = msgbus.Pop(ctx, topic, "channel1", time.Millisecond*10)
+	if err != xmsgbus.ErrPopTimeout {
+		t.Errorf("Pop() error = %v, want %v", err, xmsgbus.ErrPopTimeout)
+	}
+
+	if err := msgbus.RemoveChannel(ctx, topic, "channel2"); err != nil {
+		t.Fatalf("RemoveChannel() error = %v", err)
+	}
+	channels, _ = msgbus.ListChannel(ctx, topic)
+	if !reflect.DeepEqual(channels, []string{"channel1"}) {
+		t.Errorf("ListChannel() got = %v", channels)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStorage() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_ = storage.SetEx(ctx, "prefix:"+strconv.Itoa(i), i, time.Minute)
+	}
+	_ = storage.SetEx(ctx, "prefix:expired", 1, -time.Second)
+	_ = storage.SetEx(ctx, "other", 1, time.Minute)
+	_ = storage.Del(ctx, "prefix:2")
+
+	keys, err := storage.Keys(ctx, "prefix:")
+	if err != nil {
+		t.Fatalf("Keys() error = %v", err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"prefix:0", "prefix:1"}) {
+		t.Errorf("Keys() got = %v", keys)
+	}
+}
+
+func TestStorage_SetNX(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStorage() error = %v", err)
+	}
+	if ok, err := storage.SetNX(ctx, "key", 1, time.Minute); !ok || err != nil {
+		t.Fatalf("SetNX() = %v, %v, want true", ok, err)
+	}
+	if ok, err := storage.SetNX(ctx, "key", 1, time.Minute); ok || err != nil {
+		t.Fatalf("SetNX() = %v, %v, want false", ok, err)
+	}
+	if ok, err := storage.Exists(ctx, "key"); !ok || err != nil {
+		t.Fatalf("Exists() = %v, %v, want true", ok, err)
+	}
+	_ = storage.SetEx(ctx, "expired", 1, -time.Second)
+	if ok, err := storage.Exists(ctx, "expired"); ok || err != nil {
+		t.Fatalf("Exists() on expired key = %v, %v, want false", ok, err)
+	}
+	if ok, err := storage.SetNX(ctx, "expired", 1, time.Minute); !ok || err != nil {
+		t.Fatalf("SetNX() on expired key = %v, %v, want true", ok, err)
+	}
+}
@@ -0,0 +1,166 @@
+package disk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccheers/xpkg/xmsgbus"
+)
+
+// Storage 基于本地文件的 ISharedStorage，每个 key 对应目录中的一个文件，只在单机内共享
+type Storage struct {
+	mu  sync.Mutex
+	dir string
+}
+
+type storageNode struct {
+	Value     interface{}
+	ExpiredAt time.Time
+}
+
+func NewStorage(dir string) (xmsgbus.ISharedStorage, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{dir: dir}, nil
+}
+
+func (x *Storage) fileName(key string) string {
+	return filepath.Join(x.dir, url.PathEscape(key)+storageFileSuffix)
+}
+
+// SetEx 先写入临时文件再重命名，保证文件内容完整
+func (x *Storage) SetEx(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	bs, err := json.Marshal(&storageNode{
+		Value:     value,
+		ExpiredAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	fileName := x.fileName(key)
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err = os.WriteFile(tmpFileName, bs, 0o600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		_ = os.Remove(tmpFileName)
+		return err
+	}
+	return nil
+}
+
+// SetNX 先写入临时文件再硬链接到目标文件，目标文件存在时链接失败，多个进程之间同样是原子的
+// 目标文件已经过期时删除后重试一次，多个进程同时替换同一个过期文件时存在极小的竞争窗口
+func (x *Storage) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) (bool, error) {
+	bs, err := json.Marshal(&storageNode{
+		Value:     value,
+		ExpiredAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	fileName := x.fileName(key)
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err = os.WriteFile(tmpFileName, bs, 0o600)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpFileName)
+	for i := 0; i < 2; i++ {
+		err = os.Link(tmpFileName, fileName)
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+		if !x.expiredLocked(fileName) {
+			return false, nil
+		}
+		_ = os.Remove(fileName)
+	}
+	return false, nil
+}
+
+// expiredLocked 文件已经过期或者内容损坏
+func (x *Storage) expiredLocked(fileName string) bool {
+	bs, err := os.ReadFile(fileName)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	var node storageNode
+	return json.Unmarshal(bs, &node) != nil || node.ExpiredAt.Before(time.Now())
+}
+
+func (x *Storage) Exists(ctx context.Context, key string) (bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return !x.expiredLocked(x.fileName(key)), nil
+}
+
+// Keys 列出前缀匹配且未过期的 key，顺带删除已经过期的文件
+func (x *Storage) Keys(ctx context.Context, prefix string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entries, err := os.ReadDir(x.dir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var keys []string
+	for _, entry := range entries {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		name, ok := strings.CutSuffix(entry.Name(), storageFileSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		key, err := url.PathUnescape(name)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		fileName := filepath.Join(x.dir, entry.Name())
+		bs, err := os.ReadFile(fileName)
+		if err != nil {
+			continue
+		}
+		var node storageNode
+		if err := json.Unmarshal(bs, &node); err != nil || node.ExpiredAt.Before(now) {
+			_ = os.Remove(fileName)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (x *Storage) Del(ctx context.Context, key string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	err := os.Remove(x.fileName(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -5,4 +5,26 @@ import "time"
 const (
 	DefaultSessionTimeout = 10 * time.Second
 	DefaultGroupPrefix    = "xmsgbus"
+
+	// DelayTopicSuffix 延迟 topic 的后缀
+	DelayTopicSuffix = "_delay"
+	// DeliverAtHeader 延迟消息的投递时间（毫秒时间戳）
+	DeliverAtHeader = "xmsgbus-deliver-at"
+	// ReleaseAtHeader 延迟消息离开当前延迟档位的时间（毫秒时间戳）
+	ReleaseAtHeader = "xmsgbus-release-at"
 )
+
+// delayLevels 延迟档位，每个档位对应一个延迟 topic，档位内的消息等待相同的时长，
+// 因此先写入的消息总是先到期，不会阻塞后面的消息
+// 最大档位不超过延迟 topic 的保留时间
+var delayLevels = []time.Duration{
+	time.Second,
+	time.Second * 5,
+	time.Second * 10,
+	time.Second * 30,
+	time.Minute,
+	time.Minute * 5,
+	time.Minute * 10,
+	time.Minute * 30,
+	time.Hour,
+}
@@ -0,0 +1,162 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// PushAt 将消息写入延迟档位对应的延迟 topic，由中继消费者在档位时长到期后转投
+// 剩余延迟不小于档位时长的消息写入最大的档位，到期后按剩余延迟写入下一个档位，直到投递时间到达后转投到原 topic
+// 同一个档位内的消息等待相同的时长，长延迟的消息不会阻塞短延迟的消息
+func (x *MsgBus) PushAt(ctx context.Context, topic string, bs []byte, at time.Time) error {
+	if !at.After(time.Now()) {
+		return x.Push(ctx, topic, bs)
+	}
+
+	level := delayLevelOf(time.Until(at))
+	delayTopic := x.delayTopic(topic, level)
+	if err := x.ensureTopicExists(delayTopic); err != nil {
+		return fmt.Errorf("failed to ensure delay topic exists: %w", err)
+	}
+	if err := x.startDelayRelay(topic, delayTopic); err != nil {
+		return err
+	}
+
+	releaseAt := time.Now().Add(level)
+	if releaseAt.After(at) {
+		releaseAt = at
+	}
+	msg := &sarama.ProducerMessage{
+		Topic: delayTopic,
+		Value: sarama.ByteEncoder(bs),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(DeliverAtHeader), Value: []byte(strconv.FormatInt(at.UnixMilli(), 10))},
+			{Key: []byte(ReleaseAtHeader), Value: []byte(strconv.FormatInt(releaseAt.UnixMilli(), 10))},
+		},
+	}
+	_, _, err := x.producer.SendMessage(msg)
+	if err != nil {
+		return fmt.Errorf("failed to send message to delay topic %s: %w", delayTopic, err)
+	}
+	return nil
+}
+
+// delayLevelOf 返回不大于 delay 的最大档位，delay 小于最小档位时返回最小档位
+func delayLevelOf(delay time.Duration) time.Duration {
+	level := delayLevels[0]
+	for _, l := range delayLevels {
+		if l > delay {
+			break
+		}
+		level = l
+	}
+	return level
+}
+
+func (x *MsgBus) delayTopic(topic string, level time.Duration) string {
+	return topic + DelayTopicSuffix + "_" + strconv.FormatInt(int64(level/time.Second), 10)
+}
+
+// delayTopics 返回 topic 所有档位的延迟 topic，包括旧版本不分档位的延迟 topic
+func (x *MsgBus) delayTopics(topic string) []string {
+	topics := []string{topic + DelayTopicSuffix}
+	for _, level := range delayLevels {
+		topics = append(topics, x.delayTopic(topic, level))
+	}
+	return topics
+}
+
+// startDelayRelay 启动延迟 topic 的中继，同一个延迟 topic 只会启动一次
+// 创建消费组需要访问 kafka，在锁外进行
+func (x *MsgBus) startDelayRelay(topic, delayTopic string) error {
+	x.mu.RLock()
+	_, ok := x.relays[delayTopic]
+	x.mu.RUnlock()
+	if ok {
+		return nil
+	}
+
+	groupID := fmt.Sprintf("%s_delay_%s", x.opts.groupPrefix, delayTopic)
+	consumerGroup, err := sarama.NewConsumerGroup(x.opts.brokers, groupID, x.opts.config)
+	if err != nil {
+		return fmt.Errorf("failed to create delay consumer group: %w", err)
+	}
+
+	x.mu.Lock()
+	if _, ok := x.relays[delayTopic]; ok {
+		x.mu.Unlock()
+		return consumerGroup.Close()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	x.relays[delayTopic] = cancel
+	x.mu.Unlock()
+
+	go func() {
+		defer consumerGroup.Close()
+
+		handler := &delayRelayHandler{msgBus: x, topic: topic}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				if err := consumerGroup.Consume(ctx, []string{delayTopic}, handler); err != nil {
+					time.Sleep(time.Second)
+					continue
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+type delayRelayHandler struct {
+	msgBus *MsgBus
+	topic  string
+}
+
+func (h *delayRelayHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (h *delayRelayHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func (h *delayRelayHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for message := range claim.Messages() {
+		at := headerTime(message, DeliverAtHeader)
+		// 旧版本的消息没有档位，等待到投递时间
+		releaseAt := headerTime(message, ReleaseAtHeader)
+		if releaseAt.IsZero() {
+			releaseAt = at
+		}
+		if wait := time.Until(releaseAt); wait > 0 {
+			select {
+			case <-session.Context().Done():
+				// 未提交位点，重新分配后会再次转投
+				return nil
+			case <-time.After(wait):
+			}
+		}
+		// PushAt 在投递时间未到时写入下一个档位，否则直接转投到原 topic
+		if err := h.msgBus.PushAt(session.Context(), h.topic, message.Value, at); err != nil {
+			return err
+		}
+		session.MarkMessage(message, "")
+	}
+	return nil
+}
+
+func headerTime(message *sarama.ConsumerMessage, key string) time.Time {
+	for _, header := range message.Headers {
+		if string(header.Key) != key {
+			continue
+		}
+		ms, err := strconv.ParseInt(string(header.Value), 10, 64)
+		if err != nil {
+			break
+		}
+		return time.UnixMilli(ms)
+	}
+	return time.Time{}
+}
@@ -138,8 +138,15 @@ type MsgBus struct {
 	admin    sarama.ClusterAdmin
 	mu       sync.RWMutex
 	channels map[string]map[string]*Consumer
+	// relays 延迟 topic 中继
+	relays map[string]context.CancelFunc
 }
 
+var (
+	_ xmsgbus.IDelayMsgBus   = (*MsgBus)(nil)
+	_ xmsgbus.IOrderedMsgBus = (*MsgBus)(nil)
+)
+
 type Consumer struct {
 	consumerGroup sarama.ConsumerGroup
 	cancel        context.CancelFunc
@@ -170,6 +177,7 @@ func NewMsgBus(options ...IMsgBusOption) (xmsgbus.IMsgBus, error) {
 		producer: producer,
 		admin:    admin,
 		channels: make(map[string]map[string]*Consumer),
+		relays:   make(map[string]context.CancelFunc),
 	}, nil
 }
 
@@ -191,7 +199,36 @@ func (x *MsgBus) Push(ctx context.Context, topic string, bs []byte) error {
 	return nil
 }
 
+func (x *MsgBus) PushBatch(ctx context.Context, topic string, bss [][]byte) error {
+	if err := x.ensureTopicExists(topic); err != nil {
+		return fmt.Errorf("failed to ensure topic exists: %w", err)
+	}
+
+	msgs := make([]*sarama.ProducerMessage, 0, len(bss))
+	for _, bs := range bss {
+		msgs = append(msgs, &sarama.ProducerMessage{
+			Topic: topic,
+			Value: sarama.ByteEncoder(bs),
+		})
+	}
+
+	err := x.producer.SendMessages(msgs)
+	if err != nil {
+		return fmt.Errorf("failed to send messages to topic %s: %w", topic, err)
+	}
+
+	return nil
+}
+
 func (x *MsgBus) Pop(ctx context.Context, topic, channel string, blockTimeout time.Duration) ([]byte, func(), error) {
+	bss, ack, err := x.PopBatch(ctx, topic, channel, 1, blockTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bss[0], ack, nil
+}
+
+func (x *MsgBus) PopBatch(ctx context.Context, topic, channel string, max int, blockTimeout time.Duration) ([][]byte, func(), error) {
 	x.mu.RLock()
 	consumer := x.getConsumer(topic, channel)
 	x.mu.RUnlock()
@@ -200,39 +237,59 @@ func (x *MsgBus) Pop(ctx context.Context, topic, channel string, blockTimeout ti
 		return nil, nil, fmt.Errorf("consumer not found for topic %s, channel %s", topic, channel)
 	}
 
+	var timeout <-chan time.Time
 	if blockTimeout > 0 {
-		select {
-		case <-ctx.Done():
-			return nil, nil, ctx.Err()
-		case <-time.After(blockTimeout):
-			return nil, nil, xmsgbus.ErrPopTimeout
-		case msg := <-consumer.messageChan:
-			return msg.Value, func() {}, nil
-		}
+		timer := time.NewTimer(blockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
+	var bss [][]byte
 	select {
 	case <-ctx.Done():
 		return nil, nil, ctx.Err()
+	case <-timeout:
+		return nil, nil, xmsgbus.ErrPopTimeout
 	case msg := <-consumer.messageChan:
-		return msg.Value, func() {}, nil
+		bss = append(bss, msg.Value)
 	}
+	// 非阻塞地取出剩余数据
+	for len(bss) < max {
+		select {
+		case msg := <-consumer.messageChan:
+			bss = append(bss, msg.Value)
+		default:
+			return bss, func() {}, nil
+		}
+	}
+	return bss, func() {}, nil
 }
 
+// AddChannel 创建 channel 的消费组
+// 访问 kafka 的操作（检查 topic、创建消费组）都在锁外进行，不阻塞其他 Push/Pop
 func (x *MsgBus) AddChannel(ctx context.Context, topic string, channel string) error {
-	x.mu.Lock()
-	defer x.mu.Unlock()
+	x.mu.RLock()
+	consumer := x.getConsumer(topic, channel)
+	x.mu.RUnlock()
+	if consumer != nil {
+		return nil
+	}
 
 	if err := x.ensureTopicExists(topic); err != nil {
 		return fmt.Errorf("failed to ensure topic exists: %w", err)
 	}
-
-	if x.channels[topic] == nil {
-		x.channels[topic] = make(map[string]*Consumer)
+	// 进程重启后恢复已有延迟 topic 的中继
+	topics, err := x.admin.ListTopics()
+	if err != nil {
+		return fmt.Errorf("failed to list topics: %w", err)
 	}
-
-	if x.channels[topic][channel] != nil {
-		return nil
+	for _, delayTopic := range x.delayTopics(topic) {
+		if _, ok := topics[delayTopic]; !ok {
+			continue
+		}
+		if err := x.startDelayRelay(topic, delayTopic); err != nil {
+			return err
+		}
 	}
 
 	groupID := fmt.Sprintf("%s_%s_%s", x.opts.groupPrefix, topic, channel)
@@ -241,8 +298,19 @@ func (x *MsgBus) AddChannel(ctx context.Context, topic string, channel string) e
 		return fmt.Errorf("failed to create consumer group: %w", err)
 	}
 
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	// 并发添加了同一个 channel
+	if x.getConsumer(topic, channel) != nil {
+		return consumerGroup.Close()
+	}
+	if x.channels[topic] == nil {
+		x.channels[topic] = make(map[string]*Consumer)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	consumer := &Consumer{
+	consumer = &Consumer{
 		consumerGroup: consumerGroup,
 		cancel:        cancel,
 		messageChan:   make(chan *sarama.ConsumerMessage, 100),
@@ -335,6 +403,11 @@ func (x *MsgBus) Close() error {
 		delete(x.channels, topic)
 	}
 
+	for topic, cancel := range x.relays {
+		cancel()
+		delete(x.relays, topic)
+	}
+
 	if err := x.producer.Close(); err != nil {
 		errs = append(errs, fmt.Sprintf("producer close error: %v", err))
 	}
@@ -369,13 +442,22 @@ func (h *consumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession,
 	return nil
 }
 
-func (x *MsgBus) ensureTopicExists(topicName string) error {
+func (x *MsgBus) topicExists(topicName string) (bool, error) {
 	topics, err := x.admin.ListTopics()
 	if err != nil {
-		return fmt.Errorf("failed to list topics: %w", err)
+		return false, fmt.Errorf("failed to list topics: %w", err)
+	}
+	_, exists := topics[topicName]
+	return exists, nil
+}
+
+func (x *MsgBus) ensureTopicExists(topicName string) error {
+	exists, err := x.topicExists(topicName)
+	if err != nil {
+		return err
 	}
 
-	if _, exists := topics[topicName]; exists {
+	if exists {
 		return nil
 	}
 
@@ -164,3 +164,44 @@ func TestKafkaMsgBus_PopTimeout(t *testing.T) {
 		t.Errorf("expected timeout error, got %v", err)
 	}
 }
+
+func TestKafkaMsgBus_PushAt(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping kafka integration test in short mode")
+		return
+	}
+	msgBus, err := NewMsgBus(WithBrokers(kafkaEndpoints))
+	if err != nil {
+		t.Fatalf("failed to create msgbus: %v", err)
+	}
+	defer msgBus.(*MsgBus).Close()
+
+	ctx := context.Background()
+	topic := "test_topic_delay"
+	channel := "test_channel"
+	testData := []byte("delayed message")
+
+	err = msgBus.AddChannel(ctx, topic, channel)
+	if err != nil {
+		t.Fatalf("failed to add channel: %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	pushAt := time.Now()
+	err = msgBus.(xmsgbus.IDelayMsgBus).PushAt(ctx, topic, testData, pushAt.Add(3*time.Second))
+	if err != nil {
+		t.Fatalf("failed to push delayed message: %v", err)
+	}
+
+	data, _, err := msgBus.Pop(ctx, topic, channel, 15*time.Second)
+	if err != nil {
+		t.Fatalf("failed to pop delayed message: %v", err)
+	}
+	if string(data) != string(testData) {
+		t.Errorf("expected %s, got %s", testData, data)
+	}
+	if time.Since(pushAt) < 3*time.Second {
+		t.Errorf("delayed message delivered too early: %s", time.Since(pushAt))
+	}
+}
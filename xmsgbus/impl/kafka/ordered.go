@@ -0,0 +1,42 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Partitions 每个 channel 对应一个消费组，kafka 分区内的消息按顺序写入同一个消费队列，
+// 因此对 xmsgbus 而言只有一个有序分区，单个消费者依次处理即可保证 key 的顺序
+func (x *MsgBus) Partitions() int {
+	return 1
+}
+
+// PushWithKey 以 key 作为 kafka 的消息 key，相同 key 的消息会被写入同一个 kafka 分区
+func (x *MsgBus) PushWithKey(ctx context.Context, topic string, key string, bs []byte) error {
+	if err := x.ensureTopicExists(topic); err != nil {
+		return fmt.Errorf("failed to ensure topic exists: %w", err)
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(bs),
+	}
+
+	_, _, err := x.producer.SendMessage(msg)
+	if err != nil {
+		return fmt.Errorf("failed to send message to topic %s: %w", topic, err)
+	}
+
+	return nil
+}
+
+func (x *MsgBus) PopPartition(ctx context.Context, topic, channel string, partition int, blockTimeout time.Duration) ([]byte, func(), error) {
+	if partition != 0 {
+		return nil, nil, fmt.Errorf("partition %d out of range [0, 1)", partition)
+	}
+	return x.Pop(ctx, topic, channel, blockTimeout)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IBM/sarama"
@@ -15,6 +17,13 @@ type Storage struct {
 	admin    sarama.ClusterAdmin
 	brokers  []string
 	config   *sarama.Config
+
+	// index 在第一次 SetNX 时创建，为 SetNX 提供单点查询，避免每次都扫描整个 topic
+	indexOnce sync.Once
+	index     atomic.Pointer[storageIndex]
+	indexErr  error
+	// claimMu 保证同一进程内 SetNX 的查询与写入是原子的
+	claimMu sync.Mutex
 }
 
 func NewStorage(brokers []string, options ...IMsgBusOption) (xmsgbus.ISharedStorage, error) {
@@ -83,9 +92,59 @@ func (s *Storage) SetEx(ctx context.Context, key string, value interface{}, ttl
 		return fmt.Errorf("failed to send message: %w", err)
 	}
 
+	// 本进程的写入立即反映到索引中，不需要等待消费到这条记录
+	if index := s.index.Load(); index != nil {
+		index.set(key, expiredAt(ttl, time.Now()))
+	}
 	return nil
 }
 
+// SetNX key 不存在或者已经过期时设置，返回是否设置成功
+// kafka 没有条件写入，查询基于在内存中持续消费 storage topic 的索引：同一进程内是原子的，
+// 多个进程之间依赖索引追上其他进程的写入，极短时间内可能同时设置成功
+func (s *Storage) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) (bool, error) {
+	index, err := s.getIndex()
+	if err != nil {
+		return false, err
+	}
+
+	s.claimMu.Lock()
+	defer s.claimMu.Unlock()
+	if index.exists(key, time.Now()) {
+		return false, nil
+	}
+	if err := s.SetEx(ctx, key, value, ttl); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Exists 查询基于与 SetNX 相同的索引，其他进程的写入需要等待索引追上之后才可见
+func (s *Storage) Exists(ctx context.Context, key string) (bool, error) {
+	index, err := s.getIndex()
+	if err != nil {
+		return false, err
+	}
+	return index.exists(key, time.Now()), nil
+}
+
+func (s *Storage) getIndex() (*storageIndex, error) {
+	s.indexOnce.Do(func() {
+		topicName := "xmsgbus_storage"
+		if err := s.ensureTopicExists(topicName); err != nil {
+			s.indexErr = fmt.Errorf("failed to ensure topic exists: %w", err)
+			return
+		}
+		index, err := newStorageIndex(s.brokers, s.config, topicName)
+		if err != nil {
+			s.indexErr = fmt.Errorf("failed to create index: %w", err)
+			return
+		}
+		s.index.Store(index)
+	})
+	return s.index.Load(), s.indexErr
+}
+
 func (s *Storage) Keys(ctx context.Context, prefix string) ([]string, error) {
 	topicName := "xmsgbus_storage"
 
@@ -172,6 +231,9 @@ func (s *Storage) Del(ctx context.Context, key string) error {
 		return fmt.Errorf("failed to send delete message: %w", err)
 	}
 
+	if index := s.index.Load(); index != nil {
+		index.del(key)
+	}
 	return nil
 }
 
@@ -202,6 +264,12 @@ func (s *Storage) ensureTopicExists(topicName string) error {
 }
 
 func (s *Storage) isExpired(msg *sarama.ConsumerMessage, now time.Time) bool {
+	expireTime := messageExpiredAt(msg)
+	return !expireTime.IsZero() && now.After(expireTime)
+}
+
+// messageExpiredAt 记录的过期时间，零值表示不过期
+func messageExpiredAt(msg *sarama.ConsumerMessage) time.Time {
 	var ttlSeconds int64
 	var createdAt int64
 
@@ -215,16 +283,29 @@ func (s *Storage) isExpired(msg *sarama.ConsumerMessage, now time.Time) bool {
 	}
 
 	if ttlSeconds == 0 || createdAt == 0 {
-		return false
+		return time.Time{}
 	}
+	return time.Unix(createdAt, 0).Add(time.Duration(ttlSeconds) * time.Second)
+}
 
-	expireTime := time.Unix(createdAt, 0).Add(time.Duration(ttlSeconds) * time.Second)
-	return now.After(expireTime)
+// expiredAt 与 SetEx 写入的 header 保持一致，按秒截断
+func expiredAt(ttl time.Duration, now time.Time) time.Time {
+	ttlSeconds := int64(ttl.Seconds())
+	if ttlSeconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(now.Unix(), 0).Add(time.Duration(ttlSeconds) * time.Second)
 }
 
 func (s *Storage) Close() error {
 	var errs []string
 
+	if index := s.index.Load(); index != nil {
+		if err := index.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("index close error: %v", err))
+		}
+	}
+
 	if err := s.producer.Close(); err != nil {
 		errs = append(errs, fmt.Sprintf("producer close error: %v", err))
 	}
@@ -243,3 +324,141 @@ func (s *Storage) Close() error {
 func stringPtr(s string) *string {
 	return &s
 }
+
+// storageIndex 持续消费 storage topic，在内存中维护每个 key 最新记录的过期时间
+type storageIndex struct {
+	client             sarama.Client
+	consumer           sarama.Consumer
+	partitionConsumers []sarama.PartitionConsumer
+
+	mu        sync.Mutex
+	expiredAt map[string]time.Time
+	// gcAt 下一次清理过期记录的时间
+	gcAt time.Time
+}
+
+// storageIndexCatchUpTimeout 创建索引时等待消费到已有记录末尾的最长时间
+const storageIndexCatchUpTimeout = 5 * time.Second
+
+func newStorageIndex(brokers []string, config *sarama.Config, topicName string) (*storageIndex, error) {
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	index := &storageIndex{
+		client:    client,
+		consumer:  consumer,
+		expiredAt: make(map[string]time.Time),
+	}
+
+	partitions, err := consumer.Partitions(topicName)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	for _, partition := range partitions {
+		newest, err := client.GetOffset(topicName, partition, sarama.OffsetNewest)
+		if err != nil {
+			index.Close()
+			return nil, err
+		}
+		partitionConsumer, err := consumer.ConsumePartition(topicName, partition, sarama.OffsetOldest)
+		if err != nil {
+			index.Close()
+			return nil, err
+		}
+		index.partitionConsumers = append(index.partitionConsumers, partitionConsumer)
+		wg.Add(1)
+		go index.consume(partitionConsumer, newest, wg.Done)
+	}
+
+	caughtUp := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(caughtUp)
+	}()
+	select {
+	case <-caughtUp:
+	case <-time.After(storageIndexCatchUpTimeout):
+	}
+	return index, nil
+}
+
+// consume 消费到 newest 之前的记录后调用 caughtUp，随后继续消费新的记录直到 consumer 关闭
+func (x *storageIndex) consume(partitionConsumer sarama.PartitionConsumer, newest int64, caughtUp func()) {
+	var once sync.Once
+	defer once.Do(caughtUp)
+	if newest <= 0 {
+		once.Do(caughtUp)
+	}
+	go func() {
+		for range partitionConsumer.Errors() {
+		}
+	}()
+	for msg := range partitionConsumer.Messages() {
+		key := string(msg.Key)
+		if msg.Value == nil {
+			x.del(key)
+		} else {
+			x.set(key, messageExpiredAt(msg))
+		}
+		if msg.Offset >= newest-1 {
+			once.Do(caughtUp)
+		}
+	}
+}
+
+func (x *storageIndex) exists(key string, now time.Time) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	expiredAt, ok := x.expiredAt[key]
+	if !ok {
+		return false
+	}
+	if !expiredAt.IsZero() && now.After(expiredAt) {
+		delete(x.expiredAt, key)
+		return false
+	}
+	return true
+}
+
+func (x *storageIndex) set(key string, expiredAt time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.expiredAt[key] = expiredAt
+
+	now := time.Now()
+	if now.Before(x.gcAt) {
+		return
+	}
+	x.gcAt = now.Add(10 * time.Second)
+	for key, expiredAt := range x.expiredAt {
+		if !expiredAt.IsZero() && now.After(expiredAt) {
+			delete(x.expiredAt, key)
+		}
+	}
+}
+
+func (x *storageIndex) del(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.expiredAt, key)
+}
+
+func (x *storageIndex) Close() error {
+	// PartitionConsumer 关闭之后 Messages 随之关闭，consume 退出
+	for _, partitionConsumer := range x.partitionConsumers {
+		partitionConsumer.AsyncClose()
+	}
+	err := x.consumer.Close()
+	if cerr := x.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -1 +1,6 @@
 package memory
+
+const (
+	// DefaultPartitions 每个 channel 默认的有序分区数量
+	DefaultPartitions = 8
+)
@@ -0,0 +1,138 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/ccheers/xpkg/xlogger"
+)
+
+// delayRetryInterval 到期消息推入失败后重试的间隔
+const delayRetryInterval = time.Second
+
+type delayedMessage struct {
+	topic string
+	bs    []byte
+	at    time.Time
+	// channels 仍需推入的 channel，为空时推入 topic 下的所有 channel
+	channels []string
+}
+
+func lessDelayedMessage(a, b *delayedMessage) bool {
+	return a.at.Before(b.at)
+}
+
+// PushAt 将消息放入定时堆，到期后由 delayLoop 推入 topic 下的所有 channel
+// delayLoop 在第一次 PushAt 时启动，Close 时退出
+// 到期时 channel 已满的消息会重新放回定时堆，稍后只向这些 channel 重试
+func (x *MsgBus) PushAt(ctx context.Context, topic string, bs []byte, at time.Time) error {
+	if !at.After(time.Now()) {
+		return x.Push(ctx, topic, bs)
+	}
+	select {
+	case <-x.exitChan:
+		return ErrClosed
+	default:
+	}
+	x.delayOnce.Do(func() {
+		go x.delayLoop()
+	})
+
+	x.delayMu.Lock()
+	x.delayed.Push(&delayedMessage{
+		topic: topic,
+		bs:    bs,
+		at:    at,
+	})
+	x.delayMu.Unlock()
+
+	// 唤醒 delayLoop 重新计算下一次到期时间
+	select {
+	case x.delayWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (x *MsgBus) delayLoop() {
+	defer close(x.delayDone)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		now := time.Now()
+		wait := time.Hour
+		var dues []*delayedMessage
+
+		x.delayMu.Lock()
+		for {
+			msg, ok := x.delayed.Peek()
+			if !ok {
+				break
+			}
+			if msg.at.After(now) {
+				wait = msg.at.Sub(now)
+				break
+			}
+			x.delayed.Pop()
+			dues = append(dues, msg)
+		}
+		x.delayMu.Unlock()
+
+		for _, msg := range dues {
+			fullChans := x.pushDelayed(msg)
+			if len(fullChans) == 0 {
+				continue
+			}
+			_ = xlogger.DefaultLogger.Log(xlogger.LevelError,
+				"err", ErrChanIsFull,
+				"topic", msg.topic,
+				"channels", fullChans,
+				"module", "[MsgBus][memory][delayLoop]")
+			msg.channels = fullChans
+			msg.at = now.Add(delayRetryInterval)
+			x.delayMu.Lock()
+			x.delayed.Push(msg)
+			x.delayMu.Unlock()
+			if wait > delayRetryInterval {
+				wait = delayRetryInterval
+			}
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-x.delayWake:
+		case <-x.exitChan:
+			return
+		}
+	}
+}
+
+// pushDelayed 将到期消息推入 msg.channels 中仍然存在的 channel，返回已满的 channel
+func (x *MsgBus) pushDelayed(msg *delayedMessage) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	chans := x.topicSet[msg.topic]
+	names := msg.channels
+	if len(names) == 0 {
+		names = make([]string, 0, len(chans))
+		for chanName := range chans {
+			names = append(names, chanName)
+		}
+	}
+	var fullChans []string
+	for _, chanName := range names {
+		ch, ok := chans[chanName]
+		if !ok {
+			// channel 已被移除
+			continue
+		}
+		select {
+		case ch <- msg.bs:
+		default:
+			fullChans = append(fullChans, chanName)
+		}
+	}
+	return fullChans
+}
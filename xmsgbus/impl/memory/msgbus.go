@@ -6,17 +6,22 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ccheers/xpkg/generic/containerx/heap"
 	"github.com/ccheers/xpkg/xmsgbus"
 )
 
-var ErrChanIsFull = fmt.Errorf("channel is full")
+var (
+	ErrChanIsFull = fmt.Errorf("channel is full")
+	ErrClosed     = fmt.Errorf("msgbus closed")
+)
 
 type msgBusOptions struct {
-	maxBuffer int
+	maxBuffer  int
+	partitions int
 }
 
 func defaultMsgBusOptions() msgBusOptions {
-	return msgBusOptions{maxBuffer: 32}
+	return msgBusOptions{maxBuffer: 32, partitions: DefaultPartitions}
 }
 
 type IMsgBusOption interface {
@@ -35,34 +40,90 @@ func WithMsgBusMaxBufferOption(maxBuffer int) MsgBusOptionFunc {
 	}
 }
 
+// WithMsgBusPartitionsOption 每个 channel 的有序分区数量
+func WithMsgBusPartitionsOption(partitions int) MsgBusOptionFunc {
+	return func(options *msgBusOptions) {
+		options.partitions = partitions
+	}
+}
+
 type MsgBus struct {
 	opts     msgBusOptions
 	mu       sync.Mutex
 	topicSet map[string]map[string]chan []byte
+	// orderedSet 每个 channel 的有序分区，在第一次使用时创建
+	orderedSet map[string]map[string][]chan []byte
+
+	// 延迟消息
+	delayMu   sync.Mutex
+	delayed   *heap.Heap[*delayedMessage]
+	delayWake chan struct{}
+	delayOnce sync.Once
+	delayDone chan struct{}
+
+	exitOnce sync.Once
+	exitChan chan struct{}
 }
 
+var (
+	_ xmsgbus.IDelayMsgBus   = (*MsgBus)(nil)
+	_ xmsgbus.IOrderedMsgBus = (*MsgBus)(nil)
+)
+
 func NewMsgBus(options ...IMsgBusOption) xmsgbus.IMsgBus {
 	opts := defaultMsgBusOptions()
 	for _, opt := range options {
 		opt.apply(&opts)
 	}
+	if opts.partitions < 1 {
+		opts.partitions = 1
+	}
 	return &MsgBus{
 		opts:     opts,
 		mu:       sync.Mutex{},
 		topicSet: make(map[string]map[string]chan []byte),
+
+		orderedSet: make(map[string]map[string][]chan []byte),
+
+		delayed:   heap.New(lessDelayedMessage),
+		delayWake: make(chan struct{}, 1),
+		delayDone: make(chan struct{}),
+
+		exitChan: make(chan struct{}),
 	}
 }
 
+// Close 停止延迟消息的后台协程，尚未到期的延迟消息被丢弃，之后的 PushAt 返回 ErrClosed
+func (x *MsgBus) Close() error {
+	x.exitOnce.Do(func() {
+		close(x.exitChan)
+	})
+	x.delayOnce.Do(func() {
+		close(x.delayDone)
+	})
+	<-x.delayDone
+	return nil
+}
+
 func (x *MsgBus) Push(ctx context.Context, topic string, bs []byte) error {
+	return x.PushBatch(ctx, topic, [][]byte{bs})
+}
+
+// PushBatch 对每个 channel 原子地推入整批消息
+// 剩余容量不足以容纳整批消息的 channel 不会收到其中任何一条，其余 channel 照常推入，并返回 ErrChanIsFull
+func (x *MsgBus) PushBatch(ctx context.Context, topic string, bss [][]byte) error {
 	x.mu.Lock()
 	defer x.mu.Unlock()
 	var fullChans []string
 	for chanName, ch := range x.topicSet[topic] {
-		select {
-		case ch <- bs:
+		// 推入都在锁内进行，检查之后剩余容量只会因为消费而变大
+		if cap(ch)-len(ch) < len(bss) {
 			// 满时丢弃
-		default:
 			fullChans = append(fullChans, chanName)
+			continue
+		}
+		for _, bs := range bss {
+			ch <- bs
 		}
 	}
 	if len(fullChans) > 0 {
@@ -72,6 +133,14 @@ func (x *MsgBus) Push(ctx context.Context, topic string, bs []byte) error {
 }
 
 func (x *MsgBus) Pop(ctx context.Context, topic, channel string, blockTimeout time.Duration) ([]byte, func(), error) {
+	bss, ack, err := x.PopBatch(ctx, topic, channel, 1, blockTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bss[0], ack, nil
+}
+
+func (x *MsgBus) PopBatch(ctx context.Context, topic, channel string, max int, blockTimeout time.Duration) ([][]byte, func(), error) {
 	x.mu.Lock()
 	if x.topicSet[topic] == nil {
 		x.topicSet[topic] = make(map[string]chan []byte)
@@ -81,22 +150,32 @@ func (x *MsgBus) Pop(ctx context.Context, topic, channel string, blockTimeout ti
 	}
 	ch := x.topicSet[topic][channel]
 	x.mu.Unlock()
+
+	var timeout <-chan time.Time
 	if blockTimeout > 0 {
-		select {
-		case <-ctx.Done():
-			return nil, nil, ctx.Err()
-		case <-time.After(blockTimeout):
-			return nil, nil, xmsgbus.ErrPopTimeout
-		case bs := <-ch:
-			return bs, func() {}, nil
-		}
+		timer := time.NewTimer(blockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
+	var bss [][]byte
 	select {
 	case <-ctx.Done():
 		return nil, nil, ctx.Err()
+	case <-timeout:
+		return nil, nil, xmsgbus.ErrPopTimeout
 	case bs := <-ch:
-		return bs, func() {}, nil
+		bss = append(bss, bs)
+	}
+	// 非阻塞地取出剩余数据
+	for len(bss) < max {
+		select {
+		case bs := <-ch:
+			bss = append(bss, bs)
+		default:
+			return bss, func() {}, nil
+		}
 	}
+	return bss, func() {}, nil
 }
 
 func (x *MsgBus) AddChannel(ctx context.Context, topic string, channel string) error {
@@ -125,6 +204,10 @@ func (x *MsgBus) RemoveChannel(ctx context.Context, topic string, channel string
 	}
 	x.drainChain(ch)
 	delete(x.topicSet[topic], channel)
+	for _, ch := range x.orderedSet[topic][channel] {
+		x.drainChain(ch)
+	}
+	delete(x.orderedSet[topic], channel)
 	return nil
 }
 
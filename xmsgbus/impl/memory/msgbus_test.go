@@ -2,9 +2,12 @@ package memory
 
 import (
 	"context"
+	"errors"
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/ccheers/xpkg/xmsgbus"
 )
 
 func BenchmarkMsgbus(b *testing.B) {
@@ -46,3 +49,162 @@ func BenchmarkMsgbus(b *testing.B) {
 		msgbus.RemoveChannel(ctx, topic, topic+strconv.Itoa(i))
 	}
 }
+
+func TestMsgBus_PushAt(t *testing.T) {
+	ctx := context.Background()
+	msgbus := NewMsgBus().(*MsgBus)
+	defer msgbus.Close()
+	const (
+		topic   = "test"
+		channel = "channel"
+	)
+	_ = msgbus.AddChannel(ctx, topic, channel)
+
+	now := time.Now()
+	_ = msgbus.PushAt(ctx, topic, []byte("2"), now.Add(time.Millisecond*200))
+	_ = msgbus.PushAt(ctx, topic, []byte("1"), now.Add(time.Millisecond*100))
+	_ = msgbus.PushAt(ctx, topic, []byte("0"), now.Add(-time.Second))
+
+	for i := 0; i < 3; i++ {
+		bs, _, err := msgbus.Pop(ctx, topic, channel, time.Second)
+		if err != nil {
+			t.Fatalf("Pop() error = %v", err)
+		}
+		if string(bs) != strconv.Itoa(i) {
+			t.Errorf("Pop() got = %s, want %d", bs, i)
+		}
+	}
+	if time.Since(now) < time.Millisecond*200 {
+		t.Errorf("delayed message delivered too early: %s", time.Since(now))
+	}
+
+	_ = msgbus.Close()
+	if err := msgbus.PushAt(ctx, topic, []byte("3"), time.Now().Add(time.Second)); err != ErrClosed {
+		t.Errorf("PushAt() after Close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestMsgBus_PopBatch(t *testing.T) {
+	ctx := context.Background()
+	msgbus := NewMsgBus()
+	const (
+		topic   = "test"
+		channel = "channel"
+	)
+	_ = msgbus.AddChannel(ctx, topic, channel)
+
+	err := msgbus.PushBatch(ctx, topic, [][]byte{[]byte("0"), []byte("1"), []byte("2")})
+	if err != nil {
+		t.Fatalf("PushBatch() error = %v", err)
+	}
+
+	bss, _, err := msgbus.PopBatch(ctx, topic, channel, 2, time.Second)
+	if err != nil {
+		t.Fatalf("PopBatch() error = %v", err)
+	}
+	if len(bss) != 2 || string(bss[0]) != "0" || string(bss[1]) != "1" {
+		t.Errorf("PopBatch() got = %q", bss)
+	}
+	bss, _, err = msgbus.PopBatch(ctx, topic, channel, 2, time.Second)
+	if err != nil {
+		t.Fatalf("PopBatch() error = %v", err)
+	}
+	if len(bss) != 1 || string(bss[0]) != "2" {
+		t.Errorf("PopBatch() got = %q", bss)
+	}
+	_, _, err = msgbus.PopBatch(ctx, topic, channel, 2, time.Millisecond*10)
+	if err != xmsgbus.ErrPopTimeout {
+		t.Errorf("PopBatch() error = %v, want %v", err, xmsgbus.ErrPopTimeout)
+	}
+}
+
+func TestMsgBus_PushBatchFull(t *testing.T) {
+	ctx := context.Background()
+	msgbus := NewMsgBus(WithMsgBusMaxBufferOption(2))
+	const (
+		topic   = "test"
+		channel = "channel"
+	)
+	_ = msgbus.AddChannel(ctx, topic, channel)
+
+	_ = msgbus.Push(ctx, topic, []byte("0"))
+	err := msgbus.PushBatch(ctx, topic, [][]byte{[]byte("1"), []byte("2")})
+	if !errors.Is(err, ErrChanIsFull) {
+		t.Fatalf("PushBatch() error = %v, want %v", err, ErrChanIsFull)
+	}
+	// 放不下的批次整个被丢弃
+	bss, _, err := msgbus.PopBatch(ctx, topic, channel, 2, time.Second)
+	if err != nil {
+		t.Fatalf("PopBatch() error = %v", err)
+	}
+	if len(bss) != 1 || string(bss[0]) != "0" {
+		t.Errorf("PopBatch() got = %q", bss)
+	}
+}
+
+func TestMsgBus_PopPartition(t *testing.T) {
+	ctx := context.Background()
+	msgbus := NewMsgBus(WithMsgBusPartitionsOption(4)).(*MsgBus)
+	const (
+		topic   = "test"
+		channel = "channel"
+	)
+	_ = msgbus.AddChannel(ctx, topic, channel)
+
+	for i := 0; i < 3; i++ {
+		if err := msgbus.PushWithKey(ctx, topic, "key", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("PushWithKey() error = %v", err)
+		}
+	}
+
+	partition := xmsgbus.PartitionOf("key", msgbus.Partitions())
+	other := (partition + 1) % msgbus.Partitions()
+	_, _, err := msgbus.PopPartition(ctx, topic, channel, other, time.Millisecond*10)
+	if err != xmsgbus.ErrPopTimeout {
+		t.Errorf("PopPartition() error = %v, want %v", err, xmsgbus.ErrPopTimeout)
+	}
+	for i := 0; i < 3; i++ {
+		bs, _, err := msgbus.PopPartition(ctx, topic, channel, partition, time.Second)
+		if err != nil {
+			t.Fatalf("PopPartition() error = %v", err)
+		}
+		if string(bs) != strconv.Itoa(i) {
+			t.Errorf("PopPartition() got = %s, want %d", bs, i)
+		}
+	}
+}
+
+func TestMsgBus_PushAtChannelFull(t *testing.T) {
+	ctx := context.Background()
+	msgbus := NewMsgBus(WithMsgBusMaxBufferOption(1)).(*MsgBus)
+	defer msgbus.Close()
+	const topic = "test"
+	_ = msgbus.AddChannel(ctx, topic, "a")
+	_ = msgbus.AddChannel(ctx, topic, "b")
+
+	// 占满两个 channel，再清空 a，到期时只有 b 是满的
+	_ = msgbus.Push(ctx, topic, []byte("0"))
+	if _, _, err := msgbus.Pop(ctx, topic, "a", time.Second); err != nil {
+		t.Fatalf("Pop() error = %v", err)
+	}
+	_ = msgbus.PushAt(ctx, topic, []byte("1"), time.Now().Add(time.Millisecond*50))
+	time.Sleep(time.Millisecond * 200)
+
+	for _, want := range []string{"0", "1"} {
+		bs, _, err := msgbus.Pop(ctx, topic, "b", delayRetryInterval*3)
+		if err != nil {
+			t.Fatalf("Pop() error = %v", err)
+		}
+		if string(bs) != want {
+			t.Errorf("Pop() got = %s, want %s", bs, want)
+		}
+	}
+	bs, _, err := msgbus.Pop(ctx, topic, "a", time.Second)
+	if err != nil || string(bs) != "1" {
+		t.Fatalf("Pop() got = %s, %v, want 1", bs, err)
+	}
+	// 重试只推入之前已满的 channel
+	if _, _, err := msgbus.Pop(ctx, topic, "a", delayRetryInterval*2); err != xmsgbus.ErrPopTimeout {
+		t.Errorf("Pop() error = %v, want %v", err, xmsgbus.ErrPopTimeout)
+	}
+}
@@ -0,0 +1,78 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ccheers/xpkg/xmsgbus"
+)
+
+func (x *MsgBus) Partitions() int {
+	return x.opts.partitions
+}
+
+// PushWithKey 将数据推入 topic 下每个 channel 中 key 对应的分区
+func (x *MsgBus) PushWithKey(ctx context.Context, topic string, key string, bs []byte) error {
+	partition := xmsgbus.PartitionOf(key, x.opts.partitions)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var fullChans []string
+	for chanName := range x.topicSet[topic] {
+		select {
+		case x.partitionsLocked(topic, chanName)[partition] <- bs:
+			// 满时丢弃
+		default:
+			fullChans = append(fullChans, chanName)
+		}
+	}
+	if len(fullChans) > 0 {
+		return fmt.Errorf("%w: channels=%+v", ErrChanIsFull, fullChans)
+	}
+	return nil
+}
+
+func (x *MsgBus) PopPartition(ctx context.Context, topic, channel string, partition int, blockTimeout time.Duration) ([]byte, func(), error) {
+	if partition < 0 || partition >= x.opts.partitions {
+		return nil, nil, fmt.Errorf("partition %d out of range [0, %d)", partition, x.opts.partitions)
+	}
+	x.mu.Lock()
+	if x.topicSet[topic] == nil {
+		x.topicSet[topic] = make(map[string]chan []byte)
+	}
+	if x.topicSet[topic][channel] == nil {
+		x.topicSet[topic][channel] = make(chan []byte, x.opts.maxBuffer)
+	}
+	ch := x.partitionsLocked(topic, channel)[partition]
+	x.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if blockTimeout > 0 {
+		timer := time.NewTimer(blockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-timeout:
+		return nil, nil, xmsgbus.ErrPopTimeout
+	case bs := <-ch:
+		return bs, func() {}, nil
+	}
+}
+
+func (x *MsgBus) partitionsLocked(topic, channel string) []chan []byte {
+	if x.orderedSet[topic] == nil {
+		x.orderedSet[topic] = make(map[string][]chan []byte)
+	}
+	if x.orderedSet[topic][channel] == nil {
+		chans := make([]chan []byte, x.opts.partitions)
+		for i := range chans {
+			chans[i] = make(chan []byte, x.opts.maxBuffer)
+		}
+		x.orderedSet[topic][channel] = chans
+	}
+	return x.orderedSet[topic][channel]
+}
@@ -41,6 +41,29 @@ func (x *Storage) SetEx(ctx context.Context, key string, value interface{}, ttl
 	return nil
 }
 
+func (x *Storage) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) (bool, error) {
+	defer x.gcTick()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	now := time.Now()
+	if node, ok := x.mm[key]; ok && !node.expiredAt.Before(now) {
+		return false, nil
+	}
+	x.mm[key] = &node{
+		value:     value,
+		expiredAt: now.Add(ttl),
+	}
+	return true, nil
+}
+
+func (x *Storage) Exists(ctx context.Context, key string) (bool, error) {
+	defer x.gcTick()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, ok := x.mm[key]
+	return ok && !node.expiredAt.Before(time.Now()), nil
+}
+
 func (x *Storage) Keys(ctx context.Context, prefix string) ([]string, error) {
 	defer x.gcTick()
 	x.mu.Lock()
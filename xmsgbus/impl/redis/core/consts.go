@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 )
 
@@ -15,6 +16,36 @@ func msgBusListKey(topic string, channel string) string {
 	return "hmsgbus:list:v3:" + topic + ":" + channel
 }
 
+// 有序分区队列 key
+func msgBusPartitionListKey(topic string, channel string, partition int) string {
+	return msgBusListKey(topic, channel) + ":p" + strconv.Itoa(partition)
+}
+
+// 有序分区的消费租约 key，保证同一时间每个分区只有一个实例在消费
+func msgBusPartitionLeaseKey(topic string, channel string, partition int) string {
+	return "hmsgbus:nx:v3:partition:" + topic + ":" + channel + ":" + strconv.Itoa(partition)
+}
+
+// stream 模式下的 channel 集合 key
+func msgBusStreamSetKey(topic string) string {
+	return "hmsgbus:set:v3:stream:" + topic
+}
+
+// stream 模式下 topic 对应的 stream key，每个 channel 对应一个消费组
+func msgBusStreamKey(topic string) string {
+	return "hmsgbus:stream:v3:" + topic
+}
+
+// 延迟消息有序集合 key
+func msgBusDelayKey(topic string) string {
+	return "hmsgbus:zset:v3:delay:" + topic
+}
+
+// 存在延迟消息的 topic 集合 key
+func msgBusDelayTopicSetKey() string {
+	return "hmsgbus:set:v3:delay_topics"
+}
+
 // Ack key
 func msgBusAckKeyPrefix(tm time.Time) string {
 	const (
@@ -35,4 +66,19 @@ func msgBusMonitorKey() string {
 
 const (
 	tenMinute = time.Minute * 10
+
+	// delayBatchSize 每次从延迟集合中搬运的最大消息数
+	delayBatchSize = 128
+
+	// DefaultPartitions 每个 channel 默认的有序分区数量
+	DefaultPartitions = 8
+	// partitionLeaseTTL 有序分区租约的有效期，消费者持续消费以及处理消息期间会自动续期
+	partitionLeaseTTL = time.Second * 30
+
+	// streamDataField stream 消息中存放数据的字段
+	streamDataField = "data"
+	// defaultStreamMaxLen stream 默认的近似最大长度
+	defaultStreamMaxLen = 100000
+	// defaultStreamClaimIdle 待确认消息空闲多久后被其他消费者认领
+	defaultStreamClaimIdle = time.Minute * 3
 )
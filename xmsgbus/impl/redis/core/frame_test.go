@@ -0,0 +1,269 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccheers/xpkg/xmsgbus"
+)
+
+// fakeRedisClient 只实现 PushAt、延迟搬运、Pop 以及 monitor 用到的命令，不依赖 redis 服务
+type fakeRedisClient struct {
+	IRedisClient
+
+	mu    sync.Mutex
+	sets  map[string]map[string]struct{}
+	lists map[string][]string
+	zsets map[string]map[string]float64
+	kvs   map[string][]byte
+}
+
+func newFakeRedisClient() *fakeRedisClient {
+	return &fakeRedisClient{
+		sets:  make(map[string]map[string]struct{}),
+		lists: make(map[string][]string),
+		zsets: make(map[string]map[string]float64),
+		kvs:   make(map[string][]byte),
+	}
+}
+
+func (x *fakeRedisClient) SAdd(ctx context.Context, key string, members ...interface{}) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.sets[key] == nil {
+		x.sets[key] = make(map[string]struct{})
+	}
+	for _, member := range members {
+		x.sets[key][member.(string)] = struct{}{}
+	}
+	return nil
+}
+
+func (x *fakeRedisClient) SMembers(ctx context.Context, key string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	members := make([]string, 0, len(x.sets[key]))
+	for member := range x.sets[key] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (x *fakeRedisClient) SRemIfZEmpty(ctx context.Context, setKey string, member string, zsetKey string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.zsets[zsetKey]) == 0 {
+		delete(x.sets[setKey], member)
+	}
+	return nil
+}
+
+func (x *fakeRedisClient) Get(ctx context.Context, key string) ([]byte, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	bs, ok := x.kvs[key]
+	if !ok {
+		return nil, errors.New("redis: nil")
+	}
+	return bs, nil
+}
+
+func (x *fakeRedisClient) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.kvs[key]; ok {
+		return false, nil
+	}
+	x.kvs[key] = []byte("1")
+	return true, nil
+}
+
+func (x *fakeRedisClient) SetEXBatch(ctx context.Context, values map[string]interface{}, expiration time.Duration) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key, value := range values {
+		x.kvs[key] = value.([]byte)
+	}
+	return nil
+}
+
+func (x *fakeRedisClient) Keys(ctx context.Context, pattern string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	prefix := strings.TrimSuffix(pattern, "*")
+	var keys []string
+	for key := range x.kvs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (x *fakeRedisClient) Del(ctx context.Context, keys ...string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, key := range keys {
+		delete(x.kvs, key)
+		delete(x.lists, key)
+	}
+	return nil
+}
+
+func (x *fakeRedisClient) BLPop(ctx context.Context, timeout time.Duration, keys ...string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, key := range keys {
+		if len(x.lists[key]) > 0 {
+			value := x.lists[key][0]
+			x.lists[key] = x.lists[key][1:]
+			return []string{key, value}, nil
+		}
+	}
+	return nil, xmsgbus.ErrPopTimeout
+}
+
+func (x *fakeRedisClient) LPopN(ctx context.Context, key string, n int) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if n > len(x.lists[key]) {
+		n = len(x.lists[key])
+	}
+	values := x.lists[key][:n:n]
+	x.lists[key] = x.lists[key][n:]
+	return values, nil
+}
+
+func (x *fakeRedisClient) RPushAndExpire(ctx context.Context, key string, value string, ttl time.Duration) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.lists[key] = append(x.lists[key], value)
+	return nil
+}
+
+func (x *fakeRedisClient) LPushAndExpire(ctx context.Context, key string, value string, ttl time.Duration) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.lists[key] = append([]string{value}, x.lists[key]...)
+	return nil
+}
+
+func (x *fakeRedisClient) ZAdd(ctx context.Context, key string, score float64, member string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.zsets[key] == nil {
+		x.zsets[key] = make(map[string]float64)
+	}
+	x.zsets[key][member] = score
+	return nil
+}
+
+func (x *fakeRedisClient) ZRangeByScore(ctx context.Context, key string, min, max string, count int64) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	maxScore, err := strconv.ParseFloat(max, 64)
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for member, score := range x.zsets[key] {
+		if score <= maxScore {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return x.zsets[key][members[i]] < x.zsets[key][members[j]]
+	})
+	if int64(len(members)) > count {
+		members = members[:count]
+	}
+	return members, nil
+}
+
+func (x *fakeRedisClient) ZRem(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var n int64
+	for _, member := range members {
+		if _, ok := x.zsets[key][member.(string)]; ok {
+			delete(x.zsets[key], member.(string))
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ageAckKeys 把确认 key 改写到 monitor 扫描的时间段，模拟消费者取出消息后没有确认
+func (x *fakeRedisClient) ageAckKeys(tm time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	const ackKeyPrefix = "hmsgbus:hash:v3:ack:"
+	for key, value := range x.kvs {
+		if !strings.HasPrefix(key, ackKeyPrefix) {
+			continue
+		}
+		delete(x.kvs, key)
+		x.kvs[msgBusAckKey(tm, key[strings.LastIndexByte(key, ':')+1:])] = value
+	}
+}
+
+func TestMsgBus_EventFrame(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeRedisClient()
+	x := &MsgBus{client: client}
+	const (
+		topic   = "test"
+		channel = "channel"
+	)
+	_ = x.AddChannel(ctx, topic, channel)
+
+	// 二进制帧以 0xEB 开头，消息体不是合法的 UTF-8，作为 JSON 字符串保存会被改写
+	event := &xmsgbus.Event{
+		ID:      "id",
+		Topic:   topic,
+		Payload: []byte{0xff, 0xfe, 0x00, 0x80},
+	}
+	frame, err := xmsgbus.EncodeEventFrame(event)
+	if err != nil {
+		t.Fatalf("EncodeEventFrame() error = %v", err)
+	}
+	assertFrame := func(bs []byte) {
+		t.Helper()
+		got, err := xmsgbus.DecodeEvent(bs)
+		if err != nil {
+			t.Fatalf("DecodeEvent() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, event) {
+			t.Errorf("DecodeEvent() got = %+v, want %+v", got, event)
+		}
+	}
+
+	// 延迟消息经过延迟集合搬运
+	if err := x.PushAt(ctx, topic, frame, time.Now().Add(time.Millisecond*10)); err != nil {
+		t.Fatalf("PushAt() error = %v", err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	x.moveDelayed(ctx)
+	bs, _, err := x.Pop(ctx, topic, channel, time.Second)
+	if err != nil {
+		t.Fatalf("Pop() error = %v", err)
+	}
+	assertFrame(bs)
+
+	// 未确认的消息经过确认数据由 monitor 重新推入
+	client.ageAckKeys(time.Now().Add(-time.Minute * 2))
+	x.monitor(ctx)
+	bs, ack, err := x.Pop(ctx, topic, channel, time.Second)
+	if err != nil {
+		t.Fatalf("Pop() after monitor error = %v", err)
+	}
+	ack()
+	assertFrame(bs)
+}
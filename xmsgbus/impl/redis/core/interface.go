@@ -8,6 +8,12 @@ import (
 
 var ErrRPushAndExpire = fmt.Errorf("RPushAndExpire failed")
 
+// XMessage stream 中的一条消息
+type XMessage struct {
+	ID     string
+	Values map[string]interface{}
+}
+
 type IRedisClient interface {
 	SAdd(ctx context.Context, key string, members ...interface{}) error
 	SMembers(ctx context.Context, key string) ([]string, error)
@@ -26,4 +32,33 @@ type IRedisClient interface {
 	BLPop(ctx context.Context, timeout time.Duration, keys ...string) ([]string, error)
 
 	RPushAndExpire(ctx context.Context, key string, value string, ttl time.Duration) error
+	// LPushAndExpire 推入队首并设置过期时间
+	LPushAndExpire(ctx context.Context, key string, value string, ttl time.Duration) error
+	// RPushBatchAndExpire 通过 pipeline 批量推入并设置过期时间
+	RPushBatchAndExpire(ctx context.Context, key string, values []string, ttl time.Duration) error
+	// LPopN 通过 LPOP key count 最多弹出 n 个元素，需要 Redis 6.2 及以上版本
+	LPopN(ctx context.Context, key string, n int) ([]string, error)
+	// SetEXBatch 通过 pipeline 批量设置值以及过期时间
+	SetEXBatch(ctx context.Context, values map[string]interface{}, expiration time.Duration) error
+
+	ZAdd(ctx context.Context, key string, score float64, member string) error
+	// ZRangeByScore 按分数从小到大返回 [min, max] 区间内最多 count 个成员
+	ZRangeByScore(ctx context.Context, key string, min, max string, count int64) ([]string, error)
+	// ZRem 返回实际删除的成员个数
+	ZRem(ctx context.Context, key string, members ...interface{}) (int64, error)
+	// SRemIfZEmpty 有序集合 zsetKey 为空时从集合 setKey 中删除 member，检查与删除是原子的
+	SRemIfZEmpty(ctx context.Context, setKey string, member string, zsetKey string) error
+
+	// XAdd 追加消息到 stream，maxLen 大于 0 时按 MAXLEN ~ maxLen 近似裁剪
+	XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) (string, error)
+	// XAddBatch 通过 pipeline 批量追加消息
+	XAddBatch(ctx context.Context, stream string, maxLen int64, values []map[string]interface{}) error
+	// XGroupCreateMkStream 创建消费组，stream 不存在时一并创建
+	XGroupCreateMkStream(ctx context.Context, stream, group, start string) error
+	XGroupDestroy(ctx context.Context, stream, group string) error
+	// XReadGroup 以消费组的身份读取新消息，block 为 0 则永久阻塞
+	XReadGroup(ctx context.Context, group, consumer, stream string, count int64, block time.Duration) ([]XMessage, error)
+	XAck(ctx context.Context, stream, group string, ids ...string) error
+	// XAutoClaim 认领空闲时间超过 minIdle 的待确认消息，返回消息以及下一次扫描的起点
+	XAutoClaim(ctx context.Context, stream, group, consumer string, minIdle time.Duration, start string, count int64) ([]XMessage, string, error)
 }
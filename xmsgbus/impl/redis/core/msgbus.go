@@ -7,28 +7,91 @@ import (
 	"encoding/json"
 	"fmt"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ccheers/xpkg/generic/arrayx"
 	"github.com/ccheers/xpkg/xmsgbus"
+	"github.com/google/uuid"
 )
 
 type AckData struct {
 	ListKey string
-	Data    string
+	// Data 以 []byte 保存，JSON 中编码为 base64，二进制消息不会被改写
+	Data []byte
+}
+
+type DelayData struct {
+	// ID 保证相同内容的延迟消息在有序集合中不会被合并
+	ID string
+	// Data 以 []byte 保存，JSON 中编码为 base64，二进制消息不会被改写
+	Data []byte
+}
+
+type msgBusOptions struct {
+	partitions int
+}
+
+func defaultMsgBusOptions() msgBusOptions {
+	return msgBusOptions{
+		partitions: DefaultPartitions,
+	}
+}
+
+type IMsgBusOption interface {
+	apply(*msgBusOptions)
+}
+
+type MsgBusOptionFunc func(*msgBusOptions)
+
+func (fn MsgBusOptionFunc) apply(options *msgBusOptions) {
+	fn(options)
+}
+
+// WithPartitions 每个 channel 的有序分区数量
+func WithPartitions(partitions int) MsgBusOptionFunc {
+	return func(options *msgBusOptions) {
+		options.partitions = partitions
+	}
 }
 
 type MsgBus struct {
+	opts   msgBusOptions
 	client IRedisClient
+	// id 实例标识，用于持有有序分区的租约
+	id string
 }
 
-func NewMsgBus(client IRedisClient) xmsgbus.IMsgBus {
-	x := &MsgBus{client: client}
+var (
+	_ xmsgbus.IDelayMsgBus   = (*MsgBus)(nil)
+	_ xmsgbus.IOrderedMsgBus = (*MsgBus)(nil)
+)
+
+func NewMsgBus(client IRedisClient, options ...IMsgBusOption) xmsgbus.IMsgBus {
+	opts := defaultMsgBusOptions()
+	for _, opt := range options {
+		opt.apply(&opts)
+	}
+	if opts.partitions < 1 {
+		opts.partitions = 1
+	}
+	x := &MsgBus{
+		opts:   opts,
+		client: client,
+		id:     uuid.New().String(),
+	}
 	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		var monitorAt time.Time
 		for {
-			x.monitor(context.Background())
-			time.Sleep(time.Minute)
+			x.moveDelayed(context.Background())
+			if time.Since(monitorAt) >= time.Minute {
+				x.monitor(context.Background())
+				monitorAt = time.Now()
+			}
+			<-ticker.C
 		}
 	}()
 	return x
@@ -56,8 +119,61 @@ func (x *MsgBus) Push(ctx context.Context, topic string, bs []byte) error {
 	return nil
 }
 
+// PushAt 将数据暂存到 topic 的延迟有序集合中，到期后由后台协程搬运到各 channel 的队列
+func (x *MsgBus) PushAt(ctx context.Context, topic string, bs []byte, at time.Time) error {
+	if !at.After(time.Now()) {
+		return x.Push(ctx, topic, bs)
+	}
+	member, _ := json.Marshal(DelayData{
+		ID:   uuid.New().String(),
+		Data: bs,
+	})
+	err := x.client.ZAdd(ctx, msgBusDelayKey(topic), float64(at.UnixMilli()), string(member))
+	if err != nil {
+		return err
+	}
+	return x.client.SAdd(ctx, msgBusDelayTopicSetKey(), topic)
+}
+
+func (x *MsgBus) PushBatch(ctx context.Context, topic string, bss [][]byte) error {
+	channels, err := x.ListChannel(ctx, topic)
+	if err != nil {
+		return err
+	}
+	values := make([]string, 0, len(bss))
+	for _, bs := range bss {
+		values = append(values, string(bs))
+	}
+	var errList []error
+	for _, channel := range channels {
+		key := msgBusListKey(topic, channel)
+		err = x.client.RPushBatchAndExpire(ctx, key, values, tenMinute)
+		if err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if len(errList) > 0 {
+		err := fmt.Errorf("publish to %s failed: %v", topic, strings.Join(arrayx.Map(errList, func(err error) string {
+			return err.Error()
+		}), ". "))
+		return err
+	}
+	return nil
+}
+
 func (x *MsgBus) Pop(ctx context.Context, topic, channel string, blockTimeout time.Duration) ([]byte, func(), error) {
-	listKey := msgBusListKey(topic, channel)
+	bss, ack, err := x.PopBatch(ctx, topic, channel, 1, blockTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bss[0], ack, nil
+}
+
+func (x *MsgBus) PopBatch(ctx context.Context, topic, channel string, max int, blockTimeout time.Duration) ([][]byte, func(), error) {
+	return x.popList(ctx, msgBusListKey(topic, channel), max, blockTimeout)
+}
+
+func (x *MsgBus) popList(ctx context.Context, listKey string, max int, blockTimeout time.Duration) ([][]byte, func(), error) {
 	strs, err := x.client.BLPop(ctx, blockTimeout, listKey)
 	if err != nil {
 		return nil, nil, err
@@ -65,15 +181,37 @@ func (x *MsgBus) Pop(ctx context.Context, topic, channel string, blockTimeout ti
 	if len(strs) < 1 {
 		return nil, nil, xmsgbus.ErrNoData
 	}
-	md5Bs := md5.Sum([]byte(strs[1]))
-	ackKey := msgBusAckKey(time.Now(), hex.EncodeToString(md5Bs[:]))
-	bs, _ := json.Marshal(AckData{
-		ListKey: listKey,
-		Data:    strs[1],
-	})
-	x.client.Set(ctx, ackKey, bs, time.Minute*3)
-	return []byte(strs[1]), func() {
-		x.client.Del(ctx, ackKey)
+	values := strs[1:2]
+	if max > 1 {
+		rest, err := x.client.LPopN(ctx, listKey, max-1)
+		if err == nil {
+			values = append(values, rest...)
+		}
+	}
+
+	now := time.Now()
+	bss := make([][]byte, 0, len(values))
+	ackData := make(map[string]interface{}, len(values))
+	for _, value := range values {
+		// 同一批次中可能有内容相同的消息，加上唯一后缀避免确认 key 冲突
+		md5Bs := md5.Sum([]byte(value))
+		ackKey := msgBusAckKey(now, hex.EncodeToString(md5Bs[:])+":"+uuid.New().String())
+		bs, _ := json.Marshal(AckData{
+			ListKey: listKey,
+			Data:    []byte(value),
+		})
+		ackData[ackKey] = bs
+		bss = append(bss, []byte(value))
+	}
+	_ = x.client.SetEXBatch(ctx, ackData, time.Minute*3)
+	// 确认不受获取数据时 context 取消的影响
+	ackCtx := context.WithoutCancel(ctx)
+	return bss, func() {
+		ackKeys := make([]string, 0, len(ackData))
+		for ackKey := range ackData {
+			ackKeys = append(ackKeys, ackKey)
+		}
+		x.client.Del(ackCtx, ackKeys...)
 	}, nil
 }
 
@@ -86,7 +224,11 @@ func (x *MsgBus) RemoveChannel(ctx context.Context, topic string, channel string
 	if err != nil {
 		return err
 	}
-	_ = x.client.Del(ctx, msgBusListKey(topic, channel))
+	keys := []string{msgBusListKey(topic, channel)}
+	for i := 0; i < x.opts.partitions; i++ {
+		keys = append(keys, msgBusPartitionListKey(topic, channel, i))
+	}
+	_ = x.client.Del(ctx, keys...)
 	return nil
 }
 
@@ -119,6 +261,50 @@ func (x *MsgBus) monitor(ctx context.Context) {
 		var ackData AckData
 		_ = json.Unmarshal(bs, &ackData)
 		x.client.Del(ctx, key)
-		_ = x.client.RPushAndExpire(ctx, ackData.ListKey, ackData.Data, tenMinute)
+		// 重新推入队首，尽量保持有序分区中消息的顺序
+		_ = x.client.LPushAndExpire(ctx, ackData.ListKey, string(ackData.Data), tenMinute)
+	}
+}
+
+// moveDelayed 将到期的延迟消息推入 topic 下所有 channel 的队列
+// 通过 ZRem 的返回值认领消息，多个实例同时搬运时每条消息只会被推入一次
+// 推入失败的消息重新放回延迟集合，下一轮再次搬运，此时已经推入成功的 channel 可能收到重复的消息
+func (x *MsgBus) moveDelayed(ctx context.Context) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			fmt.Printf("[MsgBus][redis] moveDelayed panic: %v, stack:\n%s\n", r, debug.Stack())
+		}
+	}()
+	topics, err := x.client.SMembers(ctx, msgBusDelayTopicSetKey())
+	if err != nil {
+		return
+	}
+	for _, topic := range topics {
+		key := msgBusDelayKey(topic)
+		now := time.Now()
+		members, err := x.client.ZRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.UnixMilli(), 10), delayBatchSize)
+		if err != nil {
+			continue
+		}
+		for _, member := range members {
+			n, err := x.client.ZRem(ctx, key, member)
+			if err != nil || n == 0 {
+				continue
+			}
+			var delayData DelayData
+			_ = json.Unmarshal([]byte(member), &delayData)
+			err = x.Push(ctx, topic, delayData.Data)
+			if err != nil {
+				fmt.Printf("[MsgBus][redis] moveDelayed push to %s failed, retry later: %v\n", topic, err)
+				if err := x.client.ZAdd(ctx, key, float64(now.UnixMilli()), member); err != nil {
+					fmt.Printf("[MsgBus][redis] moveDelayed requeue to %s failed, message lost: %v\n", topic, err)
+				}
+			}
+		}
+		// 延迟集合已经清空的 topic 不再扫描，PushAt 先 ZAdd 再 SAdd，不会漏掉新的延迟消息
+		if len(members) < delayBatchSize {
+			_ = x.client.SRemIfZEmpty(ctx, msgBusDelayTopicSetKey(), topic, key)
+		}
 	}
 }
@@ -70,7 +70,11 @@ func TestMsgBus_Pop(t *testing.T) {
 				}
 				// 如果没有 ack 则 有数据在
 				md5Bs := md5.Sum(msg)
-				ackKey := msgBusAckKey(time.Now(), hex.EncodeToString(md5Bs[:]))
+				ackKeys, _ := x.client.Keys(ctx, msgBusAckKey(time.Now(), hex.EncodeToString(md5Bs[:]))+":*")
+				if len(ackKeys) != 1 {
+					t.Fatalf("want 1 ack key, got %v", ackKeys)
+				}
+				ackKey := ackKeys[0]
 				bs, _ := x.client.Get(ctx, ackKey)
 				t.Logf("ack key: %s, ack value: %s", ackKey, bs)
 				ack()
@@ -135,6 +139,139 @@ func (x *RedisClientImplV8) RPushAndExpire(ctx context.Context, key string, valu
 	return x.rpushAndExpire(ctx, key, value, ttl)
 }
 
+func (x *RedisClientImplV8) RPushBatchAndExpire(ctx context.Context, key string, values []string, ttl time.Duration) error {
+	members := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		members = append(members, value)
+	}
+	_, err := x.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, members...)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+func (x *RedisClientImplV8) LPushAndExpire(ctx context.Context, key string, value string, ttl time.Duration) error {
+	_, err := x.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, key, value)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+func (x *RedisClientImplV8) LPopN(ctx context.Context, key string, n int) ([]string, error) {
+	values, err := x.client.LPopCount(ctx, key, n).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return values, err
+}
+
+func (x *RedisClientImplV8) SetEXBatch(ctx context.Context, values map[string]interface{}, expiration time.Duration) error {
+	_, err := x.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, value := range values {
+			pipe.SetEX(ctx, key, value, expiration)
+		}
+		return nil
+	})
+	return err
+}
+
+func (x *RedisClientImplV8) ZAdd(ctx context.Context, key string, score float64, member string) error {
+	return x.client.ZAdd(ctx, key, &redis.Z{Score: score, Member: member}).Err()
+}
+
+func (x *RedisClientImplV8) ZRangeByScore(ctx context.Context, key string, min, max string, count int64) ([]string, error) {
+	return x.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: min, Max: max, Count: count}).Result()
+}
+
+func (x *RedisClientImplV8) ZRem(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	return x.client.ZRem(ctx, key, members...).Result()
+}
+
+func (x *RedisClientImplV8) SRemIfZEmpty(ctx context.Context, setKey string, member string, zsetKey string) error {
+	return sremIfZEmptyScript.Run(ctx, x.client, []string{setKey, zsetKey}, member).Err()
+}
+
+func (x *RedisClientImplV8) XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) (string, error) {
+	return x.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: maxLen,
+		Approx: maxLen > 0,
+		Values: values,
+	}).Result()
+}
+
+func (x *RedisClientImplV8) XAddBatch(ctx context.Context, stream string, maxLen int64, values []map[string]interface{}) error {
+	_, err := x.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, value := range values {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: stream,
+				MaxLen: maxLen,
+				Approx: maxLen > 0,
+				Values: value,
+			})
+		}
+		return nil
+	})
+	return err
+}
+
+func (x *RedisClientImplV8) XGroupCreateMkStream(ctx context.Context, stream, group, start string) error {
+	return x.client.XGroupCreateMkStream(ctx, stream, group, start).Err()
+}
+
+func (x *RedisClientImplV8) XGroupDestroy(ctx context.Context, stream, group string) error {
+	return x.client.XGroupDestroy(ctx, stream, group).Err()
+}
+
+func (x *RedisClientImplV8) XReadGroup(ctx context.Context, group, consumer, stream string, count int64, block time.Duration) ([]XMessage, error) {
+	streams, err := x.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  []string{stream, ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	var messages []XMessage
+	for _, s := range streams {
+		messages = append(messages, toXMessages(s.Messages)...)
+	}
+	return messages, nil
+}
+
+func (x *RedisClientImplV8) XAck(ctx context.Context, stream, group string, ids ...string) error {
+	return x.client.XAck(ctx, stream, group, ids...).Err()
+}
+
+func (x *RedisClientImplV8) XAutoClaim(ctx context.Context, stream, group, consumer string, minIdle time.Duration, start string, count int64) ([]XMessage, string, error) {
+	messages, next, err := x.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		MinIdle:  minIdle,
+		Start:    start,
+		Count:    count,
+		Consumer: consumer,
+	}).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	return toXMessages(messages), next, nil
+}
+
+func toXMessages(messages []redis.XMessage) []XMessage {
+	res := make([]XMessage, 0, len(messages))
+	for _, message := range messages {
+		res = append(res, XMessage{ID: message.ID, Values: message.Values})
+	}
+	return res
+}
+
 const luaScript = `
 local key = KEYS[1]
 local value = ARGV[1]
@@ -161,3 +298,10 @@ func (x *RedisClientImplV8) rpushAndExpire(ctx context.Context, key string, valu
 	}
 	return nil
 }
+
+var sremIfZEmptyScript = redis.NewScript(`
+if redis.call('ZCARD', KEYS[2]) == 0 then
+    return redis.call('SREM', KEYS[1], ARGV[1])
+end
+return 0
+`)
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ccheers/xpkg/generic/arrayx"
+	"github.com/ccheers/xpkg/xmsgbus"
+)
+
+func (x *MsgBus) Partitions() int {
+	return x.opts.partitions
+}
+
+// PushWithKey 将数据推入 topic 下每个 channel 中 key 对应的分区队列
+func (x *MsgBus) PushWithKey(ctx context.Context, topic string, key string, bs []byte) error {
+	channels, err := x.ListChannel(ctx, topic)
+	if err != nil {
+		return err
+	}
+	partition := xmsgbus.PartitionOf(key, x.opts.partitions)
+	var errList []error
+	for _, channel := range channels {
+		err = x.client.RPushAndExpire(ctx, msgBusPartitionListKey(topic, channel, partition), string(bs), tenMinute)
+		if err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if len(errList) > 0 {
+		err := fmt.Errorf("publish to %s failed: %v", topic, strings.Join(arrayx.Map(errList, func(err error) string {
+			return err.Error()
+		}), ". "))
+		return err
+	}
+	return nil
+}
+
+// PopPartition 从分区队列获取数据
+// 需要先持有分区租约，租约被其他实例持有时等待 blockTimeout 后返回 ErrPopTimeout
+// 获取到数据之后租约在后台持续续期，直到 ack 被调用或者 ctx 结束，调用方处理完成之后应该取消 ctx
+// 未确认的数据会被重新推入队首
+func (x *MsgBus) PopPartition(ctx context.Context, topic, channel string, partition int, blockTimeout time.Duration) ([]byte, func(), error) {
+	if partition < 0 || partition >= x.opts.partitions {
+		return nil, nil, fmt.Errorf("partition %d out of range [0, %d)", partition, x.opts.partitions)
+	}
+	ok, err := x.leasePartition(ctx, topic, channel, partition)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(blockTimeout):
+			return nil, nil, xmsgbus.ErrPopTimeout
+		}
+	}
+	bss, ack, err := x.popList(ctx, msgBusPartitionListKey(topic, channel, partition), 1, blockTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := x.keepPartitionLease(ctx, topic, channel, partition)
+	return bss[0], func() {
+		stop()
+		ack()
+	}, nil
+}
+
+// keepPartitionLease 在处理消息期间定时续期分区租约，避免处理时间超过 partitionLeaseTTL 时其他实例拿到同一个分区
+func (x *MsgBus) keepPartitionLease(ctx context.Context, topic, channel string, partition int) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(partitionLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, _ = x.leasePartition(ctx, topic, channel, partition)
+			}
+		}
+	}()
+	return cancel
+}
+
+// leasePartition 获取或者续期分区租约
+func (x *MsgBus) leasePartition(ctx context.Context, topic, channel string, partition int) (bool, error) {
+	key := msgBusPartitionLeaseKey(topic, channel, partition)
+	ok, err := x.client.SetNX(ctx, key, x.id, partitionLeaseTTL)
+	if err != nil || ok {
+		return ok, err
+	}
+	owner, err := x.client.Get(ctx, key)
+	if err != nil {
+		// 租约恰好过期，下一次再尝试获取
+		return false, nil
+	}
+	if string(owner) != x.id {
+		return false, nil
+	}
+	return true, x.client.SetEX(ctx, key, x.id, partitionLeaseTTL)
+}
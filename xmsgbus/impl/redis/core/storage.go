@@ -20,6 +20,21 @@ func (x *SharedStorage) SetEx(ctx context.Context, key string, value interface{}
 	return x.client.SetEX(ctx, key, value, ttl)
 }
 
+func (x *SharedStorage) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) (bool, error) {
+	return x.client.SetNX(ctx, key, value, ttl)
+}
+
+func (x *SharedStorage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := x.client.Get(ctx, key)
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 func (x *SharedStorage) Keys(ctx context.Context, prefix string) ([]string, error) {
 	if !strings.HasSuffix(prefix, "*") {
 		prefix += "*"
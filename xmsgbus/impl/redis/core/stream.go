@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ccheers/xpkg/xmsgbus"
+	"github.com/google/uuid"
+)
+
+type streamMsgBusOptions struct {
+	maxLen    int64
+	claimIdle time.Duration
+	consumer  string
+}
+
+func defaultStreamMsgBusOptions() streamMsgBusOptions {
+	hostname, _ := os.Hostname()
+	return streamMsgBusOptions{
+		maxLen:    defaultStreamMaxLen,
+		claimIdle: defaultStreamClaimIdle,
+		consumer:  hostname + "-" + uuid.New().String(),
+	}
+}
+
+type IStreamMsgBusOption interface {
+	apply(*streamMsgBusOptions)
+}
+
+type StreamMsgBusOptionFunc func(*streamMsgBusOptions)
+
+func (fn StreamMsgBusOptionFunc) apply(options *streamMsgBusOptions) {
+	fn(options)
+}
+
+// WithStreamMaxLen stream 的近似最大长度，小于等于 0 表示不裁剪
+func WithStreamMaxLen(maxLen int64) StreamMsgBusOptionFunc {
+	return func(options *streamMsgBusOptions) {
+		options.maxLen = maxLen
+	}
+}
+
+// WithStreamClaimIdle 未确认的消息空闲超过 idle 后会被重新投递给其他消费者
+func WithStreamClaimIdle(idle time.Duration) StreamMsgBusOptionFunc {
+	return func(options *streamMsgBusOptions) {
+		options.claimIdle = idle
+	}
+}
+
+// WithStreamConsumer 消费者名称，默认为 hostname + uuid
+func WithStreamConsumer(consumer string) StreamMsgBusOptionFunc {
+	return func(options *streamMsgBusOptions) {
+		options.consumer = consumer
+	}
+}
+
+// StreamMsgBus 基于 Redis Streams 的 IMsgBus 实现
+// 每个 topic 对应一个 stream，每个 channel 对应 stream 上的一个消费组
+// 未确认的消息在空闲超过 claimIdle 后通过 XAUTOCLAIM 重新投递，要求 Redis >= 6.2
+type StreamMsgBus struct {
+	opts   streamMsgBusOptions
+	client IRedisClient
+}
+
+func NewStreamMsgBus(client IRedisClient, options ...IStreamMsgBusOption) xmsgbus.IMsgBus {
+	opts := defaultStreamMsgBusOptions()
+	for _, opt := range options {
+		opt.apply(&opts)
+	}
+	return &StreamMsgBus{
+		opts:   opts,
+		client: client,
+	}
+}
+
+func (x *StreamMsgBus) Push(ctx context.Context, topic string, bs []byte) error {
+	_, err := x.client.XAdd(ctx, msgBusStreamKey(topic), x.opts.maxLen, map[string]interface{}{
+		streamDataField: string(bs),
+	})
+	if err != nil {
+		return fmt.Errorf("publish to %s failed: %w", topic, err)
+	}
+	return nil
+}
+
+func (x *StreamMsgBus) PushBatch(ctx context.Context, topic string, bss [][]byte) error {
+	values := make([]map[string]interface{}, 0, len(bss))
+	for _, bs := range bss {
+		values = append(values, map[string]interface{}{
+			streamDataField: string(bs),
+		})
+	}
+	err := x.client.XAddBatch(ctx, msgBusStreamKey(topic), x.opts.maxLen, values)
+	if err != nil {
+		return fmt.Errorf("publish to %s failed: %w", topic, err)
+	}
+	return nil
+}
+
+func (x *StreamMsgBus) Pop(ctx context.Context, topic, channel string, blockTimeout time.Duration) ([]byte, func(), error) {
+	bss, ack, err := x.PopBatch(ctx, topic, channel, 1, blockTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bss[0], ack, nil
+}
+
+func (x *StreamMsgBus) PopBatch(ctx context.Context, topic, channel string, max int, blockTimeout time.Duration) ([][]byte, func(), error) {
+	stream := msgBusStreamKey(topic)
+
+	// 优先认领其他消费者长时间未确认的消息
+	messages, _, err := x.client.XAutoClaim(ctx, stream, channel, x.opts.consumer, x.opts.claimIdle, "0-0", int64(max))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(messages) == 0 {
+		messages, err = x.client.XReadGroup(ctx, channel, x.opts.consumer, stream, int64(max), blockTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ids := make([]string, 0, len(messages))
+	bss := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+		// 已经被 MAXLEN 裁剪掉的消息没有数据，随本批次一起确认丢弃
+		if data, ok := message.Values[streamDataField].(string); ok {
+			bss = append(bss, []byte(data))
+		}
+	}
+	// 确认不受获取数据时 context 取消的影响
+	ackCtx := context.WithoutCancel(ctx)
+	ack := func() {
+		if len(ids) > 0 {
+			_ = x.client.XAck(ackCtx, stream, channel, ids...)
+		}
+	}
+	if len(bss) < 1 {
+		ack()
+		return nil, nil, xmsgbus.ErrNoData
+	}
+	return bss, ack, nil
+}
+
+func (x *StreamMsgBus) AddChannel(ctx context.Context, topic string, channel string) error {
+	err := x.client.XGroupCreateMkStream(ctx, msgBusStreamKey(topic), channel, "$")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return x.client.SAdd(ctx, msgBusStreamSetKey(topic), channel)
+}
+
+func (x *StreamMsgBus) RemoveChannel(ctx context.Context, topic string, channel string) error {
+	err := x.client.SRem(ctx, msgBusStreamSetKey(topic), channel)
+	if err != nil {
+		return err
+	}
+	_ = x.client.XGroupDestroy(ctx, msgBusStreamKey(topic), channel)
+	return nil
+}
+
+func (x *StreamMsgBus) ListChannel(ctx context.Context, topic string) ([]string, error) {
+	return x.client.SMembers(ctx, msgBusStreamSetKey(topic))
+}
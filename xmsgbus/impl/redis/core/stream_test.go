@@ -0,0 +1,62 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestStreamMsgBus_Pop(t *testing.T) {
+	ctx := context.TODO()
+	client := NewRedisClientImplV8(redis.NewClient(&redis.Options{
+		Addr: "127.0.0.1:6379",
+		DB:   0,
+	}))
+	const (
+		topic   = "test_stream"
+		channel = "test2"
+	)
+	msg := []byte("test")
+
+	consumer1 := NewStreamMsgBus(client, WithStreamConsumer("consumer1"), WithStreamClaimIdle(time.Second))
+	consumer2 := NewStreamMsgBus(client, WithStreamConsumer("consumer2"), WithStreamClaimIdle(time.Second))
+	defer consumer1.RemoveChannel(ctx, topic, channel)
+
+	err := consumer1.AddChannel(ctx, topic, channel)
+	if err != nil {
+		t.Fatalf("AddChannel() error = %v", err)
+	}
+	err = consumer1.Push(ctx, topic, msg)
+	if err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+
+	// consumer1 取出后不确认
+	got, _, err := consumer1.Pop(ctx, topic, channel, time.Second)
+	if err != nil {
+		t.Fatalf("Pop() error = %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("Pop() got = %s, want %s", got, msg)
+	}
+
+	// 空闲超时之后 consumer2 应该重新拿到这条消息
+	time.Sleep(time.Second * 2)
+	got, ack, err := consumer2.Pop(ctx, topic, channel, time.Second)
+	if err != nil {
+		t.Fatalf("Pop() reclaim error = %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("Pop() reclaim got = %s, want %s", got, msg)
+	}
+	ack()
+
+	// 确认之后不再被认领
+	time.Sleep(time.Second * 2)
+	_, _, err = consumer1.Pop(ctx, topic, channel, time.Millisecond*100)
+	if err == nil {
+		t.Errorf("Pop() after ack should time out")
+	}
+}
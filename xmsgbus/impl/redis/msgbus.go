@@ -9,10 +9,20 @@ import (
 	redisv9 "github.com/redis/go-redis/v9"
 )
 
-func NewMsgBus(client *redisv8.Client) xmsgbus.IMsgBus {
-	return core.NewMsgBus(v8.NewRedisClientImplV8(client))
+func NewMsgBus(client *redisv8.Client, options ...core.IMsgBusOption) xmsgbus.IMsgBus {
+	return core.NewMsgBus(v8.NewRedisClientImplV8(client), options...)
 }
 
-func NewMsgBusV9(client *redisv9.Client) xmsgbus.IMsgBus {
-	return core.NewMsgBus(v9.NewRedisClientImplV9(client))
+func NewMsgBusV9(client *redisv9.Client, options ...core.IMsgBusOption) xmsgbus.IMsgBus {
+	return core.NewMsgBus(v9.NewRedisClientImplV9(client), options...)
+}
+
+// NewStreamMsgBus 基于 Redis Streams 的 IMsgBus，支持消费组与未确认消息的重新投递
+func NewStreamMsgBus(client *redisv8.Client, options ...core.IStreamMsgBusOption) xmsgbus.IMsgBus {
+	return core.NewStreamMsgBus(v8.NewRedisClientImplV8(client), options...)
+}
+
+// NewStreamMsgBusV9 基于 Redis Streams 的 IMsgBus，支持消费组与未确认消息的重新投递
+func NewStreamMsgBusV9(client *redisv9.Client, options ...core.IStreamMsgBusOption) xmsgbus.IMsgBus {
+	return core.NewStreamMsgBus(v9.NewRedisClientImplV9(client), options...)
 }
@@ -0,0 +1,148 @@
+package xmsgbus
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/ccheers/xpkg/net/netutil/breaker"
+	"github.com/ccheers/xpkg/ratelimit"
+	"github.com/ccheers/xpkg/ratelimit/bbr"
+	"github.com/ccheers/xpkg/xaop"
+	"github.com/ccheers/xpkg/xlogger"
+)
+
+var (
+	// ErrRejected 被限流或者熔断拒绝，订阅者收到该错误时不确认消息也不投递死信，交由后端重投
+	ErrRejected = fmt.Errorf("rejected")
+	ErrPanic    = fmt.Errorf("panic")
+)
+
+// InvocationKind 拦截器所在的调用方
+type InvocationKind string
+
+const (
+	InvocationPublish   InvocationKind = "publish"
+	InvocationSubscribe InvocationKind = "subscribe"
+)
+
+// Invocation 当前调用的信息，拦截器通过 InvocationFromContext 获取
+type Invocation struct {
+	Kind  InvocationKind
+	Topic string
+	// Channel 发布时为空
+	Channel string
+}
+
+// Key 用于区分限流器、熔断器等资源的 key
+func (x Invocation) Key() string {
+	if x.Channel == "" {
+		return string(x.Kind) + ":" + x.Topic
+	}
+	return string(x.Kind) + ":" + x.Topic + ":" + x.Channel
+}
+
+type invocationKey struct{}
+
+func withInvocation(ctx context.Context, invocation Invocation) context.Context {
+	return context.WithValue(ctx, invocationKey{}, invocation)
+}
+
+func InvocationFromContext(ctx context.Context) (Invocation, bool) {
+	invocation, ok := ctx.Value(invocationKey{}).(Invocation)
+	return invocation, ok
+}
+
+// Interceptor 订阅者处理消息、发布者投递消息时的拦截器，基于 xaop.HandleChain 串联
+// 先注册的拦截器在外层
+type Interceptor[T ITopic] func(next xaop.AOPHandleFunc[T, struct{}]) xaop.AOPHandleFunc[T, struct{}]
+
+// chainInterceptors 将拦截器串联在 mainFn 外层
+func chainInterceptors[T ITopic](mainFn xaop.AOPHandleFunc[T, struct{}], interceptors []Interceptor[T]) xaop.AOPHandleFunc[T, struct{}] {
+	aopFns := make([]xaop.AOPChainFunc[T, struct{}], 0, len(interceptors))
+	for _, interceptor := range interceptors {
+		aopFns = append(aopFns, xaop.AOPChainFunc[T, struct{}](interceptor))
+	}
+	return xaop.HandleChain(mainFn, aopFns...)
+}
+
+// RecoveryInterceptor 将 panic 转换为错误，订阅者会按照处理失败进行重试和死信
+func RecoveryInterceptor[T ITopic]() Interceptor[T] {
+	return func(next xaop.AOPHandleFunc[T, struct{}]) xaop.AOPHandleFunc[T, struct{}] {
+		return func(ctx context.Context, event T) (resp struct{}, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%w: %v\nTrace: %s", ErrPanic, r, string(debug.Stack()))
+				}
+			}()
+			return next(ctx, event)
+		}
+	}
+}
+
+// LoggingInterceptor 失败时以 Error 级别记录日志，成功时以 Debug 级别记录日志
+func LoggingInterceptor[T ITopic](logger xlogger.Logger) Interceptor[T] {
+	return func(next xaop.AOPHandleFunc[T, struct{}]) xaop.AOPHandleFunc[T, struct{}] {
+		return func(ctx context.Context, event T) (struct{}, error) {
+			startAt := time.Now()
+			resp, err := next(ctx, event)
+			invocation, _ := InvocationFromContext(ctx)
+			level := xlogger.LevelDebug
+			keyvals := []interface{}{
+				"kind", invocation.Kind,
+				"topic", invocation.Topic,
+				"channel", invocation.Channel,
+				"latency", time.Since(startAt),
+			}
+			if err != nil {
+				level = xlogger.LevelError
+				keyvals = append(keyvals, "err", err)
+			}
+			_ = logger.Log(level, append(keyvals, "module", "[xmsgbus][LoggingInterceptor]")...)
+			return resp, err
+		}
+	}
+}
+
+// RateLimitInterceptor 使用 bbr 自适应限流，每个 topic（以及 channel）使用独立的限流器
+// 被限流时返回包装了 ErrRejected 的错误
+func RateLimitInterceptor[T ITopic](group *bbr.Group) Interceptor[T] {
+	return func(next xaop.AOPHandleFunc[T, struct{}]) xaop.AOPHandleFunc[T, struct{}] {
+		return func(ctx context.Context, event T) (struct{}, error) {
+			invocation, _ := InvocationFromContext(ctx)
+			done, err := group.Get(invocation.Key()).Allow(ctx)
+			if err != nil {
+				return struct{}{}, fmt.Errorf("%w: %w", ErrRejected, err)
+			}
+			resp, err := next(ctx, event)
+			op := ratelimit.Success
+			if err != nil {
+				op = ratelimit.Ignore
+			}
+			done(ratelimit.DoneInfo{Err: err, Op: op})
+			return resp, err
+		}
+	}
+}
+
+// BreakerInterceptor 失败率过高时熔断，每个 topic（以及 channel）使用独立的熔断器
+// 熔断时返回包装了 ErrRejected 的错误
+func BreakerInterceptor[T ITopic](group *breaker.Group) Interceptor[T] {
+	return func(next xaop.AOPHandleFunc[T, struct{}]) xaop.AOPHandleFunc[T, struct{}] {
+		return func(ctx context.Context, event T) (struct{}, error) {
+			invocation, _ := InvocationFromContext(ctx)
+			brk := group.Get(invocation.Key())
+			if err := brk.Allow(); err != nil {
+				return struct{}{}, fmt.Errorf("%w: %w", ErrRejected, err)
+			}
+			resp, err := next(ctx, event)
+			if err != nil {
+				brk.MarkFailed()
+			} else {
+				brk.MarkSuccess()
+			}
+			return resp, err
+		}
+	}
+}
@@ -3,6 +3,7 @@ package xmsgbus
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"time"
 )
 
@@ -10,6 +11,11 @@ var (
 	ErrNoData      = fmt.Errorf("no data")
 	ErrCheckFailed = fmt.Errorf("check failed")
 	ErrPopTimeout  = fmt.Errorf("pop timeout")
+
+	ErrDelayNotSupported    = fmt.Errorf("delay not supported")
+	ErrOrderingNotSupported = fmt.Errorf("ordering not supported")
+	// ErrOrderedRequired 消息实现了 IOrderingKey，在 IOrderedMsgBus 上只会进入分区队列，订阅者必须使用 WithOrdered
+	ErrOrderedRequired = fmt.Errorf("ordered subscriber required")
 )
 
 type ITopic interface {
@@ -22,6 +28,11 @@ type IMsgBus interface {
 	// Pop 以阻塞的方式获取数据
 	// blockTimeout 为 0 则永久阻塞 直到 context 退出 或 数据到达
 	Pop(ctx context.Context, topic, channel string, blockTimeout time.Duration) (data []byte, ackFn func(), err error)
+	// PushBatch 批量推入数据
+	PushBatch(ctx context.Context, topic string, bss [][]byte) error
+	// PopBatch 以阻塞的方式批量获取数据，至少返回一条，最多返回 max 条
+	// blockTimeout 的含义同 Pop，ackFn 会确认本批次的所有数据
+	PopBatch(ctx context.Context, topic, channel string, max int, blockTimeout time.Duration) (data [][]byte, ackFn func(), err error)
 	// AddChannel 为 topic 添加 channel
 	AddChannel(ctx context.Context, topic string, channel string) error
 	// RemoveChannel 删除 Channel, channel 下的数据也应该被删除
@@ -30,9 +41,51 @@ type IMsgBus interface {
 	ListChannel(ctx context.Context, topic string) ([]string, error)
 }
 
+// IDelayMsgBus 支持延迟投递的 IMsgBus
+type IDelayMsgBus interface {
+	IMsgBus
+	// PushAt 在 at 时刻将数据推入 topic 下的所有 channel
+	// at 不晚于当前时间则立即推入
+	PushAt(ctx context.Context, topic string, bs []byte, at time.Time) error
+}
+
+// IOrderingKey 需要按顺序处理的消息实现该接口，相同 key 的消息按投递顺序依次处理
+// 在 IOrderedMsgBus 上该类型的消息全部进入分区队列（key 为空时同样如此），只能被 WithOrdered 的订阅者消费
+// 没有使用 WithOrdered 的订阅者的 Handle 返回 ErrOrderedRequired，而不是静默地收不到消息
+type IOrderingKey interface {
+	OrderingKey() string
+}
+
+// IOrderedMsgBus 支持按 key 分区有序投递的 IMsgBus
+// 每个 channel 被划分为 Partitions 个有序分区，每个分区同一时间只应该被一个消费者处理
+type IOrderedMsgBus interface {
+	IMsgBus
+	// Partitions 每个 channel 的分区数量
+	Partitions() int
+	// PushWithKey 推入数据，相同 key 的数据落在同一个分区
+	PushWithKey(ctx context.Context, topic string, key string, bs []byte) error
+	// PopPartition 以阻塞的方式从指定分区获取数据，blockTimeout 的含义同 Pop
+	// 实现可以在 ack 被调用或者 ctx 结束之前一直占用该分区，调用方处理完成之后应该取消 ctx
+	PopPartition(ctx context.Context, topic, channel string, partition int, blockTimeout time.Duration) (data []byte, ackFn func(), err error)
+}
+
+// PartitionOf 计算 key 所在的分区
+func PartitionOf(key string, partitions int) int {
+	if partitions <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
+}
+
 type ISharedStorage interface {
 	// SetEx 设置一个 值 ，并且设置它的过期时间
 	SetEx(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	// SetNX key 不存在或者已经过期时设置值以及过期时间，返回是否设置成功，用于原子地认领一个 key
+	SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) (bool, error)
+	// Exists key 存在并且没有过期
+	Exists(ctx context.Context, key string) (bool, error)
 	// Keys 通过 前缀匹配 列出满足条件的 所有 Key
 	Keys(ctx context.Context, prefix string) ([]string, error)
 	// Del 删除 key
@@ -6,6 +6,7 @@ import (
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/metadata"
@@ -13,6 +14,8 @@ import (
 
 type OTELOptions struct {
 	propagator propagation.TextMapPropagator
+	// meterProvider 默认为 otel.GetMeterProvider()
+	meterProvider metric.MeterProvider
 }
 
 type OTELOption func(o *OTELOptions)
@@ -23,14 +26,28 @@ func WithOTELOptionPropagator(propagator propagation.TextMapPropagator) OTELOpti
 	}
 }
 
+// WithOTELOptionMeterProvider 设置指标的 MeterProvider
+func WithOTELOptionMeterProvider(mp metric.MeterProvider) OTELOption {
+	return func(o *OTELOptions) {
+		o.meterProvider = mp
+	}
+}
+
 func NewOTELOptions(opts ...OTELOption) *OTELOptions {
-	_default := &OTELOptions{propagator: propagation.NewCompositeTextMapPropagator(propagation.Baggage{}, propagation.TraceContext{})}
+	_default := &OTELOptions{
+		propagator:    propagation.NewCompositeTextMapPropagator(propagation.Baggage{}, propagation.TraceContext{}),
+		meterProvider: otel.GetMeterProvider(),
+	}
 	for _, opt := range opts {
 		opt(_default)
 	}
 	return _default
 }
 
+func (x *OTELOptions) meter() metric.Meter {
+	return x.meterProvider.Meter("github.com/ccheers/xpkg/xmsgbus")
+}
+
 func (x *OTELOptions) ProducerStartSpan(ctx context.Context, topic string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
 	md, ok := metadata.FromOutgoingContext(ctx)
 	if !ok {
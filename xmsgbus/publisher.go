@@ -2,8 +2,9 @@ package xmsgbus
 
 import (
 	"context"
-	"encoding/json"
+	"time"
 
+	"github.com/google/uuid"
 	"go.opentelemetry.io/otel/codes"
 	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
 	"google.golang.org/grpc/metadata"
@@ -11,23 +12,76 @@ import (
 
 type IPublisher[T ITopic] interface {
 	Publish(ctx context.Context, event T) error
+	// PublishBatch 批量投递消息，同一 topic 的消息通过一次 PushBatch 投递
+	PublishBatch(ctx context.Context, events []T) error
+	// PublishAt 在 at 时刻投递消息，需要 IMsgBus 实现 IDelayMsgBus
+	// 延迟投递不会进入分区队列，IOrderedMsgBus 上实现了 IOrderingKey 的消息返回 ErrOrderingNotSupported
+	PublishAt(ctx context.Context, event T, at time.Time) error
+	// PublishAfter 在 delay 之后投递消息，需要 IMsgBus 实现 IDelayMsgBus
+	PublishAfter(ctx context.Context, event T, delay time.Duration) error
 }
 
 type PublisherOptions[T ITopic] struct {
 	Encode EncodeFunc[T]
+	// ContentType Encode 产生的数据的编码类型，记录在 Event 中
+	ContentType string
+	// Compressor 消息体压缩算法，为空则不压缩
+	Compressor Compressor
+	// CompressThreshold 消息体达到该大小（字节）才压缩
+	CompressThreshold int
+	// Interceptors 包裹 Publish、PublishAt 的拦截器
+	Interceptors []Interceptor[T]
+	// EventFrame 使用二进制帧编码 Event，默认使用 JSON
+	EventFrame bool
 }
 
 func defaultPublisherOptions[T ITopic]() *PublisherOptions[T] {
 	return &PublisherOptions[T]{
-		Encode: DefaultEncodeFunc[T],
+		Encode:      DefaultEncodeFunc[T],
+		ContentType: ContentTypeJSON,
 	}
 }
 
 type PublisherOption[T ITopic] func(o *PublisherOptions[T])
 
+// WithEncodeFunc 自定义编码函数，编码类型记为 ContentTypeRaw，订阅者需要通过 WithDecodeFunc 解码
 func WithEncodeFunc[T ITopic](f EncodeFunc[T]) PublisherOption[T] {
 	return func(o *PublisherOptions[T]) {
 		o.Encode = f
+		o.ContentType = ContentTypeRaw
+	}
+}
+
+// WithCodec 使用编解码器编码消息体，并在 Event 中记录 ContentType
+func WithCodec[T ITopic](codec Codec) PublisherOption[T] {
+	return func(o *PublisherOptions[T]) {
+		o.Encode = func(ctx context.Context, dst T) ([]byte, error) {
+			return codec.Marshal(dst)
+		}
+		o.ContentType = codec.ContentType()
+	}
+}
+
+// WithCompressor 消息体大小达到 threshold 字节时使用 compressor 压缩
+func WithCompressor[T ITopic](compressor Compressor, threshold int) PublisherOption[T] {
+	return func(o *PublisherOptions[T]) {
+		o.Compressor = compressor
+		o.CompressThreshold = threshold
+	}
+}
+
+// WithEventFrame 使用二进制帧编码 Event，消息体不再经过 base64 膨胀
+// 所有订阅者都升级到支持二进制帧的版本之后才能开启
+func WithEventFrame[T ITopic]() PublisherOption[T] {
+	return func(o *PublisherOptions[T]) {
+		o.EventFrame = true
+	}
+}
+
+// WithPublisherInterceptors 追加 Publish、PublishAt 的拦截器，先注册的在外层，PublishBatch 不经过拦截器
+func WithPublisherInterceptors[T ITopic](interceptors ...Interceptor[T]) PublisherOption[T] {
+	return func(o *PublisherOptions[T]) {
+		o.Interceptors = append(o.Interceptors, interceptors...)
 	}
 }
 
@@ -61,21 +115,133 @@ func (x *Publisher[T]) Publish(ctx context.Context, event T) error {
 		return nil
 	}
 
+	return x.publish(ctx, event, func(ctx context.Context, bs []byte) error {
+		return x.push(ctx, event, bs)
+	})
+}
+
+// push 实现了 IOrderingKey 的消息在 IOrderedMsgBus 上按 key 投递，否则普通投递
+func (x *Publisher[T]) push(ctx context.Context, event T, bs []byte) error {
+	if key, ok := x.orderingKey(event); ok {
+		return x.msgBus.(IOrderedMsgBus).PushWithKey(ctx, event.Topic(), key, bs)
+	}
+	return x.msgBus.Push(ctx, event.Topic(), bs)
+}
+
+func (x *Publisher[T]) orderingKey(event T) (string, bool) {
+	if _, ok := x.msgBus.(IOrderedMsgBus); !ok {
+		return "", false
+	}
+	keyer, ok := any(event).(IOrderingKey)
+	if !ok {
+		return "", false
+	}
+	// key 为空的消息同样进入分区队列，有序订阅者只消费分区队列
+	return keyer.OrderingKey(), true
+}
+
+func (x *Publisher[T]) PublishBatch(ctx context.Context, events []T) error {
+	var topics []string
+	topicEvents := make(map[string][]T)
+	for _, event := range events {
+		topic := event.Topic()
+		if _, ok := topicEvents[topic]; !ok {
+			topics = append(topics, topic)
+		}
+		topicEvents[topic] = append(topicEvents[topic], event)
+	}
+
+	for _, topic := range topics {
+		err := x.publishBatch(ctx, topic, topicEvents[topic])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *Publisher[T]) publishBatch(ctx context.Context, topic string, events []T) error {
+	channels, err := x.msgBus.ListChannel(ctx, topic)
+	if err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+
 	ctx, span := x.otelOptions.ProducerStartSpan(ctx, topic, semconv.MessagingOperationPublish)
 	defer span.End()
 
-	md, _ := metadata.FromOutgoingContext(ctx)
-	bs, err := x.options.Encode(ctx, event)
+	bss := make([][]byte, 0, len(events))
+	for _, event := range events {
+		bs, err := x.encode(ctx, event)
+		if err != nil {
+			return err
+		}
+		// 有序消息需要落到 key 对应的分区，逐条投递
+		if _, ok := x.orderingKey(event); ok {
+			err = x.push(ctx, event, bs)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return err
+			}
+			continue
+		}
+		bss = append(bss, bs)
+	}
+
+	if len(bss) > 0 {
+		err = x.msgBus.PushBatch(ctx, topic, bss)
+	}
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return err
 	}
 
-	bs, _ = json.Marshal(&Event{
-		Metadata: md,
-		Payload:  bs,
+	span.SetStatus(codes.Ok, "ok")
+	return nil
+}
+
+func (x *Publisher[T]) PublishAt(ctx context.Context, event T, at time.Time) error {
+	delayBus, ok := x.msgBus.(IDelayMsgBus)
+	if !ok {
+		return ErrDelayNotSupported
+	}
+	// 到期的消息通过 Push 投递，有序订阅者只消费分区队列，会永远收不到这条消息
+	if _, ok := x.orderingKey(event); ok {
+		return ErrOrderingNotSupported
+	}
+	// 延迟消息投递给到期时存在的 channel，因此这里不检查当前是否存在 channel
+	return x.publish(ctx, event, func(ctx context.Context, bs []byte) error {
+		return delayBus.PushAt(ctx, event.Topic(), bs, at)
 	})
+}
+
+func (x *Publisher[T]) PublishAfter(ctx context.Context, event T, delay time.Duration) error {
+	return x.PublishAt(ctx, event, time.Now().Add(delay))
+}
+
+func (x *Publisher[T]) publish(ctx context.Context, event T, push func(ctx context.Context, bs []byte) error) error {
+	ctx = withInvocation(ctx, Invocation{Kind: InvocationPublish, Topic: event.Topic()})
+	_, err := chainInterceptors(func(ctx context.Context, event T) (struct{}, error) {
+		return struct{}{}, x.doPublish(ctx, event, push)
+	}, x.options.Interceptors)(ctx, event)
+	return err
+}
 
-	err = x.msgBus.Push(ctx, topic, bs)
+func (x *Publisher[T]) doPublish(ctx context.Context, event T, push func(ctx context.Context, bs []byte) error) error {
+	topic := event.Topic()
+	ctx, span := x.otelOptions.ProducerStartSpan(ctx, topic, semconv.MessagingOperationPublish)
+	defer span.End()
+
+	bs, err := x.encode(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	err = push(ctx, bs)
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
@@ -85,3 +251,34 @@ func (x *Publisher[T]) Publish(ctx context.Context, event T) error {
 	span.SetStatus(codes.Ok, "ok")
 	return nil
 }
+
+// encode 编码消息并包装为 Event
+func (x *Publisher[T]) encode(ctx context.Context, event T) ([]byte, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	bs, err := x.options.Encode(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+
+	var contentEncoding string
+	if x.options.Compressor != nil && len(bs) >= x.options.CompressThreshold {
+		bs, err = x.options.Compressor.Compress(bs)
+		if err != nil {
+			return nil, err
+		}
+		contentEncoding = x.options.Compressor.Name()
+	}
+
+	dst := &Event{
+		ID:              uuid.New().String(),
+		Metadata:        md,
+		Topic:           event.Topic(),
+		Payload:         bs,
+		ContentType:     x.options.ContentType,
+		ContentEncoding: contentEncoding,
+	}
+	if x.options.EventFrame {
+		return EncodeEventFrame(dst)
+	}
+	return EncodeEvent(dst)
+}
@@ -0,0 +1,240 @@
+package xmsgbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ccheers/xpkg/net/netutil"
+	"github.com/ccheers/xpkg/sync/graceful"
+	"github.com/ccheers/xpkg/sync/routinepool"
+	"github.com/ccheers/xpkg/xlogger"
+)
+
+var ErrRunnerStarted = fmt.Errorf("runner already started")
+
+// IRunnable 可以被 Runner 驱动的订阅者，所有的 ISubscriber 都满足该接口
+type IRunnable interface {
+	Handle(ctx context.Context) error
+	Close(ctx context.Context)
+}
+
+type runnerOptions struct {
+	concurrency int
+	pool        routinepool.Pool
+	backoff     netutil.BackoffConfig
+	logger      xlogger.Logger
+}
+
+func defaultRunnerOptions() runnerOptions {
+	return runnerOptions{
+		concurrency: 1,
+		backoff: netutil.BackoffConfig{
+			MaxDelay:  time.Second * 30,
+			BaseDelay: time.Millisecond * 100,
+			Factor:    1.6,
+			Jitter:    0.2,
+		},
+		logger: xlogger.DefaultLogger,
+	}
+}
+
+type RunnerOption func(o *runnerOptions)
+
+// WithRunnerConcurrency 并发执行 Handle 的循环个数
+func WithRunnerConcurrency(concurrency int) RunnerOption {
+	return func(o *runnerOptions) {
+		o.concurrency = concurrency
+	}
+}
+
+// WithRunnerPool 运行 Handle 循环的协程池，容量不能小于并发数，否则多出的循环不会被调度
+func WithRunnerPool(pool routinepool.Pool) RunnerOption {
+	return func(o *runnerOptions) {
+		o.pool = pool
+	}
+}
+
+// WithRunnerBackoff Handle 返回错误之后的退避策略
+func WithRunnerBackoff(backoff netutil.BackoffConfig) RunnerOption {
+	return func(o *runnerOptions) {
+		o.backoff = backoff
+	}
+}
+
+func WithRunnerLogger(logger xlogger.Logger) RunnerOption {
+	return func(o *runnerOptions) {
+		o.logger = logger
+	}
+}
+
+// Runner 以固定的并发度驱动订阅者的 Handle 循环
+// Stop 时不再获取新的数据，并等待处理中的消息完成，可以注册到 graceful.IGraceful 中
+type Runner struct {
+	name       string
+	subscriber IRunnable
+	opts       runnerOptions
+	// ownPool 协程池由 NewRunner 创建，Stop 时一并停止
+	ownPool bool
+
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	// draining 关闭后所有循环在当前消息处理完成之后退出
+	draining chan struct{}
+	wg       sync.WaitGroup
+}
+
+var _ graceful.IExiting = (*Runner)(nil)
+
+func NewRunner(name string, subscriber IRunnable, opts ...RunnerOption) *Runner {
+	options := defaultRunnerOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.concurrency < 1 {
+		options.concurrency = 1
+	}
+	ownPool := options.pool == nil
+	if ownPool {
+		options.pool = routinepool.NewPool("xmsgbus_runner", int32(options.concurrency), routinepool.NewConfig())
+	}
+	return &Runner{
+		name:       name,
+		subscriber: subscriber,
+		opts:       options,
+		ownPool:    ownPool,
+		draining:   make(chan struct{}),
+	}
+}
+
+func (x *Runner) Name() string {
+	return x.name
+}
+
+// Start 启动 Handle 循环，不阻塞
+// ctx 退出时循环会立即退出，正常的退出流程应该调用 Stop
+func (x *Runner) Start(ctx context.Context) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.started {
+		return ErrRunnerStarted
+	}
+	x.started = true
+
+	ctx, x.cancel = context.WithCancel(ctx)
+	ctx = context.WithValue(ctx, drainKey{}, (<-chan struct{})(x.draining))
+	for i := 0; i < x.opts.concurrency; i++ {
+		x.wg.Add(1)
+		err := x.opts.pool.CtxGo(ctx, x.loop)
+		if err != nil {
+			x.wg.Done()
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop 停止获取新的数据，等待处理中的消息完成后取消订阅
+// ctx 超时则强制取消所有循环并返回错误
+// 未通过 WithRunnerPool 指定协程池时，内部创建的协程池也会被停止
+func (x *Runner) Stop(ctx context.Context) error {
+	x.mu.Lock()
+	if !x.started {
+		x.mu.Unlock()
+		return nil
+	}
+	select {
+	case <-x.draining:
+	default:
+		close(x.draining)
+	}
+	x.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		x.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-done:
+	}
+	x.cancel()
+	x.subscriber.Close(ctx)
+	if x.ownPool {
+		if poolErr := x.opts.pool.Stop(ctx); err == nil {
+			err = poolErr
+		}
+	}
+	return err
+}
+
+func (x *Runner) loop(ctx context.Context) {
+	defer x.wg.Done()
+	retries := 0
+	for {
+		if x.stopping(ctx) {
+			return
+		}
+		err := x.subscriber.Handle(ctx)
+		if err == nil || errors.Is(err, ErrPopTimeout) || errors.Is(err, ErrNoData) || errors.Is(err, ErrCheckFailed) {
+			retries = 0
+			continue
+		}
+		if x.stopping(ctx) {
+			return
+		}
+
+		delay := x.opts.backoff.Backoff(retries)
+		retries++
+		_ = x.opts.logger.Log(xlogger.LevelError,
+			"err", err,
+			"runner", x.name,
+			"backoff", delay,
+			"module", "[Runner][loop]")
+		select {
+		case <-ctx.Done():
+			return
+		case <-x.draining:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (x *Runner) stopping(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	case <-x.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+type drainKey struct{}
+
+// popContext 返回用于获取数据的 context，Runner 停止时会被取消，
+// 而处理消息使用的 context 不受影响，保证处理中的消息能够完成
+func popContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	draining, ok := ctx.Value(drainKey{}).(<-chan struct{})
+	if !ok {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-draining:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
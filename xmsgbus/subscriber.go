@@ -2,15 +2,19 @@ package xmsgbus
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"runtime/debug"
 	"time"
 
+	"github.com/ccheers/xpkg/xaop"
 	"github.com/ccheers/xpkg/xlogger"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
 	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
 	"google.golang.org/grpc/metadata"
 )
@@ -28,6 +32,9 @@ func DefaultSubscriberHandleFunc[T ITopic](ctx context.Context, dst T) error {
 	return nil
 }
 
+// SubscriberBatchHandleFunc 批量处理函数
+type SubscriberBatchHandleFunc[T ITopic] func(ctx context.Context, dst []T) error
+
 type SubscriberCheckFunc[T ITopic] func(ctx context.Context, dst T) bool
 
 func DefaultSubscriberCheckFunc[T ITopic](ctx context.Context, dst T) bool {
@@ -35,17 +42,36 @@ func DefaultSubscriberCheckFunc[T ITopic](ctx context.Context, dst T) bool {
 	return true
 }
 
+// orderedBlockTimeout 有序消费时每个分区的阻塞时间
+const orderedBlockTimeout = time.Second
+
 type SubscriberOptions[T ITopic] struct {
 	HandleEvent SubscriberHandleFunc[T]
 	CheckEvent  SubscriberCheckFunc[T]
-	Decode      DecodeFunc[T]
+	// Decode 为空时根据 Event.ContentType 选择已注册的 Codec 解码
+	Decode DecodeFunc[T]
+	// BatchHandleEvent 不为空时以批量的方式获取并处理数据，HandleEvent 不再生效
+	BatchHandleEvent SubscriberBatchHandleFunc[T]
+	// BatchSize 每批最多处理的数据条数
+	BatchSize int
+	// Ordered 按照分区有序消费，同一分区同一时间只有一个 Handle 在处理，需要 IOrderedMsgBus
+	// 仅对 HandleEvent 生效
+	Ordered bool
+	// RetryPolicy HandleEvent 失败时的重试策略
+	RetryPolicy RetryPolicy
+	// DeadLetterTopic 重试耗尽后投递的死信 topic，为空则丢弃
+	DeadLetterTopic string
+	// Deduplicator 不为空时跳过已经处理过的消息，只对带有 ID 的消息生效
+	Deduplicator IDeduplicator
+	// Interceptors 包裹 HandleEvent 的拦截器，每次重试都会经过拦截器
+	Interceptors []Interceptor[T]
 }
 
 func defaultSubscriberOptions[T ITopic]() *SubscriberOptions[T] {
 	return &SubscriberOptions[T]{
 		HandleEvent: DefaultSubscriberHandleFunc[T],
 		CheckEvent:  DefaultSubscriberCheckFunc[T],
-		Decode:      DefaultDecodeFunc[T],
+		RetryPolicy: defaultRetryPolicy(),
 	}
 }
 
@@ -63,12 +89,63 @@ func WithCheckFunc[T ITopic](f SubscriberCheckFunc[T]) SubscriberOption[T] {
 	}
 }
 
+// WithDecodeFunc 自定义解码函数，设置后不再根据 Event.ContentType 选择 Codec
 func WithDecodeFunc[T ITopic](f DecodeFunc[T]) SubscriberOption[T] {
 	return func(o *SubscriberOptions[T]) {
 		o.Decode = f
 	}
 }
 
+// WithBatchHandleFunc 以批量的方式处理数据，每批最多 max 条
+func WithBatchHandleFunc[T ITopic](f SubscriberBatchHandleFunc[T], max int) SubscriberOption[T] {
+	return func(o *SubscriberOptions[T]) {
+		o.BatchHandleEvent = f
+		o.BatchSize = max
+	}
+}
+
+// WithOrdered 按照分区有序消费，配合实现了 IOrderingKey 的消息使用
+// 并发调用 Handle（例如 Runner 的多个循环）时，不同分区的消息并行处理，同一分区的消息依次处理
+// 每个进程中同一个 channel 只应该创建一个有序的 Subscriber
+// 每次 Handle 会在一个分区上阻塞，并发数应该与 Partitions 相同，否则空闲分区的阻塞会拖慢其他分区
+// 被限流熔断拒绝的消息不会释放分区，按照重试策略退避之后重新处理，直到处理完成或者 context 退出
+func WithOrdered[T ITopic]() SubscriberOption[T] {
+	return func(o *SubscriberOptions[T]) {
+		o.Ordered = true
+	}
+}
+
+// WithRetryPolicy 设置 HandleEvent 失败时的重试策略
+func WithRetryPolicy[T ITopic](policy RetryPolicy) SubscriberOption[T] {
+	return func(o *SubscriberOptions[T]) {
+		o.RetryPolicy = policy
+	}
+}
+
+// WithDeadLetterTopic 设置死信 topic，重试耗尽后消息会以 DeadLetter 的形式投递到该 topic
+// 死信 topic 下至少需要有一个 channel（即有订阅者注册）才能收到消息
+func WithDeadLetterTopic[T ITopic](topic string) SubscriberOption[T] {
+	return func(o *SubscriberOptions[T]) {
+		o.DeadLetterTopic = topic
+	}
+}
+
+// WithDeduplicator 开启幂等消费，处理之前原子地认领消息 ID，确认时记录为处理完成，没有被确认的消息会释放认领
+// 已经处理完成的消息直接确认并跳过，正在被其他消费者处理的消息不确认，交由后端重投
+// 跳过的消息数量记录在 xmsgbus_subscriber_duplicate_count 指标中
+func WithDeduplicator[T ITopic](deduplicator IDeduplicator) SubscriberOption[T] {
+	return func(o *SubscriberOptions[T]) {
+		o.Deduplicator = deduplicator
+	}
+}
+
+// WithSubscriberInterceptors 追加 HandleEvent 的拦截器，先注册的在外层，BatchHandleEvent 不经过拦截器
+func WithSubscriberInterceptors[T ITopic](interceptors ...Interceptor[T]) SubscriberOption[T] {
+	return func(o *SubscriberOptions[T]) {
+		o.Interceptors = append(o.Interceptors, interceptors...)
+	}
+}
+
 type Subscriber[T ITopic] struct {
 	msgBus      IMsgBus
 	otelOptions *OTELOptions
@@ -78,8 +155,18 @@ type Subscriber[T ITopic] struct {
 	channel string
 
 	options *SubscriberOptions[T]
+	// handle 串联了拦截器的 HandleEvent
+	handle xaop.AOPHandleFunc[T, struct{}]
 
 	topicManager ITopicManager
+
+	// partitions 有序消费时空闲分区的令牌
+	partitions chan int
+	// orderingErr 订阅方式无法消费分区队列中的消息时不为空
+	orderingErr error
+
+	duplicateCounter metric.Int64Counter
+	metricAttributes metric.MeasurementOption
 }
 
 func NewSubscriber[T ITopic](topic, channel string, client IMsgBus, otelOptions *OTELOptions, topicManager ITopicManager, opts ...SubscriberOption[T]) ISubscriber[T] {
@@ -87,7 +174,7 @@ func NewSubscriber[T ITopic](topic, channel string, client IMsgBus, otelOptions
 	for _, opt := range opts {
 		opt(options)
 	}
-	return &Subscriber[T]{
+	x := &Subscriber[T]{
 		msgBus:       client,
 		otelOptions:  otelOptions,
 		uuid:         uuid.New().String(),
@@ -95,7 +182,47 @@ func NewSubscriber[T ITopic](topic, channel string, client IMsgBus, otelOptions
 		channel:      channel,
 		options:      options,
 		topicManager: topicManager,
+		metricAttributes: metric.WithAttributes(
+			attribute.String("topic", topic),
+			attribute.String("channel", channel),
+		),
+	}
+	counter, err := otelOptions.meter().Int64Counter("xmsgbus_subscriber_duplicate_count")
+	if err != nil {
+		xlogger.DefaultLogger.Log(xlogger.LevelError, "err", err, "module", "[Subscriber][NewSubscriber]")
+		counter = noop.Int64Counter{}
+	}
+	x.duplicateCounter = counter
+	x.handle = chainInterceptors(func(ctx context.Context, event T) (struct{}, error) {
+		return struct{}{}, options.HandleEvent(ctx, event)
+	}, options.Interceptors)
+	if ordered, ok := client.(IOrderedMsgBus); ok && options.Ordered {
+		x.partitions = make(chan int, ordered.Partitions())
+		for i := 0; i < ordered.Partitions(); i++ {
+			x.partitions <- i
+		}
+	}
+	x.orderingErr = checkOrdering(client, options)
+	if x.orderingErr != nil {
+		xlogger.DefaultLogger.Log(xlogger.LevelError, "err", x.orderingErr, "topic", topic, "channel", channel, "module", "[Subscriber][NewSubscriber]")
 	}
+	return x
+}
+
+// checkOrdering 实现了 IOrderingKey 的消息在 IOrderedMsgBus 上只进入分区队列
+// 只有逐条处理的有序订阅者会消费分区队列，其他订阅者会静默地丢失这些消息
+func checkOrdering[T ITopic](client IMsgBus, options *SubscriberOptions[T]) error {
+	if _, ok := client.(IOrderedMsgBus); !ok {
+		return nil
+	}
+	var dst T
+	if _, ok := any(dst).(IOrderingKey); !ok {
+		return nil
+	}
+	if options.Ordered && options.BatchHandleEvent == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %T implements IOrderingKey, use WithOrdered without WithBatchHandleFunc", ErrOrderedRequired, dst)
 }
 
 func (x *Subscriber[T]) Handle(ctx context.Context) (err error) {
@@ -105,13 +232,21 @@ func (x *Subscriber[T]) Handle(ctx context.Context) (err error) {
 			err = fmt.Errorf("panic: %v\nTrace: %s", r, string(debug.Stack()))
 		}
 	}()
+	if x.orderingErr != nil {
+		return x.orderingErr
+	}
 	err = x.topicManager.Register(ctx, x.topic, x.channel, x.uuid, time.Minute)
 	if err != nil {
 		return err
 	}
 	// 一次 handle 监听不超过 [30,45) 秒
 	blockTimeout := time.Second * time.Duration(30+rand.Intn(15))
-	bs, ack, err := x.msgBus.Pop(ctx, x.topic, x.channel, blockTimeout)
+	if x.options.BatchHandleEvent != nil {
+		return x.handleBatch(ctx, blockTimeout)
+	}
+	popCtx, cancel := popContext(ctx)
+	defer cancel()
+	bs, ack, release, err := x.pop(popCtx, blockTimeout)
 	if err != nil {
 		// 超时没有数据则直接返回，等待下一次调用
 		if err.Error() == "redis: nil" {
@@ -119,20 +254,38 @@ func (x *Subscriber[T]) Handle(ctx context.Context) (err error) {
 		}
 		return err
 	}
-	defer ack()
+	defer release()
 
-	var dst Event
-	err = json.Unmarshal(bs, &dst)
+	dst, err := DecodeEvent(bs)
 	if err != nil {
-		return err
+		return x.deadLetter(ctx, &Event{Topic: x.topic, Payload: bs}, ack, 1, err)
+	}
+	ack, claim, done := x.settleClaims(ctx, ack)
+	defer done()
+	state := claim(dst)
+	// 有序消费时等待认领过期，释放分区之后同一个 key 的下一条消息会先被处理
+	for i := 0; x.options.Ordered && state == DedupInProgress; i++ {
+		if !x.holdPartition(ctx, i) {
+			return ctx.Err()
+		}
+		state = claim(dst)
+	}
+	switch state {
+	case DedupDone:
+		ack()
+		return nil
+	case DedupInProgress:
+		// 正在被其他消费者处理，不确认，交由后端重投
+		return nil
 	}
-	event, err := x.options.Decode(ctx, dst.Payload)
+	event, err := x.decode(ctx, dst)
 	if err != nil {
-		return err
+		return x.deadLetter(ctx, dst, ack, 1, err)
 	}
 
 	// 未通过校验则直接返回
 	if !x.options.CheckEvent(ctx, event) {
+		ack()
 		return ErrCheckFailed
 	}
 
@@ -140,17 +293,193 @@ func (x *Subscriber[T]) Handle(ctx context.Context) (err error) {
 	ctx, span := x.otelOptions.ConsumerStartSpan(ctx, dst.Topic, semconv.MessagingOperationProcess)
 	defer span.End()
 
-	err = x.options.HandleEvent(ctx, event)
+	ctx = withInvocation(ctx, Invocation{Kind: InvocationSubscribe, Topic: x.topic, Channel: x.channel})
+	handle := func() error {
+		_, err := x.handle(ctx, event)
+		return err
+	}
+	attempts, err := x.retry(ctx, handle)
+	// 有序消费时被限流熔断拒绝的消息继续占用分区重试，释放分区之后同一个 key 的下一条消息会先被处理
+	for x.options.Ordered && errors.Is(err, ErrRejected) && x.holdPartition(ctx, attempts-1) {
+		var n int
+		n, err = x.retry(ctx, handle)
+		attempts += n
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		// 重试过程中 context 退出或者被限流熔断拒绝，不确认消息，交由后端重投
+		if ctx.Err() != nil || errors.Is(err, ErrRejected) {
+			return err
+		}
+		return x.deadLetter(ctx, dst, ack, attempts, err)
+	}
+
+	ack()
+	span.SetStatus(codes.Ok, "ok")
+	return nil
+}
+
+// pop 获取数据，release 在消息处理完成之后调用，用于归还有序分区
+func (x *Subscriber[T]) pop(ctx context.Context, blockTimeout time.Duration) (bs []byte, ack func(), release func(), err error) {
+	if !x.options.Ordered {
+		bs, ack, err = x.msgBus.Pop(ctx, x.topic, x.channel, blockTimeout)
+		return bs, ack, func() {}, err
+	}
+	if x.partitions == nil {
+		return nil, nil, nil, ErrOrderingNotSupported
+	}
+
+	var partition int
+	select {
+	case <-ctx.Done():
+		return nil, nil, nil, ctx.Err()
+	case partition = <-x.partitions:
+	}
+	// 处理完成之后取消 ctx，结束 IOrderedMsgBus 对分区的占用（例如租约续期）
+	ctx, cancel := context.WithCancel(ctx)
+	release = func() {
+		cancel()
+		x.partitions <- partition
+	}
+	// 有序消费时缩短阻塞时间，让空闲的分区尽快轮转
+	bs, ack, err = x.msgBus.(IOrderedMsgBus).PopPartition(ctx, x.topic, x.channel, partition, orderedBlockTimeout)
+	if err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+	return bs, ack, release, nil
+}
+
+// holdPartition 有序消费时占用着分区按照重试策略退避，context 退出时返回 false
+func (x *Subscriber[T]) holdPartition(ctx context.Context, retries int) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(x.options.RetryPolicy.Backoff.Backoff(retries)):
+		return true
+	}
+}
+
+func (x *Subscriber[T]) handleBatch(ctx context.Context, blockTimeout time.Duration) error {
+	popCtx, cancel := popContext(ctx)
+	defer cancel()
+	bss, ack, err := x.msgBus.PopBatch(popCtx, x.topic, x.channel, x.options.BatchSize, blockTimeout)
+	if err != nil {
+		// 超时没有数据则直接返回，等待下一次调用
+		if err.Error() == "redis: nil" {
+			return nil
+		}
+		return err
+	}
+
+	// 先认领整批数据，批次只能整体确认，有数据正在被其他消费者处理时整批不确认，交由后端重投
+	ack, claim, done := x.settleClaims(ctx, ack)
+	defer done()
+	claimed := make([]*Event, 0, len(bss))
+	decodeErrs := make([]error, 0, len(bss))
+	for _, bs := range bss {
+		dst, err := DecodeEvent(bs)
+		if err != nil {
+			claimed = append(claimed, &Event{Topic: x.topic, Payload: bs})
+			decodeErrs = append(decodeErrs, err)
+			continue
+		}
+		switch claim(dst) {
+		case DedupDone:
+			continue
+		case DedupInProgress:
+			return nil
+		}
+		claimed = append(claimed, dst)
+		decodeErrs = append(decodeErrs, nil)
+	}
+
+	// 解析失败的数据单独进入死信，不影响同批次的其他数据
+	envelopes := make([]*Event, 0, len(claimed))
+	events := make([]T, 0, len(claimed))
+	for i, dst := range claimed {
+		if decodeErrs[i] != nil {
+			if err := x.pushDeadLetter(ctx, dst, 1, decodeErrs[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		event, err := x.decode(ctx, dst)
+		if err != nil {
+			if err := x.pushDeadLetter(ctx, dst, 1, err); err != nil {
+				return err
+			}
+			continue
+		}
+		// 未通过校验的数据直接丢弃
+		if !x.options.CheckEvent(ctx, event) {
+			continue
+		}
+		envelopes = append(envelopes, dst)
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		ack()
+		return nil
+	}
+
+	ctx = metadata.NewIncomingContext(ctx, envelopes[0].Metadata)
+	ctx, span := x.otelOptions.ConsumerStartSpan(ctx, envelopes[0].Topic, semconv.MessagingOperationProcess)
+	defer span.End()
+
+	attempts, err := x.retry(ctx, func() error {
+		return x.options.BatchHandleEvent(ctx, events)
+	})
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
+		// 重试过程中 context 退出，不确认消息，交由后端重投
+		if ctx.Err() != nil {
+			return err
+		}
+		for _, envelope := range envelopes {
+			if err := x.pushDeadLetter(ctx, envelope, attempts, err); err != nil {
+				return err
+			}
+		}
+		ack()
 		return err
 	}
 
+	ack()
 	span.SetStatus(codes.Ok, "ok")
 	return nil
 }
 
+// decode 解压并解码消息体
+func (x *Subscriber[T]) decode(ctx context.Context, src *Event) (T, error) {
+	var dst T
+	payload := src.Payload
+	if src.ContentEncoding != "" {
+		compressor, err := GetCompressor(src.ContentEncoding)
+		if err != nil {
+			return dst, err
+		}
+		payload, err = compressor.Decompress(payload)
+		if err != nil {
+			return dst, err
+		}
+	}
+	if x.options.Decode != nil {
+		return x.options.Decode(ctx, payload)
+	}
+	if src.ContentType == ContentTypeRaw {
+		return dst, fmt.Errorf("%w: topic=%s", ErrDecodeFuncRequired, src.Topic)
+	}
+	codec, err := GetCodec(src.ContentType)
+	if err != nil {
+		return dst, err
+	}
+	err = codec.Unmarshal(payload, &dst)
+	return dst, err
+}
+
 func (x *Subscriber[T]) Close(ctx context.Context) {
 	x.topicManager.Unregister(ctx, x.topic, x.channel, x.uuid)
 }
@@ -2,15 +2,23 @@ package xmsgbus_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/ccheers/xpkg/net/netutil"
+	"github.com/ccheers/xpkg/sync/graceful"
+	"github.com/ccheers/xpkg/xaop"
+	"github.com/ccheers/xpkg/xlogger"
 	"github.com/ccheers/xpkg/xmsgbus"
 	"github.com/ccheers/xpkg/xmsgbus/impl/memory"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type dummyEvent struct {
@@ -407,3 +415,910 @@ func TestSubscriber_Handle(t *testing.T) {
 		})
 	}
 }
+
+func TestSubscriber_HandleRetryAndDeadLetter(t *testing.T) {
+	const dlqTopic = "test_dlq"
+	type testCase struct {
+		name           string
+		failTimes      int
+		maxAttempts    int
+		wantErr        bool
+		wantCalls      int
+		wantDeadLetter bool
+	}
+	tests := []testCase{
+		{
+			name:        "succeed after retry",
+			failTimes:   2,
+			maxAttempts: 3,
+			wantErr:     false,
+			wantCalls:   3,
+		},
+		{
+			name:           "retries exhausted",
+			failTimes:      5,
+			maxAttempts:    3,
+			wantErr:        true,
+			wantCalls:      3,
+			wantDeadLetter: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			msgbus := memory.NewMsgBus()
+			storage := memory.NewStorage()
+			manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+			_ = msgbus.AddChannel(ctx, "test", "channel")
+			_ = msgbus.AddChannel(ctx, dlqTopic, "channel")
+
+			calls := 0
+			subscriber := xmsgbus.NewSubscriber[*dummyEvent](
+				"test",
+				"channel",
+				msgbus,
+				xmsgbus.NewOTELOptions(),
+				manager,
+				xmsgbus.WithHandleFunc[*dummyEvent](func(ctx context.Context, dst *dummyEvent) error {
+					calls++
+					if calls <= tt.failTimes {
+						return fmt.Errorf("fail %d", calls)
+					}
+					return nil
+				}),
+				xmsgbus.WithRetryPolicy[*dummyEvent](xmsgbus.RetryPolicy{
+					MaxAttempts: tt.maxAttempts,
+					Backoff:     netutil.BackoffConfig{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Factor: 1},
+				}),
+				xmsgbus.WithDeadLetterTopic[*dummyEvent](dlqTopic),
+			)
+			err := xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions()).
+				Publish(ctx, &dummyEvent{Value: 123})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := subscriber.Handle(ctx); (err != nil) != tt.wantErr {
+				t.Errorf("Handle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("HandleEvent calls = %d, want %d", calls, tt.wantCalls)
+			}
+
+			var deadLetter *xmsgbus.DeadLetter
+			dlqSubscriber := xmsgbus.NewSubscriber[*xmsgbus.DeadLetter](
+				dlqTopic,
+				"channel",
+				msgbus,
+				xmsgbus.NewOTELOptions(),
+				manager,
+				xmsgbus.WithHandleFunc[*xmsgbus.DeadLetter](func(ctx context.Context, dst *xmsgbus.DeadLetter) error {
+					deadLetter = dst
+					return nil
+				}),
+			)
+			timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+			defer cancel()
+			_ = dlqSubscriber.Handle(timeoutCtx)
+			if (deadLetter != nil) != tt.wantDeadLetter {
+				t.Fatalf("dead letter = %+v, want %v", deadLetter, tt.wantDeadLetter)
+			}
+			if deadLetter == nil {
+				return
+			}
+			if deadLetter.Attempts != tt.maxAttempts || deadLetter.SourceTopic != "test" || deadLetter.SourceChannel != "channel" {
+				t.Errorf("unexpected dead letter: %+v", deadLetter)
+			}
+			event, err := xmsgbus.DefaultDecodeFunc[*dummyEvent](ctx, deadLetter.Event.Payload)
+			if err != nil || event.Value != 123 {
+				t.Errorf("dead letter event = %+v, err = %v", event, err)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishAfter(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus()
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+	_ = msgbus.AddChannel(ctx, "test", "channel")
+
+	var got *dummyEvent
+	subscriber := xmsgbus.NewSubscriber[*dummyEvent](
+		"test",
+		"channel",
+		msgbus,
+		xmsgbus.NewOTELOptions(),
+		manager,
+		xmsgbus.WithHandleFunc[*dummyEvent](func(ctx context.Context, dst *dummyEvent) error {
+			got = dst
+			return nil
+		}),
+	)
+
+	publishedAt := time.Now()
+	err := xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions()).
+		PublishAfter(ctx, &dummyEvent{Value: 123}, time.Millisecond*200)
+	if err != nil {
+		t.Fatalf("PublishAfter() error = %v", err)
+	}
+	if err := subscriber.Handle(ctx); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	if got == nil || got.Value != 123 {
+		t.Errorf("Handle() got = %+v", got)
+	}
+	if time.Since(publishedAt) < time.Millisecond*200 {
+		t.Errorf("delayed event handled too early: %s", time.Since(publishedAt))
+	}
+}
+
+func TestSubscriber_HandleBatch(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus()
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+	_ = msgbus.AddChannel(ctx, "test", "channel")
+
+	var got [][]*dummyEvent
+	subscriber := xmsgbus.NewSubscriber[*dummyEvent](
+		"test",
+		"channel",
+		msgbus,
+		xmsgbus.NewOTELOptions(),
+		manager,
+		xmsgbus.WithBatchHandleFunc[*dummyEvent](func(ctx context.Context, dst []*dummyEvent) error {
+			got = append(got, dst)
+			return nil
+		}, 2),
+	)
+
+	err := xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions()).
+		PublishBatch(ctx, []*dummyEvent{{Value: 1}, {Value: 2}, {Value: 3}})
+	if err != nil {
+		t.Fatalf("PublishBatch() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := subscriber.Handle(ctx); err != nil {
+			t.Fatalf("Handle() error = %v", err)
+		}
+	}
+	want := [][]*dummyEvent{{{Value: 1}, {Value: 2}}, {{Value: 3}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Handle() got = %+v, want %+v", got, want)
+	}
+}
+
+func TestRunner_Stop(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus()
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+	_ = msgbus.AddChannel(ctx, "test", "channel")
+
+	var (
+		mu      sync.Mutex
+		handled []uint32
+	)
+	subscriber := xmsgbus.NewSubscriber[*dummyEvent](
+		"test",
+		"channel",
+		msgbus,
+		xmsgbus.NewOTELOptions(),
+		manager,
+		xmsgbus.WithHandleFunc[*dummyEvent](func(ctx context.Context, dst *dummyEvent) error {
+			time.Sleep(time.Millisecond * 200)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			handled = append(handled, dst.Value)
+			return nil
+		}),
+	)
+	runner := xmsgbus.NewRunner("test_runner", subscriber, xmsgbus.WithRunnerConcurrency(2))
+	var _ graceful.IExiting = runner
+	if err := runner.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	publisher := xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions())
+	for i := 1; i <= 2; i++ {
+		if err := publisher.Publish(ctx, &dummyEvent{Value: uint32(i)}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	// 等待两条消息都进入处理流程
+	time.Sleep(time.Millisecond * 50)
+
+	stopCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	startAt := time.Now()
+	if err := runner.Stop(stopCtx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if time.Since(startAt) > time.Second {
+		t.Errorf("Stop() took too long: %s", time.Since(startAt))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 2 {
+		t.Errorf("handled = %v, want 2 in-flight events finished", handled)
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	event := &xmsgbus.Event{
+		Metadata:        metadata.New(map[string]string{"test": "123"}),
+		Topic:           "test",
+		Payload:         []byte{0, 1, 2, 255},
+		ContentType:     xmsgbus.ContentTypeMsgpack,
+		ContentEncoding: xmsgbus.CompressionGzip,
+	}
+	frame, err := xmsgbus.EncodeEventFrame(event)
+	if err != nil {
+		t.Fatalf("EncodeEventFrame() error = %v", err)
+	}
+	bs, err := xmsgbus.EncodeEvent(event)
+	if err != nil {
+		t.Fatalf("EncodeEvent() error = %v", err)
+	}
+	legacy, _ := json.Marshal(event)
+	tests := []struct {
+		name    string
+		bs      []byte
+		want    *xmsgbus.Event
+		wantErr bool
+	}{
+		{
+			name: "frame",
+			bs:   frame,
+			want: event,
+		},
+		{
+			name: "json",
+			bs:   bs,
+			want: event,
+		},
+		{
+			name: "legacy json",
+			bs:   legacy,
+			want: event,
+		},
+		{
+			name:    "truncated",
+			bs:      frame[:4],
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			bs:      []byte("garbage"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := xmsgbus.DecodeEvent(tt.bs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeEvent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) && !tt.wantErr {
+				t.Errorf("DecodeEvent() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	codec, err := xmsgbus.GetCodec(xmsgbus.ContentTypeProtobuf)
+	if err != nil {
+		t.Fatalf("GetCodec() error = %v", err)
+	}
+	bs, err := codec.Marshal(wrapperspb.String("test"))
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var dst *wrapperspb.StringValue
+	err = codec.Unmarshal(bs, &dst)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if dst.GetValue() != "test" {
+		t.Errorf("Unmarshal() got = %v", dst)
+	}
+	_, err = codec.Marshal(&dummyEvent{})
+	if !errors.Is(err, xmsgbus.ErrNotProtoMessage) {
+		t.Errorf("Marshal() error = %v, want %v", err, xmsgbus.ErrNotProtoMessage)
+	}
+}
+
+func TestSubscriber_HandleCodec(t *testing.T) {
+	type testCase struct {
+		name       string
+		codec      xmsgbus.Codec
+		compressor xmsgbus.Compressor
+		frame      bool
+	}
+	var tests []testCase
+	for _, contentType := range []string{xmsgbus.ContentTypeJSON, xmsgbus.ContentTypeMsgpack} {
+		codec, _ := xmsgbus.GetCodec(contentType)
+		tests = append(tests, testCase{name: contentType, codec: codec})
+		tests = append(tests, testCase{name: contentType + "+frame", codec: codec, frame: true})
+		for _, name := range []string{xmsgbus.CompressionGzip, xmsgbus.CompressionSnappy, xmsgbus.CompressionZstd} {
+			compressor, _ := xmsgbus.GetCompressor(name)
+			tests = append(tests, testCase{name: contentType + "+" + name, codec: codec, compressor: compressor})
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			msgbus := memory.NewMsgBus()
+			storage := memory.NewStorage()
+			manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+			_ = msgbus.AddChannel(ctx, "test", "channel")
+
+			var got *dummyEvent
+			subscriber := xmsgbus.NewSubscriber[*dummyEvent](
+				"test",
+				"channel",
+				msgbus,
+				xmsgbus.NewOTELOptions(),
+				manager,
+				xmsgbus.WithHandleFunc[*dummyEvent](func(ctx context.Context, dst *dummyEvent) error {
+					got = dst
+					return nil
+				}),
+			)
+			opts := []xmsgbus.PublisherOption[*dummyEvent]{xmsgbus.WithCodec[*dummyEvent](tt.codec)}
+			if tt.compressor != nil {
+				opts = append(opts, xmsgbus.WithCompressor[*dummyEvent](tt.compressor, 0))
+			}
+			if tt.frame {
+				opts = append(opts, xmsgbus.WithEventFrame[*dummyEvent]())
+			}
+			err := xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions(), opts...).
+				Publish(ctx, &dummyEvent{Value: 123})
+			if err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+			if err := subscriber.Handle(ctx); err != nil {
+				t.Fatalf("Handle() error = %v", err)
+			}
+			if got == nil || got.Value != 123 {
+				t.Errorf("Handle() got = %+v", got)
+			}
+		})
+	}
+}
+
+func TestCompressor_Limit(t *testing.T) {
+	const limit = 1 << 20
+	zstdCompressor, err := xmsgbus.NewZstdCompressor(limit)
+	if err != nil {
+		t.Fatalf("NewZstdCompressor() error = %v", err)
+	}
+	compressors := []xmsgbus.Compressor{
+		xmsgbus.GzipCompressor{MaxDecompressedSize: limit},
+		xmsgbus.SnappyCompressor{MaxDecompressedSize: limit},
+		zstdCompressor,
+	}
+	for _, compressor := range compressors {
+		t.Run(compressor.Name(), func(t *testing.T) {
+			src, err := compressor.Compress(make([]byte, limit))
+			if err != nil {
+				t.Fatalf("Compress() error = %v", err)
+			}
+			if bs, err := compressor.Decompress(src); err != nil || len(bs) != limit {
+				t.Fatalf("Decompress() len = %d, error = %v", len(bs), err)
+			}
+
+			src, err = compressor.Compress(make([]byte, limit+1))
+			if err != nil {
+				t.Fatalf("Compress() error = %v", err)
+			}
+			if _, err := compressor.Decompress(src); !errors.Is(err, xmsgbus.ErrDecompressedTooLarge) {
+				t.Errorf("Decompress() error = %v, want %v", err, xmsgbus.ErrDecompressedTooLarge)
+			}
+		})
+	}
+}
+
+func TestSubscriber_HandleRaw(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus()
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+	_ = msgbus.AddChannel(ctx, "test", "channel")
+
+	encode := func(ctx context.Context, dst *dummyEvent) ([]byte, error) {
+		return []byte(fmt.Sprint(dst.Value)), nil
+	}
+	err := xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions(), xmsgbus.WithEncodeFunc[*dummyEvent](encode)).
+		Publish(ctx, &dummyEvent{Value: 123})
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	subscriber := xmsgbus.NewSubscriber[*dummyEvent](
+		"test",
+		"channel",
+		msgbus,
+		xmsgbus.NewOTELOptions(),
+		manager,
+		xmsgbus.WithHandleFunc[*dummyEvent](func(ctx context.Context, dst *dummyEvent) error {
+			return nil
+		}),
+	)
+	if err := subscriber.Handle(ctx); !errors.Is(err, xmsgbus.ErrDecodeFuncRequired) {
+		t.Errorf("Handle() error = %v, want %v", err, xmsgbus.ErrDecodeFuncRequired)
+	}
+}
+
+type orderedEvent struct {
+	Key   string
+	Value int
+}
+
+func (x *orderedEvent) Topic() string {
+	return "test"
+}
+
+func (x *orderedEvent) OrderingKey() string {
+	return x.Key
+}
+
+func TestSubscriber_HandleOrdered(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus(memory.WithMsgBusMaxBufferOption(128), memory.WithMsgBusPartitionsOption(4))
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+	_ = msgbus.AddChannel(ctx, "test", "channel")
+
+	const (
+		keys  = 4
+		count = 20
+	)
+	var (
+		mu      sync.Mutex
+		handled = make(map[string][]int)
+		wg      sync.WaitGroup
+	)
+	wg.Add(keys * count)
+	subscriber := xmsgbus.NewSubscriber[*orderedEvent](
+		"test",
+		"channel",
+		msgbus,
+		xmsgbus.NewOTELOptions(),
+		manager,
+		xmsgbus.WithOrdered[*orderedEvent](),
+		xmsgbus.WithHandleFunc[*orderedEvent](func(ctx context.Context, dst *orderedEvent) error {
+			defer wg.Done()
+			// 打乱不同分区的处理耗时
+			time.Sleep(time.Millisecond * time.Duration(dst.Value%3))
+			mu.Lock()
+			defer mu.Unlock()
+			handled[dst.Key] = append(handled[dst.Key], dst.Value)
+			return nil
+		}),
+	)
+	runner := xmsgbus.NewRunner("test_ordered_runner", subscriber, xmsgbus.WithRunnerConcurrency(4))
+	if err := runner.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer runner.Stop(ctx)
+
+	publisher := xmsgbus.NewPublisher[*orderedEvent](msgbus, manager, xmsgbus.NewOTELOptions())
+	for i := 0; i < count; i++ {
+		for k := 0; k < keys; k++ {
+			err := publisher.Publish(ctx, &orderedEvent{Key: fmt.Sprintf("key-%d", k), Value: i})
+			if err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("timeout waiting for ordered events")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for key, values := range handled {
+		for i, v := range values {
+			if v != i {
+				t.Fatalf("key %s handled out of order: %v", key, values)
+			}
+		}
+	}
+}
+
+func TestSubscriber_HandleOrderedRejected(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus(memory.WithMsgBusPartitionsOption(2))
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+	_ = msgbus.AddChannel(ctx, "test", "channel")
+
+	const count = 5
+	var (
+		mu       sync.Mutex
+		handled  []int
+		rejected bool
+		wg       sync.WaitGroup
+	)
+	wg.Add(count)
+	subscriber := xmsgbus.NewSubscriber[*orderedEvent](
+		"test",
+		"channel",
+		msgbus,
+		xmsgbus.NewOTELOptions(),
+		manager,
+		xmsgbus.WithOrdered[*orderedEvent](),
+		xmsgbus.WithRetryPolicy[*orderedEvent](xmsgbus.RetryPolicy{
+			MaxAttempts: 1,
+			Backoff:     netutil.BackoffConfig{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Factor: 1},
+		}),
+		// 第一条消息被限流拒绝一次
+		xmsgbus.WithSubscriberInterceptors[*orderedEvent](func(next xaop.AOPHandleFunc[*orderedEvent, struct{}]) xaop.AOPHandleFunc[*orderedEvent, struct{}] {
+			return func(ctx context.Context, event *orderedEvent) (struct{}, error) {
+				mu.Lock()
+				reject := event.Value == 0 && !rejected
+				rejected = rejected || reject
+				mu.Unlock()
+				if reject {
+					return struct{}{}, fmt.Errorf("%w: rate limited", xmsgbus.ErrRejected)
+				}
+				return next(ctx, event)
+			}
+		}),
+		xmsgbus.WithHandleFunc[*orderedEvent](func(ctx context.Context, dst *orderedEvent) error {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			handled = append(handled, dst.Value)
+			return nil
+		}),
+	)
+
+	publisher := xmsgbus.NewPublisher[*orderedEvent](msgbus, manager, xmsgbus.NewOTELOptions())
+	for i := 0; i < count; i++ {
+		if err := publisher.Publish(ctx, &orderedEvent{Key: "key", Value: i}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	runner := xmsgbus.NewRunner("test_ordered_rejected_runner", subscriber, xmsgbus.WithRunnerConcurrency(2))
+	if err := runner.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer runner.Stop(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("timeout waiting for ordered events")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !rejected || !reflect.DeepEqual(handled, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("handled = %v, rejected = %v, want [0 1 2 3 4] after a rejection", handled, rejected)
+	}
+}
+
+func TestSubscriber_HandleOrderedRequired(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus(memory.WithMsgBusPartitionsOption(4))
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+
+	subscriber := xmsgbus.NewSubscriber[*orderedEvent](
+		"test",
+		"channel",
+		msgbus,
+		xmsgbus.NewOTELOptions(),
+		manager,
+		xmsgbus.WithHandleFunc[*orderedEvent](func(ctx context.Context, dst *orderedEvent) error {
+			return nil
+		}),
+	)
+	if err := subscriber.Handle(ctx); !errors.Is(err, xmsgbus.ErrOrderedRequired) {
+		t.Errorf("Handle() error = %v, want %v", err, xmsgbus.ErrOrderedRequired)
+	}
+}
+
+func TestPublisher_PublishAtOrdered(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus(memory.WithMsgBusPartitionsOption(4))
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+	_ = msgbus.AddChannel(ctx, "test", "channel")
+
+	// 到期的消息不会进入分区队列，有序订阅者收不到，直接拒绝
+	err := xmsgbus.NewPublisher[*orderedEvent](msgbus, manager, xmsgbus.NewOTELOptions()).
+		PublishAfter(ctx, &orderedEvent{Key: "key", Value: 1}, time.Millisecond)
+	if !errors.Is(err, xmsgbus.ErrOrderingNotSupported) {
+		t.Fatalf("PublishAfter() error = %v, want %v", err, xmsgbus.ErrOrderingNotSupported)
+	}
+
+	// 没有 key 的消息照常延迟投递
+	err = xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions()).
+		PublishAfter(ctx, &dummyEvent{Value: 1}, time.Millisecond)
+	if err != nil {
+		t.Fatalf("PublishAfter() error = %v", err)
+	}
+	if _, _, err := msgbus.Pop(ctx, "test", "channel", time.Second); err != nil {
+		t.Fatalf("Pop() error = %v", err)
+	}
+}
+
+func TestDeduplicator_Claim(t *testing.T) {
+	tests := []struct {
+		name         string
+		deduplicator xmsgbus.IDeduplicator
+	}{
+		{
+			name:         "storage",
+			deduplicator: xmsgbus.NewStorageDeduplicator(memory.NewStorage(), time.Minute, time.Minute),
+		},
+		{
+			name:         "bloom",
+			deduplicator: xmsgbus.NewBloomDeduplicator(1000, 0.001, time.Minute),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			if state, err := tt.deduplicator.Claim(ctx, "key"); state != xmsgbus.DedupClaimed || err != nil {
+				t.Fatalf("Claim() = %v, %v, want %v", state, err, xmsgbus.DedupClaimed)
+			}
+			if state, _ := tt.deduplicator.Claim(ctx, "key"); state != xmsgbus.DedupInProgress {
+				t.Fatalf("Claim() twice = %v, want %v", state, xmsgbus.DedupInProgress)
+			}
+			if err := tt.deduplicator.Release(ctx, "key"); err != nil {
+				t.Fatalf("Release() error = %v", err)
+			}
+			if state, _ := tt.deduplicator.Claim(ctx, "key"); state != xmsgbus.DedupClaimed {
+				t.Fatalf("Claim() after Release = %v, want %v", state, xmsgbus.DedupClaimed)
+			}
+			if err := tt.deduplicator.Commit(ctx, "key"); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			if state, _ := tt.deduplicator.Claim(ctx, "key"); state != xmsgbus.DedupDone {
+				t.Fatalf("Claim() after Commit = %v, want %v", state, xmsgbus.DedupDone)
+			}
+		})
+	}
+}
+
+func TestSubscriber_HandleDeduplicator(t *testing.T) {
+	tests := []struct {
+		name         string
+		deduplicator xmsgbus.IDeduplicator
+	}{
+		{
+			name:         "storage",
+			deduplicator: xmsgbus.NewStorageDeduplicator(memory.NewStorage(), time.Minute, time.Minute),
+		},
+		{
+			name:         "bloom",
+			deduplicator: xmsgbus.NewBloomDeduplicator(1000, 0.001, time.Minute),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			msgbus := memory.NewMsgBus()
+			storage := memory.NewStorage()
+			manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+			_ = msgbus.AddChannel(ctx, "test", "channel")
+
+			var handled []uint32
+			subscriber := xmsgbus.NewSubscriber[*dummyEvent](
+				"test",
+				"channel",
+				msgbus,
+				xmsgbus.NewOTELOptions(),
+				manager,
+				xmsgbus.WithDeduplicator[*dummyEvent](tt.deduplicator),
+				xmsgbus.WithHandleFunc[*dummyEvent](func(ctx context.Context, dst *dummyEvent) error {
+					handled = append(handled, dst.Value)
+					return nil
+				}),
+			)
+
+			err := xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions()).
+				Publish(ctx, &dummyEvent{Value: 1})
+			if err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+			bs, _, err := msgbus.Pop(ctx, "test", "channel", time.Second)
+			if err != nil {
+				t.Fatalf("Pop() error = %v", err)
+			}
+			event, err := xmsgbus.DecodeEvent(bs)
+			if err != nil {
+				t.Fatalf("DecodeEvent() error = %v", err)
+			}
+			if event.ID == "" {
+				t.Fatalf("Publish() did not stamp event ID")
+			}
+			// 模拟重复投递
+			for i := 0; i < 3; i++ {
+				_ = msgbus.Push(ctx, "test", bs)
+				if err := subscriber.Handle(ctx); err != nil {
+					t.Fatalf("Handle() error = %v", err)
+				}
+			}
+			if !reflect.DeepEqual(handled, []uint32{1}) {
+				t.Errorf("handled = %v, want [1]", handled)
+			}
+		})
+	}
+}
+
+// crashedDeduplicator 丢弃 Release，模拟进程在处理过程中退出，认领没有被释放
+type crashedDeduplicator struct {
+	xmsgbus.IDeduplicator
+}
+
+func (x *crashedDeduplicator) Release(ctx context.Context, key string) error {
+	return nil
+}
+
+func TestSubscriber_HandleDeduplicatorCrash(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus()
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+	_ = msgbus.AddChannel(ctx, "test", "channel")
+
+	claimTTL := 100 * time.Millisecond
+	deduplicator := &crashedDeduplicator{xmsgbus.NewStorageDeduplicator(memory.NewStorage(), claimTTL, time.Minute)}
+	var (
+		calls   int
+		handled []uint32
+	)
+	subscriber := xmsgbus.NewSubscriber[*dummyEvent](
+		"test",
+		"channel",
+		msgbus,
+		xmsgbus.NewOTELOptions(),
+		manager,
+		xmsgbus.WithDeduplicator[*dummyEvent](deduplicator),
+		xmsgbus.WithRetryPolicy[*dummyEvent](xmsgbus.RetryPolicy{MaxAttempts: 1}),
+		xmsgbus.WithHandleFunc[*dummyEvent](func(ctx context.Context, dst *dummyEvent) error {
+			calls++
+			// 第一次处理时进程退出，消息没有被确认
+			if calls == 1 {
+				return fmt.Errorf("%w: crash", xmsgbus.ErrRejected)
+			}
+			handled = append(handled, dst.Value)
+			return nil
+		}),
+	)
+
+	err := xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions()).
+		Publish(ctx, &dummyEvent{Value: 1})
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	bs, _, err := msgbus.Pop(ctx, "test", "channel", time.Second)
+	if err != nil {
+		t.Fatalf("Pop() error = %v", err)
+	}
+	redeliver := func() {
+		t.Helper()
+		_ = msgbus.Push(ctx, "test", bs)
+		if err := subscriber.Handle(ctx); err != nil && !errors.Is(err, xmsgbus.ErrRejected) {
+			t.Fatalf("Handle() error = %v", err)
+		}
+	}
+
+	redeliver()
+	// 认领过期之前重新投递的消息不会被当作重复消息确认
+	redeliver()
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1 while the claim is alive", calls)
+	}
+	time.Sleep(2 * claimTTL)
+	redeliver()
+	if !reflect.DeepEqual(handled, []uint32{1}) {
+		t.Fatalf("handled = %v, want [1] after the claim expired", handled)
+	}
+	// 处理完成之后重复投递的消息被跳过
+	redeliver()
+	if !reflect.DeepEqual(handled, []uint32{1}) {
+		t.Errorf("handled = %v, want [1]", handled)
+	}
+}
+
+func TestSubscriber_HandleInterceptors(t *testing.T) {
+	ctx := context.TODO()
+	msgbus := memory.NewMsgBus()
+	storage := memory.NewStorage()
+	manager := xmsgbus.NewTopicManager(ctx, msgbus, newSimpleCas(), storage)
+	_ = msgbus.AddChannel(ctx, "test", "channel")
+	_ = msgbus.AddChannel(ctx, "test_dlq", "channel")
+
+	var (
+		trace     []string
+		calls     int
+		rejecting bool
+	)
+	record := func(name string) xmsgbus.Interceptor[*dummyEvent] {
+		return func(next xaop.AOPHandleFunc[*dummyEvent, struct{}]) xaop.AOPHandleFunc[*dummyEvent, struct{}] {
+			return func(ctx context.Context, event *dummyEvent) (struct{}, error) {
+				invocation, _ := xmsgbus.InvocationFromContext(ctx)
+				trace = append(trace, fmt.Sprintf("%s:%s", name, invocation.Kind))
+				if rejecting {
+					return struct{}{}, fmt.Errorf("%w: test", xmsgbus.ErrRejected)
+				}
+				return next(ctx, event)
+			}
+		}
+	}
+	subscriber := xmsgbus.NewSubscriber[*dummyEvent](
+		"test",
+		"channel",
+		msgbus,
+		xmsgbus.NewOTELOptions(),
+		manager,
+		xmsgbus.WithRetryPolicy[*dummyEvent](xmsgbus.RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     netutil.BackoffConfig{MaxDelay: time.Millisecond, BaseDelay: time.Millisecond, Factor: 1},
+		}),
+		xmsgbus.WithDeadLetterTopic[*dummyEvent]("test_dlq"),
+		xmsgbus.WithSubscriberInterceptors[*dummyEvent](
+			xmsgbus.RecoveryInterceptor[*dummyEvent](),
+			xmsgbus.LoggingInterceptor[*dummyEvent](xlogger.DefaultLogger),
+			record("subscriber"),
+		),
+		xmsgbus.WithHandleFunc[*dummyEvent](func(ctx context.Context, dst *dummyEvent) error {
+			calls++
+			if calls == 1 {
+				panic("boom")
+			}
+			return nil
+		}),
+	)
+	publisher := xmsgbus.NewPublisher[*dummyEvent](msgbus, manager, xmsgbus.NewOTELOptions(),
+		xmsgbus.WithPublisherInterceptors[*dummyEvent](record("publisher")),
+	)
+
+	if err := publisher.Publish(ctx, &dummyEvent{Value: 1}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	// 第一次处理 panic 被转换为错误后重试成功
+	if err := subscriber.Handle(ctx); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	want := []string{"publisher:publish", "subscriber:subscribe", "subscriber:subscribe"}
+	if !reflect.DeepEqual(trace, want) || calls != 2 {
+		t.Fatalf("trace = %v, calls = %d, want %v, 2", trace, calls, want)
+	}
+
+	// 被拒绝的消息不进入死信
+	if err := publisher.Publish(ctx, &dummyEvent{Value: 2}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	rejecting = true
+	if err := subscriber.Handle(ctx); !errors.Is(err, xmsgbus.ErrRejected) {
+		t.Fatalf("Handle() error = %v, want %v", err, xmsgbus.ErrRejected)
+	}
+	_, _, err := msgbus.Pop(ctx, "test_dlq", "channel", time.Millisecond*10)
+	if !errors.Is(err, xmsgbus.ErrPopTimeout) {
+		t.Errorf("rejected event was dead lettered, err = %v", err)
+	}
+}